@@ -4,7 +4,7 @@ import (
 	//"github.com/snuffpuppet/spectre/fingerprint"
 	"fmt"
 	"math"
-	"github.com/snuffpuppet/spectre/lookup"
+	"sync"
 )
 
 /*
@@ -15,8 +15,9 @@ import (
  * Temporal matches are currently just a simple list of matches that get checked
  */
 type location struct {
-	mic  float64
-	song float64
+	mic   float64
+	song  float64
+	speed float64 // song time per mic second, from the spans of the fingerprints (1 if they don't have spans)
 }
 
 type audioHit struct {
@@ -38,38 +39,118 @@ func (a audioHits) String() (s string) {
 	return
 }
 
+const VECTOR_NEIGHBOURS = 5 // most near keys registered for each vector lookup
+const MAX_SPEED = 1.25      // hits implying playback faster (or slower) than this are ignored
+
+// The matching state for one stream.  All methods are safe to call from several goroutines, and any number of
+// matchers can share one Library.
 type AudioMatcher struct {
-	timeThreshold  float64
-	FingerprintLib lookup.Matches
-	FrequencyHits  map[string][]location
+	mu            sync.Mutex
+	timeThreshold float64
+	lib           *Library
+	frequencyHits map[string][]location
+	fits          map[string]driftFit // last drift model fitted for each track
+	window        float64             // seconds of hits kept while following a stream, 0 to keep them all
+	halfLife      float64             // seconds for the vote of a hit to halve, 0 for no decay
+	now           float64             // latest mic time seen
+	lock          lock                // what the stream is locked on
+	updated       float64             // mic time of the last lock update
+	subscribers   subscribers         // who to send lock events to
 }
 
-func New(mappings lookup.Matches, timeThreshold float64) (*AudioMatcher) {
+func New(lib *Library, timeThreshold float64) (*AudioMatcher) {
 	am := AudioMatcher{
 		timeThreshold: timeThreshold,
-		FrequencyHits: make(map[string][]location),
-		FingerprintLib: mappings,
+		frequencyHits: make(map[string][]location),
+		lib: lib,
 	}
 	return &am
 }
 
+// The reference fingerprints the matcher looks hits up in
+func (matcher *AudioMatcher) Library() *Library {
+	return matcher.lib
+}
+
 // register a fingerprint with the audio matcher in order to log the timestamps
 func (matcher *AudioMatcher) Register(key []byte, ts float64) {
-	fpm, ok := matcher.FingerprintLib[string(key)]
-	if !ok {
+	matcher.RegisterSpan(key, ts, 0)
+}
+
+// register a fingerprint covering span seconds of the mic, so that each hit also gives the playback speed
+func (matcher *AudioMatcher) RegisterSpan(key []byte, ts, span float64) {
+	matcher.mu.Lock()
+	defer matcher.mu.Unlock()
+
+	matcher.register(key, ts, span)
+}
+
+func (matcher *AudioMatcher) register(key []byte, ts, span float64) {
+	matcher.now = math.Max(matcher.now, ts)
+	matcher.autoUpdate(ts)
+	postings := matcher.lib.index.Postings(key)
+
+	// we have frequency matches, now add each of them to the list for its track
+	for _, p := range postings {
+		speed := 1.0
+		if span > 0 && p.Span > 0 {
+			speed = float64(p.Span) / span
+			if speed > MAX_SPEED || speed < 1/MAX_SPEED {
+				continue
+			}
+		}
+
+		filename := matcher.lib.index.Track(p.TrackId)
+		timestamps, ok := matcher.frequencyHits[filename]
+		if !ok {
+			timestamps = make([]location, 0)
+		}
+
+		matcher.frequencyHits[filename] = append(timestamps, location{mic: ts, song: float64(p.Offset), speed: speed})
+		//fmt.Printf("Frequency match for %s at %.2f\n", filename, p.Offset)
+	}
+}
+
+// register a fingerprint by its vector, logging the timestamps of the nearest keys in the index
+func (matcher *AudioMatcher) RegisterVector(v []float64, ts float64) {
+	if matcher.lib.vectors == nil {
 		return
 	}
-	// we have  frequency match, now add the match to the list
-	timestamps, ok := matcher.FrequencyHits[fpm.Filename]
-	if !ok {
-		timestamps = make([]location, 1)
+	near := matcher.lib.vectors.Query(v, matcher.lib.radius, VECTOR_NEIGHBOURS)
+
+	matcher.mu.Lock()
+	defer matcher.mu.Unlock()
+	for _, n := range near {
+		matcher.register(n.Key, ts, 0)
 	}
+}
+
+// forget about any hits registered before the given mic time
+func (matcher *AudioMatcher) Forget(before float64) {
+	matcher.mu.Lock()
+	defer matcher.mu.Unlock()
 
-	matcher.FrequencyHits[fpm.Filename] = append(timestamps, location{mic: ts, song: fpm.Timestamp})
-	//fmt.Printf("Frequency match for %s at %.2f\n", fpm.Filename, fpm.Timestamp)
+	matcher.forget(before)
+}
+
+func (matcher *AudioMatcher) forget(before float64) {
+	for filename, ts := range matcher.frequencyHits {
+		keep := 0
+		for keep < len(ts) && ts[keep].mic < before {
+			keep++
+		}
+		if keep == len(ts) {
+			delete(matcher.frequencyHits, filename)
+		} else if keep > 0 {
+			matcher.frequencyHits[filename] = append([]location(nil), ts[keep:]...)
+		}
+	}
 }
 
 func (m *AudioMatcher) Stats() (s string) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+
 	hits, misses, totalHits, totalMisses := m.hitStats()
 	header := fmt.Sprintf("Totals - hits: %d / osync: %d / total: %d", totalHits, totalMisses, totalHits + totalMisses)
 	body := ""
@@ -89,7 +170,7 @@ func (m *AudioMatcher) hitStats() (hits, misses map[string]int, totalHits, total
 	totalHits, totalMisses= 0,0
 
 	// Check through our frequency hit list to see if the time deltas match those of the file
-	for filename, ts := range m.FrequencyHits {
+	for filename, ts := range m.frequencyHits {
 		if len(ts) >1 {
 			for i := 1; i < len(ts); i++ {
 				songTimeDelta := ts[i].song - ts[i-1].song
@@ -112,6 +193,9 @@ func (m *AudioMatcher) hitStats() (hits, misses map[string]int, totalHits, total
 
 // return a slice of audioHits that the caller can use to determine the probability of a match
 func (matcher *AudioMatcher) GetHits() (orderedHits audioHits) {
+	matcher.mu.Lock()
+	defer matcher.mu.Unlock()
+
 	hits, _, totalHits, _ := matcher.hitStats()
 
 	// Hits calculated, now provide a sorted list to the caller
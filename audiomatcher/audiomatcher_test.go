@@ -0,0 +1,85 @@
+package audiomatcher_test
+
+import (
+	"encoding/binary"
+	"github.com/snuffpuppet/spectre/audiomatcher"
+	"github.com/snuffpuppet/spectre/lookup"
+	"math"
+	"math/rand"
+	"sync"
+	"testing"
+)
+
+// the key number as a vector, for approximate lookups
+func keyVector(k []byte) []float64 {
+	return []float64{float64(binary.BigEndian.Uint32(k))}
+}
+
+/*
+ * Many sessions sharing one library, each with its own goroutine registering hits while another reads the matches
+ * and a subscriber takes the events.  Run with -race to check the sharing.
+ */
+func TestParallelSessions(t *testing.T) {
+	idx := lookup.New()
+	for i := 0; i < 5000; i++ {
+		idx.Add(key(i), "film.mkv", float64(i)*0.2)
+	}
+	library := audiomatcher.NewLibrary(idx)
+	library.UseVectors(lookup.IndexLSH(idx, keyVector, 2, 1, 4), 0.5)
+
+	const SESSIONS = 16
+	var wg sync.WaitGroup
+	positions := make([]float64, SESSIONS)
+	for s := 0; s < SESSIONS; s++ {
+		matcher := audiomatcher.New(library, 0.5)
+		matcher.SetWindow(audiomatcher.MATCH_WINDOW, audiomatcher.HIT_HALF_LIFE)
+		events, cancel := matcher.Subscribe(audiomatcher.EVENT_BUFFER)
+		done := make(chan struct{})
+
+		// each session hears the film from a different place
+		start := 50 * s
+		wg.Add(3)
+		go func(s int) {
+			defer wg.Done()
+			defer close(done)
+			defer cancel()
+			r := rand.New(rand.NewSource(int64(s)))
+			for n := 0; n < 150; n++ {
+				mic := float64(n) * 0.2
+				if n%2 == 0 {
+					matcher.Register(key(start+n), mic)
+				} else {
+					matcher.RegisterVector(keyVector(key(start+n)), mic)
+				}
+				matcher.Register(key(r.Intn(5000)), mic)
+			}
+			_, positions[s], _ = matcher.LockPosition(30)
+		}(s)
+		go func() {
+			defer wg.Done()
+			for {
+				select {
+				case <-done:
+					return
+				default:
+				}
+				matcher.Offsets(audiomatcher.OFFSET_BIN_WIDTH)
+				matcher.Drifts()
+				matcher.Stats()
+				matcher.LockPosition(10)
+			}
+		}()
+		go func() {
+			defer wg.Done()
+			for range events {
+			}
+		}()
+	}
+	wg.Wait()
+
+	for s, pos := range positions {
+		if expected := float64(50*s)*0.2 + 30; math.Abs(pos-expected) > 0.2 {
+			t.Errorf("Session %d locked at %.2f, expected %.2f", s, pos, expected)
+		}
+	}
+}
@@ -0,0 +1,274 @@
+package audiomatcher
+
+import (
+	"fmt"
+	"math"
+	"math/rand"
+	"sort"
+)
+
+/*
+ * drift:
+ * Fit a line, song = offset + rate * mic, through the hits for a track so that the playback position is known
+ * between hits and slow drift (a player clock running fast, a slightly stretched transfer) is followed rather than
+ * smeared over several offset bins.
+ * Most hits are usually spurious so the line is first found with RANSAC: lines through random pairs of hits are
+ * tried and the one with the most hits close to it wins.  The previous fit and the histogram offset are always
+ * tried too so the model carries on smoothly as hits arrive.  The rate and offset are then re-estimated from the
+ * hits near the line with Theil-Sen (the median of the slopes between pairs of hits), which isn't pulled about by
+ * the few spurious hits that happen to land near it.
+ * ref: Fischler & Bolles, "Random Sample Consensus", CACM 1981
+ */
+
+const DRIFT_TOLERANCE = 0.2   // seconds a hit can be off the line and still count as agreeing with it
+const DRIFT_ITERATIONS = 200  // random pairs of hits tried as lines
+const DRIFT_MIN_SPACING = 1.0 // mic seconds between a pair of hits for their slope to be worth trying
+const DRIFT_MIN_INLIERS = 5   // hits that must agree before there is a model
+const DRIFT_MAX_PAIRS = 20000 // slopes the Theil-Sen median is taken over, sampled when there are more pairs
+const DRIFT_SEED = 1          // fits are repeatable for the same hits
+
+// A line through the hits for a track
+type DriftModel struct {
+	Filename string
+	Offset   float64 // song time at mic time 0
+	Rate     float64 // song seconds per mic second
+	Sigma    float64 // robust estimate of the spread of the agreeing hits about the line, in seconds
+	Inliers  int     // hits agreeing with the line
+	Total    int     // total hits for the track
+	Latest   float64 // mic time of the latest hit
+
+	micMean float64 // mean mic time of the agreeing hits
+	micSxx  float64 // and the sum of their squared distances from it
+}
+
+// Position in the track at the given mic time along with its standard error, which grows away from the hits the
+// model was fitted to
+func (d DriftModel) Position(micTime float64) (position, uncertainty float64) {
+	position = d.Offset + d.Rate*micTime
+
+	variance := 1 / float64(d.Inliers)
+	if d.micSxx > 0 {
+		dt := micTime - d.micMean
+		variance += dt * dt / d.micSxx
+	}
+
+	return position, d.Sigma * math.Sqrt(variance)
+}
+
+func (d DriftModel) String() string {
+	pos, err := d.Position(d.Latest)
+	return fmt.Sprintf("%4d/%4d at %s ±%.3fs, rate %.5f - %s", d.Inliers, d.Total, FormatTime(pos), err, d.Rate, d.Filename)
+}
+
+type DriftModels []DriftModel
+
+func (d DriftModels) String() (s string) {
+	s = ""
+	for _, v := range d {
+		s += fmt.Sprintf("%s\n", v)
+	}
+
+	return
+}
+
+// The last fit for a track and the hits it was made from, so it is only redone when they change
+type driftFit struct {
+	hits          int
+	first, latest float64
+	model         DriftModel
+	ok            bool
+}
+
+// Fit the drift model for a track, false if not enough hits agree on a line
+func (m *AudioMatcher) Drift(filename string) (DriftModel, bool) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+
+	return m.drift(filename)
+}
+
+func (m *AudioMatcher) drift(filename string) (DriftModel, bool) {
+	ts := m.frequencyHits[filename]
+	if len(ts) == 0 {
+		delete(m.fits, filename)
+		return DriftModel{}, false
+	}
+
+	// hits are only ever added to the end or forgotten from the start
+	prev, fitted := m.fits[filename]
+	if fitted && prev.hits == len(ts) && prev.first == ts[0].mic && prev.latest == ts[len(ts)-1].mic {
+		return prev.model, prev.ok
+	}
+
+	var seeds []DriftModel
+	if fitted && prev.ok {
+		seeds = append(seeds, prev.model)
+	}
+	if o := dominantOffset(ts, OFFSET_BIN_WIDTH, m.weight); o.Votes > 0 {
+		seeds = append(seeds, DriftModel{Offset: o.Offset, Rate: o.Speed})
+	}
+
+	model, ok := fitDrift(ts, seeds)
+	model.Filename = filename
+	if m.fits == nil {
+		m.fits = make(map[string]driftFit)
+	}
+	m.fits[filename] = driftFit{len(ts), ts[0].mic, ts[len(ts)-1].mic, model, ok}
+
+	return model, ok
+}
+
+// Fit the drift model for every track that has one, most agreeing hits first
+func (m *AudioMatcher) Drifts() DriftModels {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+
+	return m.drifts()
+}
+
+func (m *AudioMatcher) drifts() (models DriftModels) {
+	models = make(DriftModels, 0, len(m.frequencyHits))
+	for filename := range m.frequencyHits {
+		if d, ok := m.drift(filename); ok {
+			models = append(models, d)
+		}
+	}
+
+	sort.Slice(models, func(i, j int) bool {
+		if models[i].Inliers != models[j].Inliers {
+			return models[i].Inliers > models[j].Inliers
+		}
+		return models[i].Filename < models[j].Filename
+	})
+
+	return
+}
+
+func (m *AudioMatcher) DriftStats() string {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+
+	models := m.drifts()
+	if len(models) == 0 {
+		return "No matches"
+	}
+
+	best := models[0]
+	pos, err := best.Position(best.Latest)
+	return fmt.Sprintf("Best: %s matched at %s ±%.3fs, rate %.5f\n%s", best.Filename, FormatTime(pos), err, best.Rate, models)
+}
+
+func fitDrift(ts []location, seeds []DriftModel) (model DriftModel, ok bool) {
+	model.Total = len(ts)
+	for _, l := range ts {
+		model.Latest = math.Max(model.Latest, l.mic)
+	}
+
+	// RANSAC for the line most of the hits agree with
+	best, bestVotes := DriftModel{}, 0
+	try := func(d DriftModel) {
+		if v := len(inliers(ts, d)); v > bestVotes {
+			best, bestVotes = d, v
+		}
+	}
+	for _, d := range seeds {
+		try(d)
+	}
+
+	r := rand.New(rand.NewSource(DRIFT_SEED))
+	for i := 0; i < DRIFT_ITERATIONS && len(ts) > 1; i++ {
+		a, b := ts[r.Intn(len(ts))], ts[r.Intn(len(ts))]
+		if math.Abs(b.mic-a.mic) < DRIFT_MIN_SPACING {
+			continue
+		}
+		rate := (b.song - a.song) / (b.mic - a.mic)
+		if rate > MAX_SPEED || rate < 1/MAX_SPEED {
+			continue
+		}
+		try(DriftModel{Offset: a.song - rate*a.mic, Rate: rate})
+	}
+	if bestVotes < DRIFT_MIN_INLIERS {
+		return model, false
+	}
+
+	// Theil-Sen through the hits near the winning line, then take the hits near that
+	in := inliers(ts, best)
+	model.Rate, model.Offset = theilSen(in, best.Rate, r)
+	in = inliers(ts, model)
+	if len(in) < DRIFT_MIN_INLIERS {
+		return model, false
+	}
+	model.Inliers = len(in)
+
+	residuals := make([]float64, len(in))
+	for i, l := range in {
+		residuals[i] = math.Abs(l.song - model.Offset - model.Rate*l.mic)
+		model.micMean += l.mic
+	}
+	model.micMean /= float64(len(in))
+	for _, l := range in {
+		model.micSxx += (l.mic - model.micMean) * (l.mic - model.micMean)
+	}
+
+	// the median absolute deviation scaled to match a normal standard deviation
+	model.Sigma = 1.4826 * median(residuals)
+
+	return model, true
+}
+
+// the hits within DRIFT_TOLERANCE of the line
+func inliers(ts []location, d DriftModel) (in []location) {
+	for _, l := range ts {
+		if math.Abs(l.song-d.Offset-d.Rate*l.mic) <= DRIFT_TOLERANCE {
+			in = append(in, l)
+		}
+	}
+
+	return
+}
+
+// Median slope between pairs of hits and the median intercept at that slope.
+// Pairs are sampled when there are too many to try them all, and rate is kept if no pair can give a slope.
+func theilSen(in []location, rate float64, r *rand.Rand) (float64, float64) {
+	var slopes []float64
+	slope := func(a, b location) {
+		if b.mic != a.mic {
+			slopes = append(slopes, (b.song-a.song)/(b.mic-a.mic))
+		}
+	}
+
+	if n := len(in); n*(n-1)/2 <= DRIFT_MAX_PAIRS {
+		for i := range in {
+			for j := i + 1; j < n; j++ {
+				slope(in[i], in[j])
+			}
+		}
+	} else {
+		for i := 0; i < DRIFT_MAX_PAIRS; i++ {
+			slope(in[r.Intn(n)], in[r.Intn(n)])
+		}
+	}
+	if len(slopes) > 0 {
+		rate = median(slopes)
+	}
+
+	intercepts := make([]float64, len(in))
+	for i, l := range in {
+		intercepts[i] = l.song - rate*l.mic
+	}
+
+	return rate, median(intercepts)
+}
+
+// median of the values, which are sorted in place
+func median(x []float64) float64 {
+	if len(x) == 0 {
+		return 0
+	}
+	sort.Float64s(x)
+	mid := len(x) / 2
+	if len(x)%2 == 0 {
+		return (x[mid-1] + x[mid]) / 2
+	}
+	return x[mid]
+}
@@ -0,0 +1,65 @@
+package audiomatcher_test
+
+import (
+	"github.com/snuffpuppet/spectre/audiomatcher"
+	"github.com/snuffpuppet/spectre/lookup"
+	"math"
+	"math/rand"
+	"testing"
+)
+
+const DRIFT_RATE = 1.0005 // 3.6s of drift over two hours
+
+// A two hour film heard from 10 minutes in with a clock that drifts, three spurious hits for every genuine one
+func drifting(matcher *audiomatcher.AudioMatcher, idx *lookup.Index, from, to int) {
+	r := rand.New(rand.NewSource(int64(from)))
+	for i := from; i < to; i++ {
+		song := 600 + float64(i)*2
+		idx.Add(key(i), "film.mkv", song)
+		for n := 1; n <= 3; n++ {
+			idx.Add(key(i+n*100000), "film.mkv", r.Float64()*7200)
+		}
+
+		mic := (song-600)/DRIFT_RATE + 0.03*r.NormFloat64()
+		matcher.Register(key(i), mic)
+		for n := 1; n <= 3; n++ {
+			matcher.Register(key(i+n*100000), mic)
+		}
+	}
+}
+
+func TestDrift(t *testing.T) {
+	idx := lookup.New()
+	matcher := audiomatcher.New(audiomatcher.NewLibrary(idx), 0.5)
+	if _, ok := matcher.Drift("film.mkv"); ok {
+		t.Fatalf("Drift model with no hits")
+	}
+
+	drifting(matcher, idx, 0, 300)
+	early, ok := matcher.Drift("film.mkv")
+	if !ok {
+		t.Fatalf("No drift model after 10 minutes")
+	}
+
+	// the model follows along as more hits come in
+	drifting(matcher, idx, 300, 3000)
+	d, ok := matcher.Drift("film.mkv")
+	if !ok || d.Inliers <= early.Inliers {
+		t.Fatalf("Drift model didn't update: %s then %s", early, d)
+	}
+	if math.Abs(d.Rate-DRIFT_RATE) > 1e-5 || d.Inliers < 2900 || d.Inliers > 3100 {
+		t.Errorf("Fitted %s, expected rate %.5f with 3000 hits", d, DRIFT_RATE)
+	}
+
+	pos, err := d.Position(3000)
+	if expected := 600 + 3000*DRIFT_RATE; math.Abs(pos-expected) > 0.02 || err <= 0 || err > 0.01 {
+		t.Errorf("Position at 3000s is %.3f ±%.3f, expected %.3f", pos, err, expected)
+	}
+	if _, far := d.Position(20000); far <= err {
+		t.Errorf("Uncertainty %.4f extrapolating isn't more than %.4f within the hits", far, err)
+	}
+
+	if models := matcher.Drifts(); len(models) != 1 || models[0].Filename != "film.mkv" {
+		t.Errorf("Drifts gave %s", models)
+	}
+}
@@ -0,0 +1,96 @@
+package audiomatcher
+
+import (
+	"math"
+	"sync"
+)
+
+/*
+ * events:
+ * Publish the lock events (see lock.go) to subscribers so that they can react to them rather than polling the
+ * matcher.  Subscribers are kept under their own lock so they can come and go while the matcher is busy.  Once
+ * anyone has subscribed, registering hits updates the lock every UPDATE_INTERVAL seconds of mic time, so the audio
+ * goroutine only has to keep registering fingerprints (and call Update through any silence).
+ * Each subscriber gets its own buffered channel.  Events are never allowed to hold up the audio: if a subscriber
+ * falls so far behind that its channel is full, the events it misses are dropped and counted.
+ */
+
+const UPDATE_INTERVAL = 1.0 // mic seconds between lock updates made as hits are registered
+const EVENT_BUFFER = 16     // suggested channel size for subscribers
+
+type subscribers struct {
+	mu      sync.Mutex
+	next    int
+	chans   map[int]chan Event
+	dropped int
+}
+
+// Receive events on a channel with room for buffer events.  The returned function unsubscribes and closes the
+// channel, and is safe to call from any goroutine.
+func (m *AudioMatcher) Subscribe(buffer int) (<-chan Event, func()) {
+	s := &m.subscribers
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	if s.chans == nil {
+		s.chans = make(map[int]chan Event)
+	}
+	id := s.next
+	s.next++
+	ch := make(chan Event, buffer)
+	s.chans[id] = ch
+
+	var once sync.Once
+	return ch, func() {
+		once.Do(func() {
+			s.mu.Lock()
+			defer s.mu.Unlock()
+			delete(s.chans, id)
+			close(ch)
+		})
+	}
+}
+
+// Number of events dropped because a subscriber's channel was full
+func (m *AudioMatcher) Dropped() int {
+	s := &m.subscribers
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	return s.dropped
+}
+
+func (m *AudioMatcher) subscribed() bool {
+	s := &m.subscribers
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	return len(s.chans) > 0
+}
+
+// Send the events to every subscriber without waiting for any of them
+func (m *AudioMatcher) publish(events []Event) {
+	if len(events) == 0 {
+		return
+	}
+	s := &m.subscribers
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	for _, e := range events {
+		for _, ch := range s.chans {
+			select {
+			case ch <- e:
+			default:
+				s.dropped++
+			}
+		}
+	}
+}
+
+// Update the lock if it is due and anyone is listening for events
+func (m *AudioMatcher) autoUpdate(ts float64) {
+	if ts-m.updated >= UPDATE_INTERVAL && m.subscribed() {
+		m.update(math.Floor(ts/UPDATE_INTERVAL) * UPDATE_INTERVAL)
+	}
+}
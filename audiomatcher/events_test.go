@@ -0,0 +1,59 @@
+package audiomatcher_test
+
+import (
+	"github.com/snuffpuppet/spectre/audiomatcher"
+	"github.com/snuffpuppet/spectre/lookup"
+	"math/rand"
+	"testing"
+)
+
+func TestSubscribe(t *testing.T) {
+	idx := lookup.New()
+	for i := 0; i < 10000; i++ {
+		idx.Add(key(i), "film.mkv", float64(i)*0.2)
+	}
+	idx.SetLanguage("film.mkv", "fre")
+	matcher := audiomatcher.New(audiomatcher.NewLibrary(idx), 0.5)
+	matcher.SetWindow(audiomatcher.MATCH_WINDOW, audiomatcher.HIT_HALF_LIFE)
+
+	events, cancel := matcher.Subscribe(audiomatcher.EVENT_BUFFER)
+	got := make(chan []audiomatcher.EventType)
+	go func() {
+		var types []audiomatcher.EventType
+		for e := range events {
+			if e.Language != "fre" {
+				t.Errorf("%s event has language %q, expected fre", e.Type, e.Language)
+			}
+			types = append(types, e.Type)
+		}
+		got <- types
+	}()
+
+	// the film playing from 100s, faintly at first, then stopping after 25s with only spurious hits after that
+	r := rand.New(rand.NewSource(1))
+	for n := 0; n < 225; n++ {
+		mic := float64(n) * 0.2
+		if (mic < 10 && n%5 == 0) || (mic >= 10 && mic < 25) {
+			matcher.Register(key(n+500), mic)
+		}
+		if n%2 == 0 {
+			matcher.Register(key(r.Intn(10000)), mic)
+		}
+	}
+	cancel()
+	cancel()
+
+	expected := []audiomatcher.EventType{audiomatcher.CANDIDATE, audiomatcher.LOCKED, audiomatcher.PAUSED, audiomatcher.LOST}
+	types := <-got
+	if len(types) != len(expected) {
+		t.Fatalf("Got events %v, expected %v", types, expected)
+	}
+	for i := range types {
+		if types[i] != expected[i] {
+			t.Fatalf("Got events %v, expected %v", types, expected)
+		}
+	}
+	if matcher.Dropped() != 0 {
+		t.Errorf("%d events dropped", matcher.Dropped())
+	}
+}
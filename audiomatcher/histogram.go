@@ -0,0 +1,282 @@
+package audiomatcher
+
+import (
+	"fmt"
+	"math"
+	"sort"
+)
+
+/*
+ * histogram:
+ * Score the hits for each track by binning the (song - mic) time offset of every hit.
+ * Hits that are genuine all agree on the offset between the mic and the track so they pile up in one bin, while
+ * spurious hits spread out over the others.  The winning bin gives the playback position in the track directly.
+ * When the fingerprints carry their own speed estimates (see AudioMatcher.RegisterSpan) the offsets are binned at
+ * each speed in turn, song - speed * mic, with only the hits that roughly agree with the speed voting.  The speed
+ * with the strongest offset wins and is then refined with a line through the hits that voted for it.
+ * If the matcher decays its hits (see AudioMatcher.SetWindow) each vote is weighted by the age of its hit so that a
+ * new offset after a seek takes over from the old one quickly.
+ */
+
+const OFFSET_BIN_WIDTH = 0.1 // default width (in seconds) of the offset histogram bins
+const SPEED_BIN_WIDTH = 0.01 // width of the speed histogram bins
+const SPEED_TOLERANCE = 0.1  // hits only vote at speeds within this of their own estimate
+
+// The dominant offset found for a track
+type OffsetMatch struct {
+	Filename   string
+	Language   string  // language of the track's audio, if it was indexed with one
+	Offset     float64 // song time - speed * mic time, in seconds
+	Speed      float64 // song seconds per mic second, 1 unless the fingerprints can tell
+	Votes      int     // hits agreeing with the offset
+	Score      float64 // Votes weighted by the age of the hits, the same as Votes if hits don't decay
+	RunnerUp   int     // hits agreeing with the next best offset for the track
+	Confidence float64 // Score / the runner up's score (Score if there is no runner up)
+	Total      int     // total hits for the track
+	Latest     float64 // mic time of the latest hit
+	Confirmed  float64 // mic time of the latest hit agreeing with the offset
+}
+
+// Position in the track for the given mic time
+func (o OffsetMatch) Position(micTime float64) float64 {
+	return o.Offset + o.Speed*micTime
+}
+
+func (o OffsetMatch) String() string {
+	return fmt.Sprintf("%4d/%4d (x%5.1f) offset %s, speed %.4f - %s", o.Votes, o.Total, o.Confidence, FormatTime(o.Offset), o.Speed, o.Filename)
+}
+
+type OffsetMatches []OffsetMatch
+
+func (o OffsetMatches) String() (s string) {
+	s = ""
+	for _, v := range o {
+		s += fmt.Sprintf("%s\n", v)
+	}
+
+	return
+}
+
+// Find the dominant offset for each track, best match first
+func (m *AudioMatcher) Offsets(binWidth float64) OffsetMatches {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+
+	return m.offsets(binWidth)
+}
+
+func (m *AudioMatcher) offsets(binWidth float64) (matches OffsetMatches) {
+	matches = make(OffsetMatches, 0, len(m.frequencyHits))
+	for filename, ts := range m.frequencyHits {
+		if len(ts) == 0 {
+			continue
+		}
+		match := dominantOffset(ts, binWidth, m.weight)
+		match.Filename = filename
+		match.Language = m.lib.index.Language(filename)
+		matches = append(matches, match)
+	}
+
+	sort.Sort(byScore(matches))
+
+	return
+}
+
+func (m *AudioMatcher) OffsetStats() string {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+
+	matches := m.offsets(OFFSET_BIN_WIDTH)
+	if len(matches) == 0 {
+		return "No matches"
+	}
+
+	best := matches[0]
+	return fmt.Sprintf("Best: %s matched at %s, speed %.4f\n%s", best.Filename, FormatTime(best.Position(best.Latest)), best.Speed, matches)
+}
+
+// Find the speed and offset that most of the hits agree on.
+// Hits without speed estimates are all at exactly 1 so only normal speed is tried for them.
+// Each hit's vote is weighted by weight(mic time).
+func dominantOffset(ts []location, binWidth float64, weight func(float64) float64) (match OffsetMatch) {
+	lo, hi := speedBin(ts[0].speed), speedBin(ts[0].speed)
+	for _, l := range ts {
+		if b := speedBin(l.speed); b < lo {
+			lo = b
+		} else if b > hi {
+			hi = b
+		}
+	}
+
+	// one bin of hits all at a constant speed other than normal still have their speed
+	unknown := true
+	for _, l := range ts {
+		if l.speed != 1 {
+			unknown = false
+			break
+		}
+	}
+
+	normal := speedBin(1)
+	var voters []location
+	for b := lo; b <= hi; b++ {
+		speed := 1.0
+		if !unknown {
+			speed = float64(b) * SPEED_BIN_WIDTH
+		}
+		// ties go to the speed closest to normal
+		m, in := offsetAt(ts, speed, binWidth, weight)
+		if b == lo || m.Score > match.Score || (m.Score == match.Score && abs(b-normal) < abs(speedBin(match.Speed)-normal)) {
+			match, voters = m, in
+		}
+	}
+
+	if !unknown {
+		match = refineSpeed(match, voters, binWidth)
+	}
+	for _, l := range voters {
+		match.Confirmed = math.Max(match.Confirmed, l.mic)
+	}
+
+	match.Total = len(ts)
+	for _, l := range ts {
+		if l.mic > match.Latest {
+			match.Latest = l.mic
+		}
+	}
+
+	return
+}
+
+// Bin the offsets of the hits at the given speed and pick out the strongest.
+// Genuine hits can straddle a bin boundary so each bin is scored along with its two neighbours.
+func offsetAt(ts []location, speed, binWidth float64, weight func(float64) float64) (match OffsetMatch, voters []location) {
+	bins := make(map[int]int)
+	scores := make(map[int]float64)
+	for _, l := range ts {
+		if math.Abs(l.speed-speed) <= SPEED_TOLERANCE {
+			b := offsetBin(l, speed, binWidth)
+			bins[b]++
+			scores[b] += weight(l.mic)
+		}
+	}
+
+	votes := func(b int) (int, float64) {
+		return bins[b-1] + bins[b] + bins[b+1], scores[b-1] + scores[b] + scores[b+1]
+	}
+
+	best, bestVotes, bestScore := 0, 0, 0.0
+	for b := range bins {
+		if v, s := votes(b); s > bestScore || (s == bestScore && b < best) {
+			best, bestVotes, bestScore = b, v, s
+		}
+	}
+
+	// the runner up must not share any bins with the winner
+	runnerUp, runnerUpScore := 0, 0.0
+	for b := range bins {
+		if b < best-2 || b > best+2 {
+			if v, s := votes(b); s > runnerUpScore {
+				runnerUp, runnerUpScore = v, s
+			}
+		}
+	}
+
+	// use the mean of the hits in the winning bins for the offset rather than the bin centre
+	sum := 0.0
+	for _, l := range ts {
+		if math.Abs(l.speed-speed) > SPEED_TOLERANCE {
+			continue
+		}
+		if b := offsetBin(l, speed, binWidth); b >= best-1 && b <= best+1 {
+			sum += l.song - speed*l.mic
+			voters = append(voters, l)
+		}
+	}
+
+	match.Offset = sum / math.Max(float64(bestVotes), 1)
+	match.Speed = speed
+	match.Votes = bestVotes
+	match.Score = bestScore
+	match.RunnerUp = runnerUp
+	match.Confidence = bestScore / math.Max(runnerUpScore, 1)
+
+	return
+}
+
+// The vote can only tell speeds apart when they move the hits by more than the three offset bins the votes come
+// from, so fit a line through the hits that voted for the match to pin the speed down.  The fit is only used if
+// it stays within what the vote could tell apart.
+func refineSpeed(match OffsetMatch, in []location, binWidth float64) OffsetMatch {
+	if len(in) < 2 {
+		return match
+	}
+
+	var mic, song float64
+	first, last := in[0].mic, in[0].mic
+	for _, l := range in {
+		mic += l.mic
+		song += l.song
+		first = math.Min(first, l.mic)
+		last = math.Max(last, l.mic)
+	}
+	mic /= float64(len(in))
+	song /= float64(len(in))
+
+	var cov, variance float64
+	for _, l := range in {
+		cov += (l.mic - mic) * (l.song - song)
+		variance += (l.mic - mic) * (l.mic - mic)
+	}
+	if variance == 0 {
+		return match
+	}
+
+	resolution := math.Max(SPEED_BIN_WIDTH, 3*binWidth/(last-first))
+	if speed := cov / variance; math.Abs(speed-match.Speed) <= resolution {
+		match.Speed = speed
+		match.Offset = song - speed*mic
+	}
+
+	return match
+}
+
+func offsetBin(l location, speed, binWidth float64) int {
+	return int(math.Floor((l.song - speed*l.mic) / binWidth))
+}
+
+func speedBin(speed float64) int {
+	return int(math.Floor(speed/SPEED_BIN_WIDTH + 0.5))
+}
+
+func abs(x int) int {
+	if x < 0 {
+		return -x
+	}
+	return x
+}
+
+// Format a time in seconds as [-]hh:mm:ss.ss
+func FormatTime(secs float64) string {
+	sign := ""
+	if secs < 0 {
+		sign = "-"
+		secs = -secs
+	}
+	h := int(secs / 3600)
+	m := int(secs/60) % 60
+	s := math.Mod(secs, 60)
+
+	return fmt.Sprintf("%s%02d:%02d:%05.2f", sign, h, m, s)
+}
+
+type byScore OffsetMatches
+
+func (a byScore) Len() int      { return len(a) }
+func (a byScore) Swap(i, j int) { a[i], a[j] = a[j], a[i] }
+func (a byScore) Less(i, j int) bool {
+	if a[i].Score != a[j].Score {
+		return a[i].Score > a[j].Score
+	}
+	return a[i].Filename < a[j].Filename
+}
@@ -0,0 +1,179 @@
+package audiomatcher_test
+
+import (
+	"encoding/binary"
+	"github.com/snuffpuppet/spectre/audiomatcher"
+	"github.com/snuffpuppet/spectre/lookup"
+	"math"
+	"math/rand"
+	"strings"
+	"testing"
+)
+
+func key(n int) []byte {
+	k := make([]byte, 4)
+	binary.BigEndian.PutUint32(k, uint32(n))
+	return k
+}
+
+// A reference track with a fingerprint every 50ms, each covering half a second
+func spanIndex() *lookup.Index {
+	idx := lookup.New()
+	for i := 0; i < 2000; i++ {
+		idx.AddSpan(key(i), "film.mkv", float64(i)*0.05, 0.5)
+		idx.AddSpan(key(i), "other.mkv", float64(i)*0.05, 0.5)
+	}
+	idx.SetLanguage("film.mkv", "eng")
+	return idx
+}
+
+// The film heard from 60s on, at the given speed, with some hits from other keys mixed in
+func listen(matcher *audiomatcher.AudioMatcher, speed float64) {
+	r := rand.New(rand.NewSource(1))
+	for i := 1200; i < 1400; i++ {
+		mic := (float64(i)*0.05 - 60) / speed
+		jitter := 1 + 0.02*r.NormFloat64()
+		matcher.RegisterSpan(key(i), mic, 0.5/speed*jitter)
+		matcher.RegisterSpan(key(r.Intn(2000)), mic, 0.5*jitter)
+	}
+}
+
+func TestOffsetsSpeed(t *testing.T) {
+	pal := 25 / 23.976
+	for _, speed := range []float64{1, pal, 1 / pal} {
+		matcher := audiomatcher.New(audiomatcher.NewLibrary(spanIndex()), 0.5)
+		listen(matcher, speed)
+
+		matches := matcher.Offsets(audiomatcher.OFFSET_BIN_WIDTH)
+		if len(matches) == 0 {
+			t.Fatalf("No matches at speed %.4f", speed)
+		}
+		best := matches[0]
+		if math.Abs(best.Speed-speed) > 0.001 || math.Abs(best.Position(5)-(60+5*speed)) > 0.05 {
+			t.Errorf("Matched %s, expected speed %.4f at 60s", best, speed)
+		}
+		if best.Filename != "film.mkv" || best.Language != "eng" {
+			t.Errorf("Matched %s in %q, expected film.mkv in eng", best.Filename, best.Language)
+		}
+	}
+
+	matcher := audiomatcher.New(audiomatcher.NewLibrary(spanIndex()), 0.5)
+	listen(matcher, pal)
+	if s := matcher.OffsetStats(); !strings.Contains(s, "matched at 00:01:09.9") || !strings.Contains(s, "speed 1.04") {
+		t.Errorf("Stats don't give the position and speed:\n%s", s)
+	}
+}
+
+func TestOffsetsWithoutSpeed(t *testing.T) {
+	idx := lookup.New()
+	for i := 0; i < 100; i++ {
+		idx.Add(key(i), "film.mkv", float64(i)*0.1)
+	}
+
+	// without spans the speed is exactly normal
+	matcher := audiomatcher.New(audiomatcher.NewLibrary(idx), 0.5)
+	for i := 50; i < 100; i++ {
+		matcher.Register(key(i), float64(i)*0.1-3)
+	}
+	best := matcher.Offsets(audiomatcher.OFFSET_BIN_WIDTH)[0]
+	if best.Speed != 1 || math.Abs(best.Offset-3) > 1e-6 || best.Votes != 50 {
+		t.Errorf("Matched %s, expected offset 3s at normal speed", best)
+	}
+}
+
+// Spans that all give the same speed, away from normal, still say what the speed is
+func TestOffsetsConstantSpeed(t *testing.T) {
+	matcher := audiomatcher.New(audiomatcher.NewLibrary(spanIndex()), 0.5)
+	for i := 1200; i < 1220; i++ {
+		mic := (float64(i)*0.05 - 60) / 1.04
+		matcher.RegisterSpan(key(i), mic, 0.5/1.04)
+	}
+
+	matches := matcher.Offsets(audiomatcher.OFFSET_BIN_WIDTH)
+	if len(matches) == 0 {
+		t.Fatalf("No matches at a constant speed")
+	}
+	best := matches[0]
+	if math.Abs(best.Speed-1.04) > 0.001 || math.Abs(best.Position(0)-60) > 0.05 || best.Votes != 20 {
+		t.Errorf("Matched %s, expected speed 1.04 at 60s with all 20 hits", best)
+	}
+}
+
+// A reference track with a fingerprint every 100ms
+func tenthIndex(tracks ...string) *lookup.Index {
+	idx := lookup.New()
+	for i := 0; i < 1000; i++ {
+		for _, track := range tracks {
+			idx.Add(key(i), track, float64(i)*0.1)
+		}
+	}
+	return idx
+}
+
+func TestOffsetsDominant(t *testing.T) {
+	matcher := audiomatcher.New(audiomatcher.NewLibrary(tenthIndex("film.mkv")), 0.5)
+
+	// the film heard from 40s on, with spurious hits spread over the rest of it
+	r := rand.New(rand.NewSource(1))
+	for i := 400; i < 460; i++ {
+		mic := float64(i)*0.1 - 40
+		matcher.Register(key(i), mic)
+		if i%3 == 0 {
+			matcher.Register(key(r.Intn(1000)), mic)
+		}
+	}
+
+	matches := matcher.Offsets(audiomatcher.OFFSET_BIN_WIDTH)
+	if len(matches) != 1 {
+		t.Fatalf("Got %d matches, expected 1", len(matches))
+	}
+	best := matches[0]
+	if math.Abs(best.Offset-40) > 0.05 || best.Votes < 60 || best.Total != 80 {
+		t.Errorf("Matched %s, expected at least 60 of 80 hits at 40s", best)
+	}
+	if best.RunnerUp >= best.Votes/4 || best.Confidence < 4 {
+		t.Errorf("Runner up has %d votes (x%.1f), expected far fewer than %d", best.RunnerUp, best.Confidence, best.Votes)
+	}
+	if math.Abs(best.Latest-5.9) > 1e-6 || math.Abs(best.Confirmed-5.9) > 1e-6 {
+		t.Errorf("Latest hit at %.2f, confirmed at %.2f, expected both at 5.9", best.Latest, best.Confirmed)
+	}
+}
+
+func TestOffsetsTies(t *testing.T) {
+	// two offsets in one track with as many hits each, the earlier one wins
+	matcher := audiomatcher.New(audiomatcher.NewLibrary(tenthIndex("film.mkv")), 0.5)
+	for i := 0; i < 10; i++ {
+		matcher.Register(key(500+i), float64(i)*0.1+30)
+		matcher.Register(key(100+i), float64(i)*0.1)
+	}
+	best := matcher.Offsets(audiomatcher.OFFSET_BIN_WIDTH)[0]
+	if math.Abs(best.Offset-10) > 1e-6 || best.Votes != 10 || best.RunnerUp != 10 || best.Confidence != 1 {
+		t.Errorf("Matched %s with runner up %d, expected 10 votes at 10s and a runner up of 10", best, best.RunnerUp)
+	}
+
+	// two tracks that match as well as each other come out in name order
+	matcher = audiomatcher.New(audiomatcher.NewLibrary(tenthIndex("b.mkv", "a.mkv")), 0.5)
+	for i := 0; i < 10; i++ {
+		matcher.Register(key(100+i), float64(i)*0.1)
+	}
+	matches := matcher.Offsets(audiomatcher.OFFSET_BIN_WIDTH)
+	if len(matches) != 2 || matches[0].Filename != "a.mkv" || matches[1].Filename != "b.mkv" || matches[0].Score != matches[1].Score {
+		t.Errorf("Tied matches are:\n%s", matches)
+	}
+}
+
+func TestOffsetsEmpty(t *testing.T) {
+	matcher := audiomatcher.New(audiomatcher.NewLibrary(tenthIndex("film.mkv")), 0.5)
+	if matches := matcher.Offsets(audiomatcher.OFFSET_BIN_WIDTH); len(matches) != 0 {
+		t.Errorf("Matches without any hits:\n%s", matches)
+	}
+
+	// keys that aren't in the index aren't hits
+	matcher.Register(key(5000), 1)
+	if matches := matcher.Offsets(audiomatcher.OFFSET_BIN_WIDTH); len(matches) != 0 {
+		t.Errorf("Matches for an unknown key:\n%s", matches)
+	}
+	if s := matcher.OffsetStats(); s != "No matches" {
+		t.Errorf("Stats without any hits are %q", s)
+	}
+}
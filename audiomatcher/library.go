@@ -0,0 +1,37 @@
+package audiomatcher
+
+import "github.com/snuffpuppet/spectre/lookup"
+
+/*
+ * library:
+ * The reference fingerprints that hits are looked up in, kept apart from the matchers so that one copy can be
+ * shared by every stream being matched.  Once it has been set up a library is only ever read, which makes it safe
+ * to use from any number of goroutines without locking.
+ */
+
+type Library struct {
+	index   *lookup.Index
+	vectors *lookup.LSH // for approximate lookups, if in use
+	radius  float64     // how far away a vector can be and still match
+}
+
+func NewLibrary(index *lookup.Index) *Library {
+	return &Library{index: index}
+}
+
+// Allow fingerprints to be registered by vector, matching keys in the index within radius of them.
+// This must be done before any matchers start using the library.
+func (lib *Library) UseVectors(vectors *lookup.LSH, radius float64) {
+	lib.vectors = vectors
+	lib.radius = radius
+}
+
+// Number of distinct fingerprint keys
+func (lib *Library) Len() int {
+	return lib.index.Len()
+}
+
+// Names of all the tracks, indexed by track id
+func (lib *Library) Tracks() []string {
+	return lib.index.Tracks()
+}
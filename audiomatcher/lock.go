@@ -0,0 +1,230 @@
+package audiomatcher
+
+import (
+	"fmt"
+	"math"
+)
+
+/*
+ * lock:
+ * Follow a live stream (a film playing) and report when the match on it changes.
+ * Only the hits from the last few seconds are kept and older hits count for less, halving in weight every
+ * half life, so when the viewer skips a chapter the new offset overtakes the old one within a couple of seconds
+ * rather than having to outvote everything heard so far.  Each update checks the best offset against the current
+ * lock and reports what happened as an Event: the first lock, a seek to another position, a pause when nothing
+ * agrees with the lock any more, and the lock being lost altogether.  While paused the position stays put and a
+ * match at that position again resumes the lock.  Before there is a lock, the best offset is reported as a
+ * candidate whenever it changes.
+ */
+
+const MATCH_WINDOW = 10.0    // seconds of hits kept for following a stream
+const HIT_HALF_LIFE = 1.5    // seconds for the vote of a hit to halve
+const LOCK_SCORE = 3.0       // weighted hits needed agreeing on an offset before locking
+const LOCK_CONFIDENCE = 2.0  // and how much better than the runner up the offset must be
+const OFFSET_TOLERANCE = 0.5 // seconds a position can move and still be the same lock
+const PAUSE_AFTER = 3.0      // seconds without a hit agreeing with the lock before it is paused
+const LOST_AFTER = 15.0      // seconds without a hit agreeing with the lock before it is lost
+const CANDIDATE_SCORE = 1.5  // weighted hits agreeing on an offset before it is reported as a candidate
+
+type EventType int
+
+const (
+	LOCKED    EventType = iota // a position has been found, or found again after a pause
+	SEEKED                     // the position has jumped (From to Position)
+	PAUSED                     // nothing has agreed with the position for a while
+	LOST                       // and still nothing much later
+	CANDIDATE                  // the best match so far, not yet good enough to lock on
+)
+
+func (e EventType) String() string {
+	switch e {
+	case LOCKED:
+		return "locked"
+	case SEEKED:
+		return "seeked"
+	case PAUSED:
+		return "paused"
+	case LOST:
+		return "lost"
+	case CANDIDATE:
+		return "candidate"
+	}
+	return "unknown"
+}
+
+// A change in the match on a stream
+type Event struct {
+	Type       EventType
+	Time       float64 // mic time of the update that found it
+	Filename   string
+	Language   string  // language of the track's audio, if it was indexed with one
+	Position   float64 // track position at Time
+	From       float64 // position before a seek
+	Offset     float64 // track time - speed * mic time
+	Speed      float64 // track seconds per mic second
+	Confidence float64
+}
+
+func (e Event) String() string {
+	switch e.Type {
+	case SEEKED:
+		return fmt.Sprintf("%s on %s from %s to %s, speed %.4f (x%.1f)", e.Type, e.Filename, FormatTime(e.From), FormatTime(e.Position), e.Speed, e.Confidence)
+	case LOCKED, CANDIDATE:
+		return fmt.Sprintf("%s on %s at %s, speed %.4f (x%.1f)", e.Type, e.Filename, FormatTime(e.Position), e.Speed, e.Confidence)
+	}
+	return fmt.Sprintf("%s on %s at %s", e.Type, e.Filename, FormatTime(e.Position))
+}
+
+type lockState int
+
+const (
+	searching lockState = iota
+	locked
+	paused
+	lost
+)
+
+// The position of the track relative to the mic
+type lock struct {
+	state      lockState
+	filename   string
+	language   string
+	offset     float64 // track time - speed * mic time
+	speed      float64
+	confidence float64
+	confirmed  float64 // mic time of the latest hit agreeing with the lock
+	candidate  Event   // latest candidate reported while searching
+}
+
+// Position in the track at the given mic time, which stands still while paused
+func (l *lock) position(now float64) float64 {
+	if l.state == paused {
+		now = l.confirmed
+	}
+	return l.offset + l.speed*now
+}
+
+func (l *lock) set(o OffsetMatch) {
+	l.filename, l.language = o.Filename, o.Language
+	l.offset, l.speed = o.Offset, o.Speed
+	l.confidence = o.Confidence
+	l.confirmed = o.Confirmed
+	l.candidate = Event{}
+}
+
+func (l *lock) event(t EventType, now float64) Event {
+	return Event{Type: t, Time: now, Filename: l.filename, Language: l.language, Position: l.position(now), Offset: l.offset, Speed: l.speed, Confidence: l.confidence}
+}
+
+// Keep only the last window seconds of hits and halve the vote of a hit every halfLife seconds (0 for no decay).
+// Hits are forgotten as the stream is followed with Update.
+func (m *AudioMatcher) SetWindow(window, halfLife float64) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+
+	m.window = window
+	m.halfLife = halfLife
+}
+
+// the vote of a hit at the given mic time
+func (m *AudioMatcher) weight(mic float64) float64 {
+	if m.halfLife <= 0 {
+		return 1
+	}
+	return math.Pow(0.5, (m.now-mic)/m.halfLife)
+}
+
+// Check the latest hits against the lock at the given mic time, returning what has changed.
+// The events are also sent to any subscribers.
+func (m *AudioMatcher) Update(now float64) []Event {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+
+	return m.update(now)
+}
+
+func (m *AudioMatcher) update(now float64) (events []Event) {
+	defer func() {
+		m.publish(events)
+	}()
+
+	m.now = math.Max(m.now, now)
+	m.updated = now
+	if m.window > 0 {
+		m.forget(now - m.window)
+	}
+
+	var best *OffsetMatch
+	if matches := m.offsets(OFFSET_BIN_WIDTH); len(matches) > 0 {
+		best = &matches[0]
+	}
+	good := best != nil && best.Score >= LOCK_SCORE && best.Confidence >= LOCK_CONFIDENCE && now-best.Confirmed <= PAUSE_AFTER
+
+	l := &m.lock
+	following := l.state == locked || l.state == paused
+	switch {
+	case good && following && m.sameLock(*best, now):
+		// still on the same lock, follow any slow drift
+		resumed := l.state == paused
+		l.state = locked
+		l.set(*best)
+		if resumed {
+			events = append(events, l.event(LOCKED, now))
+		}
+	case good && following:
+		from := l.position(now)
+		l.state = locked
+		l.set(*best)
+		e := l.event(SEEKED, now)
+		e.From = from
+		events = append(events, e)
+	case good:
+		l.state = locked
+		l.set(*best)
+		events = append(events, l.event(LOCKED, now))
+	case following && now-l.confirmed > LOST_AFTER:
+		events = append(events, l.event(LOST, now))
+		l.state = lost
+	case l.state == locked && now-l.confirmed > PAUSE_AFTER:
+		l.state = paused
+		events = append(events, l.event(PAUSED, now))
+	case !following && best != nil && best.Score >= CANDIDATE_SCORE:
+		c := Event{Type: CANDIDATE, Time: now, Filename: best.Filename, Language: best.Language, Position: best.Position(now), Offset: best.Offset, Speed: best.Speed, Confidence: best.Confidence}
+		if p := l.candidate; p.Filename != c.Filename || math.Abs(p.Position+p.Speed*(now-p.Time)-c.Position) >= OFFSET_TOLERANCE {
+			l.candidate = c
+			events = append(events, c)
+		}
+	}
+
+	return
+}
+
+// Whether the match carries on from the lock.  After a pause the track has been playing again since the first hit
+// agreeing with the match, so that is where the position has to line up with the paused one.
+func (m *AudioMatcher) sameLock(o OffsetMatch, now float64) bool {
+	l := &m.lock
+	if o.Filename != l.filename {
+		return false
+	}
+	if l.state == paused {
+		for _, h := range m.frequencyHits[o.Filename] {
+			if h.mic > l.confirmed && math.Abs(h.song-o.Position(h.mic)) < OFFSET_TOLERANCE {
+				now = h.mic
+				break
+			}
+		}
+	}
+
+	return math.Abs(o.Position(now)-l.position(now)) < OFFSET_TOLERANCE
+}
+
+// Track and position the stream is locked on at the given mic time, false if it has never locked
+func (m *AudioMatcher) LockPosition(now float64) (filename string, position float64, ok bool) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+
+	if m.lock.state == searching {
+		return "", 0, false
+	}
+	return m.lock.filename, m.lock.position(now), true
+}
@@ -0,0 +1,78 @@
+package audiomatcher_test
+
+import (
+	"github.com/snuffpuppet/spectre/audiomatcher"
+	"github.com/snuffpuppet/spectre/lookup"
+	"math"
+	"math/rand"
+	"testing"
+)
+
+func TestLockEvents(t *testing.T) {
+	idx := lookup.New()
+	for i := 0; i < 10000; i++ {
+		idx.Add(key(i), "film.mkv", float64(i)*0.2)
+	}
+	matcher := audiomatcher.New(audiomatcher.NewLibrary(idx), 0.5)
+	matcher.SetWindow(audiomatcher.MATCH_WINDOW, audiomatcher.HIT_HALF_LIFE)
+
+	// where the film is at each mic time: playing from 100s, skipping to 1000s after a minute, pausing for 10s,
+	// then playing for another 30s before being turned off
+	film := func(mic float64) (float64, bool) {
+		switch {
+		case mic < 60:
+			return 100 + mic, true
+		case mic < 120:
+			return 1000 + mic - 60, true
+		case mic >= 130 && mic < 160:
+			return 1060 + mic - 130, true
+		}
+		return 0, false
+	}
+
+	r := rand.New(rand.NewSource(1))
+	var events []audiomatcher.Event
+	for n := 0; n < 1000; n++ {
+		mic := float64(n) * 0.2
+		if pos, ok := film(mic); ok {
+			matcher.Register(key(int(pos/0.2+0.5)), mic)
+		}
+		if n%2 == 0 {
+			matcher.Register(key(r.Intn(10000)), mic)
+		}
+		if n%5 == 0 {
+			events = append(events, matcher.Update(mic)...)
+		}
+		if mic == 125 {
+			if _, pos, ok := matcher.LockPosition(mic); !ok || math.Abs(pos-1059.8) > 0.1 {
+				t.Errorf("Paused at %.2f, expected 1059.80", pos)
+			}
+		}
+	}
+
+	expected := []struct {
+		event    audiomatcher.EventType
+		from, to float64 // mic times the event should happen between
+	}{
+		{audiomatcher.LOCKED, 0, 2},
+		{audiomatcher.SEEKED, 60, 63},
+		{audiomatcher.PAUSED, 120, 124},
+		{audiomatcher.LOCKED, 130, 133},
+		{audiomatcher.PAUSED, 160, 164},
+		{audiomatcher.LOST, 174, 176},
+	}
+	if len(events) != len(expected) {
+		t.Fatalf("Got events %v", events)
+	}
+	for i, e := range events {
+		if e.Type != expected[i].event || e.Time < expected[i].from || e.Time > expected[i].to || e.Filename != "film.mkv" {
+			t.Errorf("Event %d was %s at %.1f, expected %s between %.0f and %.0f", i, e, e.Time, expected[i].event, expected[i].from, expected[i].to)
+		}
+		if pos, ok := film(e.Time); ok && e.Type != audiomatcher.PAUSED && math.Abs(e.Position-pos) > 0.2 {
+			t.Errorf("Event %d was %s, expected position %.2f", i, e, pos)
+		}
+	}
+	if seek := events[1]; math.Abs(seek.From-(100+seek.Time)) > 0.2 {
+		t.Errorf("Seeked from %.2f, expected %.2f", seek.From, 100+seek.Time)
+	}
+}
@@ -1,6 +1,7 @@
 package main
 
 import (
+	"context"
 	"fmt"
 	"log"
 	"flag"
@@ -8,6 +9,7 @@ import (
 	"os"
 	"github.com/snuffpuppet/spectre/pcm"
 	"github.com/snuffpuppet/spectre/fingerprint"
+	"github.com/snuffpuppet/spectre/ffmpeg"
 	"io"
 )
 
@@ -39,16 +41,25 @@ func dumpBands(f *pcm.Frame, s spectral.Spectra, verbose bool) {
 	printSpectra(f, fp, true)
 }
 
-func dumpFiles(filenames []string, analyser spectral.Analyser, optVerbose bool) (err error) {
+// With a hop the blocks are analysed in overlapping windows, a new one every hop samples
+func dumpFiles(filenames []string, analyser spectral.Analyser, hop int, optVerbose bool) (err error) {
 
 	for _, filename := range filenames {
 		fmt.Printf("Dumping %s...\n", filename)
-		stream, err := pcm.NewFileStream(filename, fingerprint.SAMPLE_RATE, fingerprint.BLOCK_SIZE)
+		stream, err := pcm.NewFileStream(context.Background(), filename, fingerprint.SAMPLE_RATE, fingerprint.BLOCK_SIZE)
 		if (err != nil) {
 			return err
 		}
 
-		err = dumpStream(filename, stream, analyser, optVerbose)
+		var in pcm.Reader = stream
+		if hop > 0 {
+			if in, err = pcm.NewOverlapReader(stream, fingerprint.BLOCK_SIZE, hop, fingerprint.SAMPLE_RATE); err != nil {
+				stream.Close()
+				return err
+			}
+		}
+
+		err = dumpStream(filename, in, analyser, optVerbose)
 
 		stream.Close()
 	}
@@ -57,7 +68,6 @@ func dumpFiles(filenames []string, analyser spectral.Analyser, optVerbose bool)
 }
 
 func dumpStream(filename string, stream pcm.Reader, analyser spectral.Analyser, optVerbose bool) (error) {
-	fnum := 0
 	duration := 5
 
 	for {
@@ -69,14 +79,13 @@ func dumpStream(filename string, stream pcm.Reader, analyser spectral.Analyser,
 			return err
 		}
 
-		fnum++
 		spectra := analyser(frame.AsFloat64(), fingerprint.SAMPLE_RATE, fingerprint.NFFT, fingerprint.NOVERLAP, fingerprint.DB_SCALING)
 
 		//dumpPeaks(frame, spectra, optVerbose)
 
 		dumpBands(frame, spectra, optVerbose)
 
-		if fnum >= fingerprint.BLOCKS_PER_SECOND * duration {
+		if frame.Timestamp() >= float64(duration) {
 			break
 		}
 	}
@@ -85,15 +94,44 @@ func dumpStream(filename string, stream pcm.Reader, analyser spectral.Analyser,
 }
 
 
+// Write the spectrogram of a file out as an image
+func dumpImage(filename, imagename string) error {
+	stream, err := pcm.NewFileStream(context.Background(), filename, fingerprint.SAMPLE_RATE, fingerprint.BLOCK_SIZE)
+	if err != nil {
+		return err
+	}
+	defer stream.Close()
+
+	s, err := spectral.ReadSpectrogram(stream, fingerprint.SAMPLE_RATE, fingerprint.LANDMARK_NFFT, fingerprint.LANDMARK_HOP)
+	if err != nil {
+		return err
+	}
+
+	out, err := os.Create(imagename)
+	if err != nil {
+		return err
+	}
+	if err = s.DB().WritePGM(out); err != nil {
+		out.Close()
+		return err
+	}
+	fmt.Printf("Wrote %d x %d spectrogram of %s to %s\n", s.Len(), len(s.Freqs), filename, imagename)
+
+	return out.Close()
+}
+
 func main() {
-	var optAnalyser string
-	var optSeconds int
-	var optVerbose bool
+	var optAnalyser, optImage string
+	var optSeconds, optHop int
+	var optVerbose, optProbe bool
 	var analyser spectral.Analyser
 
 	flag.BoolVar(&optVerbose, "verbose", false, "Verbose output of spectral analysis data")
 	flag.StringVar(&optAnalyser, "analyser", "pwelch", "Spectral analyser to use (pwelch | bespoke)")
 	flag.IntVar(&optSeconds, "seconds", 0, "Limit scan to number of seconds")
+	flag.StringVar(&optImage, "image", "", "Write the spectrogram of the first file to this PGM image")
+	flag.IntVar(&optHop, "hop", 0, fmt.Sprintf("Analyse overlapping windows of %d samples, starting a new one every hop samples (0 for back to back blocks)", fingerprint.BLOCK_SIZE))
+	flag.BoolVar(&optProbe, "probe", false, "Describe the audio streams in each file (with ffprobe) instead of dumping them")
 
 	flag.Parse()
 
@@ -116,9 +154,26 @@ func main() {
 
 	filenames := flag.Args()
 
+	if optProbe {
+		for _, filename := range filenames {
+			info, err := ffmpeg.Probe(context.Background(), filename)
+			if err != nil {
+				log.Fatalf("Fatal Error probing: %s", err)
+			}
+			fmt.Println(info)
+		}
+		return
+	}
+
+	if optImage != "" {
+		if err := dumpImage(filenames[0], optImage); err != nil {
+			log.Fatalf("Fatal Error writing spectrogram: %s", err)
+		}
+	}
+
 	fmt.Printf("Using '%s' analysis to generate fingerprints for %v\n", optAnalyser, filenames)
 
-	err := dumpFiles(filenames, analyser, optVerbose)
+	err := dumpFiles(filenames, analyser, optHop, optVerbose)
 	if err != nil {
 		log.Fatalf("Fatal Error dumping: %s", err)
 	}
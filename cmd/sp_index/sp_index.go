@@ -0,0 +1,88 @@
+package main
+
+import (
+	"context"
+	"flag"
+	"fmt"
+	"github.com/snuffpuppet/spectre/fingerprint"
+	"github.com/snuffpuppet/spectre/indexer"
+	"github.com/snuffpuppet/spectre/lookup"
+	"github.com/snuffpuppet/spectre/spectral"
+	"log"
+	"os"
+	"os/signal"
+	"runtime"
+)
+
+/*
+ * sp_index:
+ * Fingerprint a set of reference audio files once and save the results to a database file
+ * that the other commands can load instead of decoding the media every time.
+ */
+
+func main() {
+	var optVerbose bool
+	var optWorkers int
+	var optAnalyser, optFingerprint, optOutput, optAudio string
+	var analyser spectral.Analyser
+
+	flag.BoolVar(&optVerbose, "verbose", false, "Verbose output of spectral analysis data")
+	flag.StringVar(&optAnalyser, "analyser", "bespoke", "Spectral analyser to use (pwelch | bespoke)")
+	flag.StringVar(&optFingerprint, "fingerprint", fingerprint.PRINTER_BANDED, "Fingerprinting method to use (banded | quantised | chroma | chromaprint | landmark | panako | philips)")
+	flag.IntVar(&optWorkers, "workers", runtime.NumCPU(), "Number of files to fingerprint at once")
+	flag.StringVar(&optAudio, "audio", "", "Audio streams of each file to index: a stream number, a language (eng, fre...) or all, each tagged with its language (default stream if not given)")
+	flag.StringVar(&optOutput, "output", "", "Database file to write the fingerprints to")
+
+	flag.Parse()
+
+	// Ctrl-C stops the indexing, killing any ffmpeg processes
+	ctx, stop := signal.NotifyContext(context.Background(), os.Interrupt, os.Kill)
+	defer stop()
+
+	switch optAnalyser {
+	case "bespoke":
+		analyser = spectral.Amplitude
+	case "pwelch":
+		analyser = spectral.Pwelch
+	default:
+		flag.PrintDefaults()
+		log.Fatalf("Unrecognised spectral analyser requested: '%s'", optAnalyser)
+	}
+
+	if optOutput == "" {
+		log.Println("Error: No -output database file given")
+		flag.PrintDefaults()
+		os.Exit(1)
+	}
+
+	if len(flag.Args()) == 0 {
+		log.Println("Error: No audio files given to index")
+		flag.PrintDefaults()
+		os.Exit(1)
+	}
+
+	filenames := flag.Args()
+
+	newPrinter := func(silenceThreshold float64) (fingerprint.Printer, error) {
+		return fingerprint.NewPrinter(optFingerprint, analyser, silenceThreshold)
+	}
+
+	// check the fingerprinter is valid before doing any work
+	if _, err := newPrinter(fingerprint.FILE_SILENCE_THRESHOLD); err != nil {
+		flag.PrintDefaults()
+		log.Fatal(err)
+	}
+
+	fmt.Printf("Using '%s' analysis with '%s' fingerprints for %v\n", optAnalyser, optFingerprint, filenames)
+
+	fingerprints := lookup.New()
+	if err := indexer.Files(ctx, fingerprints, filenames, optAudio, newPrinter, optWorkers, optVerbose); err != nil {
+		log.Fatalf("Fatal Error generating fingerprints: %s", err)
+	}
+
+	if err := fingerprints.Save(optOutput, indexer.Params(optFingerprint, optAnalyser)); err != nil {
+		log.Fatalf("Fatal Error saving fingerprints: %s", err)
+	}
+
+	fmt.Printf("Saved %d keys (%d fingerprints) for %d tracks to %s\n", fingerprints.Len(), fingerprints.Size(), len(fingerprints.Tracks()), optOutput)
+}
@@ -1,6 +1,8 @@
 package main
 
 import (
+	"context"
+	"errors"
 	"flag"
 	"github.com/snuffpuppet/spectre/spectral"
 	"log"
@@ -9,135 +11,137 @@ import (
 	"github.com/snuffpuppet/spectre/pcm"
 	"github.com/snuffpuppet/spectre/audiomatcher"
 	"os/signal"
+	"runtime"
 	"io"
 	"github.com/snuffpuppet/spectre/fingerprint"
 	"github.com/snuffpuppet/spectre/lookup"
+	"github.com/snuffpuppet/spectre/indexer"
 )
 
-func loadFiles(filenames []string, analyser spectral.Analyser, optVerbose bool) (matches lookup.Matches, err error) {
-
-	matches = lookup.New()
-
-	for _, filename := range filenames {
-		fmt.Printf("Processing fingerprints for %s...\n", filename)
-		stream, err := pcm.NewFileStream(filename, fingerprint.SAMPLE_RATE, fingerprint.BLOCK_SIZE)
-		if (err != nil) {
-			return nil, err
-		}
-
-		matches, err = loadStream(filename, stream, matches, analyser, optVerbose)
-
-		stream.Close()
-	}
-
-	return matches, nil
-}
-
-func listen(stream pcm.StartReader, matcher *audiomatcher.AudioMatcher, analyser spectral.Analyser, optVerbose bool) error {
-	sig := make(chan os.Signal, 1)
-	signal.Notify(sig, os.Interrupt, os.Kill)
+const LSH_HASHES = 4  // projections combined in each LSH table
+const LSH_WIDTH = 4.0 // bucket width of each projection
 
+func listen(ctx context.Context, stream pcm.StartReader, matcher *audiomatcher.AudioMatcher, printer fingerprint.Printer, register func(fp fingerprint.Print), stats func() string, optVerbose bool) error {
 	if err := stream.Start(); err != nil {
 		return fmt.Errorf("Error starting microphone recording: %s", err)
 	}
 
-	fmt.Printf("Listening for %d fingerprints.  Press Ctrl-C to stop\n", len(matcher.FingerprintLib))
+	fmt.Printf("Listening for %d fingerprints.  Press Ctrl-C to stop\n", matcher.Library().Len())
 
 	for {
 		frame, err := stream.Read()
 		if err != nil {
 			if err == io.EOF || err == io.ErrUnexpectedEOF {
+				for _, fp := range printer.Flush() {
+					register(fp)
+				}
 				return nil
 			}
-			log.Fatalf("Error reading microphone: %s", err)
+			return fmt.Errorf("Error reading microphone: %w", err)
 		}
 
-		fp := fingerprint.Generate(analyser, frame.AsFloat64(), fingerprint.MIC_SILENCE_THRESHOLD)
+		prints := printer.Prints(frame)
 
-		if fp != nil {
+		for _, fp := range prints {
+			indexer.PrintStatus(fp.Source, frame, optVerbose)
 
-			printStatus(fp, frame, optVerbose)
-
-			matcher.Register(fingerprint.Hash(fp.Fingerprint()), frame.Timestamp())
+			register(fp)
+		}
 
-			// Check every second to see if they are certain enough to be a match
-			if frame.BlockId() % fingerprint.BLOCKS_PER_SECOND == 0 {
-				log.Printf("(%.2f) %s\n", frame.Timestamp(), matcher.Stats())
-				//hits := matcher.GetHits()
-				//if len(hits) > 0 {
-					//fmt.Println(hits)
-				//}
-			}
+		// Check every second to see if they are certain enough to be a match
+		if frame.BlockId() % fingerprint.BLOCKS_PER_SECOND == 0 {
+			log.Printf("(%.2f) %s\n", frame.Timestamp(), stats())
+			//hits := matcher.GetHits()
+			//if len(hits) > 0 {
+				//fmt.Println(hits)
+			//}
 		}
 
-		select {
-		case <-sig:
-			return nil
-		default:
+		if err := ctx.Err(); err != nil {
+			return fmt.Errorf("Listening: %w", err)
 		}
 	}
 
 }
 
-func loadStream(filename string, stream pcm.Reader, matches lookup.Matches, analyser spectral.Analyser, optVerbose bool) (lookup.Matches, error){
-	clashCount, fpCount := 0, 0
+// Listen using 32 bit sub-fingerprints, matching the latest block of them by bit error rate
+func listenBits(ctx context.Context, stream pcm.StartReader, bits *lookup.BitIndex, printer fingerprint.Printer, blockSize int, threshold float64, optVerbose bool) error {
+	if err := stream.Start(); err != nil {
+		return fmt.Errorf("Error starting microphone recording: %s", err)
+	}
+
+	fmt.Println("Listening for sub-fingerprints.  Press Ctrl-C to stop")
+
+	// the latest block of sub-fingerprints and their times
+	block := make([]uint32, 0, blockSize)
+	times := make([]float64, 0, blockSize)
+
 	for {
 		frame, err := stream.Read()
-		if (err != nil) {
-			if (err == io.EOF || err == io.ErrUnexpectedEOF) {
-				break
+		if err != nil {
+			if err == io.EOF || err == io.ErrUnexpectedEOF {
+				return nil
 			}
-			return matches, err
+			return fmt.Errorf("Error reading microphone: %w", err)
 		}
 
-		fp := fingerprint.Generate(analyser, frame.AsFloat64(), fingerprint.FILE_SILENCE_THRESHOLD)
+		for _, fp := range printer.Prints(frame) {
+			indexer.PrintStatus(fp.Source, frame, optVerbose)
 
-		printStatus(fp, frame, optVerbose)
-
-		if fp != nil {
-			fpCount++
-/*			if _, ok := matches[string(fp.Fingerprint())]; ok {
-				clashCount++
+			// only sub-fingerprints can be matched by bit error rate
+			sub, ok := fp.Source.(fingerprint.SubFingerprint)
+			if !ok {
+				continue
 			}
-			matches[string(fp.Fingerprint())] = audiomatcher.Match{filename, frame.Timestamp()}
-*/
-			key := fingerprint.Hash(fp.Fingerprint())
-			if _, ok := matches.Lookup(key); ok {
-				clashCount++
+			if len(block) == blockSize {
+				block = append(block[:0], block[1:]...)
+				times = append(times[:0], times[1:]...)
 			}
-			matches.Add(key, filename, frame.Timestamp())
+			block = append(block, sub.Bits)
+			times = append(times, sub.Timestamp)
 		}
-	}
 
-	log.Printf("%s:\tFingerprints %d, hash clashes: %d\n", filename, fpCount, clashCount)
-
-	return matches, nil
-}
+		// Check every second once there is a full block to match
+		if frame.BlockId() % fingerprint.BLOCKS_PER_SECOND == 0 && len(block) == blockSize {
+			if m, ok := bits.Match(block, times[0], threshold); ok {
+				log.Printf("(%.2f) %s\n", frame.Timestamp(), m)
+			} else {
+				log.Printf("(%.2f) no match (best BER %.3f)\n", frame.Timestamp(), m.BER)
+			}
+		}
 
-func printStatus(fp fmt.Stringer, frame *pcm.Frame, verbose bool) {
-	if verbose {
-		header := fmt.Sprintf("[%4d:%6.2f]", frame.BlockId(), frame.Timestamp())
-		if fp == nil {
-			fmt.Printf("%s fp: nil\n", header)
-		} else {
-			//fmt.Printf("%s %s\n", header, fp.Candidates)
-			fmt.Printf("%s %s\n", header, fp)
-			//fmt.Printf("%s -> Key: %v\n\n", header, fp.Fingerprint())
+		if err := ctx.Err(); err != nil {
+			return fmt.Errorf("Listening: %w", err)
 		}
 	}
 }
 
 func main() {
-	var optVerbose bool
-	var optAnalyser, optInput string
+	var optVerbose, optProbe, optEvents bool
+	var optTables, optWorkers int
+	var optRadius float64
+	var optAnalyser, optInput, optFingerprint, optScoring, optDatabase, optAudio string
 	var analyser spectral.Analyser
 
 	flag.BoolVar(&optVerbose, "verbose", false, "Verbose output of spectral analysis data")
 	flag.StringVar(&optAnalyser, "analyser", "bespoke", "Spectral analyser to use (pwelch | bespoke)")
 	flag.StringVar(&optInput, "input", "", "Input file to use instead of microphone")
+	flag.StringVar(&optFingerprint, "fingerprint", fingerprint.PRINTER_BANDED, "Fingerprinting method to use (banded | quantised | chroma | chromaprint | landmark | panako | philips)")
+	flag.BoolVar(&optProbe, "probe", false, "Also look up the neighbouring keys of each fingerprint (quantised, not with -lsh)")
+	flag.IntVar(&optWorkers, "workers", runtime.NumCPU(), "Number of reference files to fingerprint at once")
+	flag.StringVar(&optAudio, "audio", "", "Audio streams of each file to index: a stream number, a language (eng, fre...) or all, each tagged with its language (default stream if not given)")
+	flag.IntVar(&optTables, "lsh", 0, "Look up fingerprints approximately with this many LSH tables (quantised | philips | chromaprint), which already covers the neighbouring keys -probe would look up")
+	flag.Float64Var(&optRadius, "lsh-radius", 2, "Distance a fingerprint can be from a key in the index and still match")
+	flag.StringVar(&optScoring, "scoring", "delta", "Match scoring to use (delta | offset | drift)")
+	flag.BoolVar(&optEvents, "events", false, "Follow the stream and print lock events (candidate | locked | seeked | paused | lost) as they happen")
+	flag.StringVar(&optDatabase, "db", "", "Fingerprint database (from sp_index) to use instead of audio files")
 
 	flag.Parse()
 
+	// Ctrl-C stops whatever is running
+	ctx, stop := signal.NotifyContext(context.Background(), os.Interrupt, os.Kill)
+	defer stop()
+
 	switch optAnalyser {
 	case "bespoke":
 		analyser = spectral.Amplitude
@@ -149,7 +153,18 @@ func main() {
 
 	}
 
-	if (len(flag.Args()) == 0) {
+	if optScoring != "delta" && optScoring != "offset" && optScoring != "drift" {
+		flag.PrintDefaults()
+		log.Fatalf("Unrecognised match scoring requested: '%s'", optScoring)
+	}
+
+	// the LSH lookup replaces the exact lookup of each key and the keys near it
+	if optProbe && optTables > 0 {
+		flag.PrintDefaults()
+		log.Fatalf("The -probe option can't be used with -lsh, whose approximate lookups already find the neighbouring keys")
+	}
+
+	if (len(flag.Args()) == 0 && optDatabase == "") {
 		log.Println("Error: No audio files found to match against")
 		flag.PrintDefaults()
 		os.Exit(1)
@@ -157,29 +172,125 @@ func main() {
 
 	filenames := flag.Args()
 
-	fmt.Printf("Using '%s' analysis to generate fingerprints for %v\n", optAnalyser, filenames)
+	newPrinter := func(silenceThreshold float64) (fingerprint.Printer, error) {
+		return fingerprint.NewPrinter(optFingerprint, analyser, silenceThreshold)
+	}
+
+	// check the fingerprinter is valid before doing any work
+	if _, err := newPrinter(fingerprint.FILE_SILENCE_THRESHOLD); err != nil {
+		flag.PrintDefaults()
+		log.Fatal(err)
+	}
 
-	fingerprints, err := loadFiles(filenames, analyser, optVerbose)
+	var fingerprints *lookup.Index
+	var err error
+	if optDatabase != "" {
+		fmt.Printf("Loading '%s' fingerprints from %s\n", optFingerprint, optDatabase)
+		fingerprints, err = lookup.Load(optDatabase, indexer.Params(optFingerprint, optAnalyser))
+	} else {
+		fmt.Printf("Using '%s' analysis with '%s' fingerprints for %v\n", optAnalyser, optFingerprint, filenames)
+		fingerprints = lookup.New()
+		err = indexer.Files(ctx, fingerprints, filenames, optAudio, newPrinter, optWorkers, optVerbose)
+	}
 	if err != nil {
 		log.Fatalf("Fatal Error generating fingerprints: %s", err)
 	}
 
 	var input pcm.StartReader
 	if optInput != "" {
-		input, err = pcm.NewFileStream(optInput, fingerprint.SAMPLE_RATE, fingerprint.BLOCK_SIZE)
+		input, err = pcm.NewFileStream(ctx, optInput, fingerprint.SAMPLE_RATE, fingerprint.BLOCK_SIZE)
 	} else {
-		input, err = pcm.NewMicStream(fingerprint.SAMPLE_RATE, fingerprint.BLOCK_SIZE)
+		input, err = pcm.NewMicReader(ctx, fingerprint.SAMPLE_RATE, fingerprint.BLOCK_SIZE)
 	}
 	if err != nil {
 		log.Fatalf("Fatal Error opening stream: %s", err)
 	}
 
-	matcher := audiomatcher.New(fingerprints, fingerprint.TIME_DELTA_THRESHOLD)
-
-	err = listen(input, matcher, analyser, optVerbose)
+	printer, err := newPrinter(fingerprint.MIC_SILENCE_THRESHOLD)
 	if err != nil {
+		log.Fatal(err)
+	}
+
+	// approximate lookups of the keys (or sub-fingerprints) in the index
+	var vectors *lookup.LSH
+	var decode func(key []byte) []float64
+	if optTables > 0 {
+		decode, err = fingerprint.KeyVector(optFingerprint)
+		if err != nil {
+			log.Fatal(err)
+		}
+		vectors = lookup.IndexLSH(fingerprints, decode, optTables, LSH_HASHES, LSH_WIDTH)
+		fmt.Printf("Indexed %d fingerprint vectors in %d tables\n", vectors.Len(), optTables)
+	}
+
+	// sub-fingerprints are matched a block at a time by bit error rate rather than by key
+	switch optFingerprint {
+	case fingerprint.PRINTER_PHILIPS:
+		bits := lookup.NewBitIndex(fingerprints, fingerprint.PhilipsHop(fingerprint.SAMPLE_RATE))
+		if vectors != nil {
+			bits.UseVectors(vectors, decode, optRadius)
+		}
+		if err = listenBits(ctx, input, bits, printer, fingerprint.PHILIPS_BLOCK, fingerprint.PHILIPS_BER_THRESHOLD, optVerbose); err != nil && !errors.Is(err, context.Canceled) {
+			log.Fatalf("Fatal Error listening to stream: %s", err)
+		}
+		return
+	case fingerprint.PRINTER_CHROMAPRINT:
+		bits := lookup.NewBitIndex(fingerprints, fingerprint.ChromaprintHop(fingerprint.SAMPLE_RATE))
+		if vectors != nil {
+			bits.UseVectors(vectors, decode, optRadius)
+		}
+		if err = listenBits(ctx, input, bits, printer, fingerprint.CHROMAPRINT_BLOCK, fingerprint.CHROMAPRINT_BER_THRESHOLD, optVerbose); err != nil && !errors.Is(err, context.Canceled) {
+			log.Fatalf("Fatal Error listening to stream: %s", err)
+		}
+		return
+	}
+
+	// the library is set up before any matching starts and is only read after that
+	library := audiomatcher.NewLibrary(fingerprints)
+	if vectors != nil {
+		library.UseVectors(vectors, optRadius)
+	}
+
+	matcher := audiomatcher.New(library, fingerprint.TIME_DELTA_THRESHOLD)
+	if optEvents {
+		matcher.SetWindow(audiomatcher.MATCH_WINDOW, audiomatcher.HIT_HALF_LIFE)
+		events, cancel := matcher.Subscribe(audiomatcher.EVENT_BUFFER)
+		defer cancel()
+		go func() {
+			for e := range events {
+				log.Printf("(%.2f) **** %s\n", e.Time, e)
+			}
+		}()
+	}
+
+	stats := matcher.Stats
+	switch optScoring {
+	case "offset":
+		stats = matcher.OffsetStats
+	case "drift":
+		stats = matcher.DriftStats
+	}
+
+	// a print is matched by its own key, and optionally the keys near to it
+	register := func(fp fingerprint.Print) {
+		matcher.RegisterSpan(fp.Key, fp.Timestamp, fp.Span)
+		if optProbe {
+			for _, key := range fp.Near {
+				matcher.Register(key, fp.Timestamp)
+			}
+		}
+	}
+	if decode != nil {
+		// the exact key is always one of its own nearest neighbours
+		register = func(fp fingerprint.Print) {
+			matcher.RegisterVector(decode(fp.Key), fp.Timestamp)
+		}
+	}
+
+	err = listen(ctx, input, matcher, printer, register, stats, optVerbose)
+	if err != nil && !errors.Is(err, context.Canceled) {
 		log.Fatalf("Fatal Error listening to stream: %s", err)
 	}
 
-	fmt.Println(matcher.Stats())
+	fmt.Println(stats())
 }
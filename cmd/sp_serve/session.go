@@ -0,0 +1,157 @@
+package main
+
+import (
+	"context"
+	"encoding/binary"
+	"fmt"
+	"github.com/snuffpuppet/spectre/audiomatcher"
+	"github.com/snuffpuppet/spectre/fingerprint"
+	"github.com/snuffpuppet/spectre/pcm"
+)
+
+/*
+ * session:
+ * The recognition state for a single client.  Each session has its own matcher and fingerprint printer,
+ * all of them sharing the server's read-only library.  Audio arrives as signed 16 bit little endian mono PCM at
+ * fingerprint.SAMPLE_RATE in whatever size chunks the client likes and is cut into blocks for the printer here.
+ * Clients with their own fingerprinter can send the prints instead.
+ * The session stops fingerprinting as soon as its context is cancelled, e.g. when the client disconnects.
+ */
+
+// A fingerprint sent by a client (the key is base64 encoded in JSON)
+type clientPrint struct {
+	Key       []byte  `json:"key"`
+	Timestamp float64 `json:"timestamp"`
+	Span      float64 `json:"span,omitempty"` // seconds the print covers, for fingerprints that can tell the speed
+}
+
+type printsRequest struct {
+	Prints []clientPrint `json:"prints"`
+}
+
+type matchResult struct {
+	Track       string  `json:"track"`
+	Language    string  `json:"language,omitempty"`    // the dub matched, if the track was indexed with its language
+	Offset      float64 `json:"offset"`                // track time - speed * client time
+	Speed       float64 `json:"speed"`                 // track seconds per client second
+	Position    float64 `json:"position"`              // track time at the end of the audio received
+	Uncertainty float64 `json:"uncertainty,omitempty"` // standard error of the position, if the drift model has it
+	Votes       int     `json:"votes"`
+	Total       int     `json:"total"`
+	Confidence  float64 `json:"confidence"`
+}
+
+type response struct {
+	Time    float64       `json:"time"` // seconds of audio (or latest print) received
+	Matches []matchResult `json:"matches"`
+	Error   string        `json:"error,omitempty"`
+}
+
+type session struct {
+	ctx     context.Context
+	matcher *audiomatcher.AudioMatcher
+	printer fingerprint.Printer
+	window  float64 // seconds of hits to keep, 0 keeps everything
+
+	pending []int16 // samples waiting for a full block
+	odd     []byte  // half a sample left over from the last chunk
+	blockId int
+	now     float64 // client time of the latest audio or print
+}
+
+func newSession(ctx context.Context, library *audiomatcher.Library, printer fingerprint.Printer, window float64) *session {
+	return &session{
+		ctx:     ctx,
+		matcher: audiomatcher.New(library, fingerprint.TIME_DELTA_THRESHOLD),
+		printer: printer,
+		window:  window,
+		pending: make([]int16, 0, fingerprint.BLOCK_SIZE),
+	}
+}
+
+// Add a chunk of raw pcm data, fingerprinting any complete blocks
+func (s *session) addPCM(data []byte) error {
+	if len(s.odd) > 0 {
+		data = append(s.odd, data...)
+		s.odd = nil
+	}
+	if len(data)%2 != 0 {
+		s.odd = []byte{data[len(data)-1]}
+		data = data[:len(data)-1]
+	}
+
+	for i := 0; i < len(data); i += 2 {
+		s.pending = append(s.pending, int16(binary.LittleEndian.Uint16(data[i:])))
+		if len(s.pending) == fingerprint.BLOCK_SIZE {
+			if err := s.ctx.Err(); err != nil {
+				return fmt.Errorf("Fingerprinting audio: %w", err)
+			}
+			frame := pcm.NewFrame(s.pending, s.blockId, fingerprint.SAMPLE_RATE)
+			s.register(s.printer.Prints(&frame))
+			s.blockId++
+			s.pending = make([]int16, 0, fingerprint.BLOCK_SIZE)
+		}
+	}
+
+	s.now = float64(s.blockId*fingerprint.BLOCK_SIZE+len(s.pending)) / fingerprint.SAMPLE_RATE
+
+	return nil
+}
+
+// Add fingerprints generated by the client
+func (s *session) addPrints(prints []clientPrint) {
+	for _, p := range prints {
+		s.matcher.RegisterSpan(p.Key, p.Timestamp, p.Span)
+		if p.Timestamp > s.now {
+			s.now = p.Timestamp
+		}
+	}
+}
+
+// The end of the audio, fingerprint whatever is left
+func (s *session) flush() {
+	if len(s.pending) > 0 {
+		frame := pcm.NewFrame(s.pending, s.blockId, fingerprint.SAMPLE_RATE)
+		s.register(s.printer.Prints(&frame))
+	}
+	s.register(s.printer.Flush())
+}
+
+func (s *session) register(prints []fingerprint.Print) {
+	for _, fp := range prints {
+		s.matcher.RegisterSpan(fp.Key, fp.Timestamp, fp.Span)
+	}
+}
+
+// The best matches so far
+func (s *session) result(maxResults int) response {
+	if s.window > 0 {
+		s.matcher.Forget(s.now - s.window)
+	}
+
+	offsets := s.matcher.Offsets(audiomatcher.OFFSET_BIN_WIDTH)
+	if len(offsets) > maxResults {
+		offsets = offsets[:maxResults]
+	}
+
+	r := response{Time: s.now, Matches: make([]matchResult, 0, len(offsets))}
+	for _, o := range offsets {
+		m := matchResult{
+			Track:      o.Filename,
+			Language:   o.Language,
+			Offset:     o.Offset,
+			Speed:      o.Speed,
+			Position:   o.Position(s.now),
+			Votes:      o.Votes,
+			Total:      o.Total,
+			Confidence: o.Confidence,
+		}
+		// the line through the hits follows drift better than the offset bins
+		if d, ok := s.matcher.Drift(o.Filename); ok {
+			m.Position, m.Uncertainty = d.Position(s.now)
+		}
+		r.Matches = append(r.Matches, m)
+	}
+
+	return r
+}
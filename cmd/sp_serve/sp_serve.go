@@ -0,0 +1,286 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"flag"
+	"fmt"
+	"github.com/gorilla/websocket"
+	"github.com/snuffpuppet/spectre/audiomatcher"
+	"github.com/snuffpuppet/spectre/fingerprint"
+	"github.com/snuffpuppet/spectre/indexer"
+	"github.com/snuffpuppet/spectre/lookup"
+	"github.com/snuffpuppet/spectre/spectral"
+	"io"
+	"log"
+	"net/http"
+	"os"
+	"strings"
+	"time"
+)
+
+/*
+ * sp_serve:
+ * Run recognition as a service over a fingerprint database.
+ *
+ *   POST /identify  one-shot identification of a snippet.  The body is either raw pcm (signed 16 bit little
+ *                   endian mono at the fingerprint sample rate) or, with a JSON content type, a list of prints:
+ *                   {"prints": [{"key": "<base64>", "timestamp": 1.5}, ...]}
+ *   GET  /session   WebSocket for continuous recognition.  Binary messages carry pcm and text messages carry
+ *                   prints as above.  The current matches are sent back as JSON after each second of audio.
+ */
+
+const MAX_SNIPPET_SECONDS = 60 // longest snippet accepted by /identify, and the most audio in one session message
+const MAX_RESULTS = 5          // number of matches returned
+
+const MAX_MESSAGE_BYTES = MAX_SNIPPET_SECONDS * fingerprint.SAMPLE_RATE * 2 // as 16 bit pcm
+
+type server struct {
+	library    *audiomatcher.Library
+	newPrinter func() (fingerprint.Printer, error)
+	sessions   chan struct{} // one entry for each running session
+	idle       time.Duration // close sessions that have not sent anything for this long (0 for no limit)
+	lifetime   time.Duration // close sessions that have been open this long (0 for no limit)
+	window     float64       // seconds of hits kept by continuous sessions
+	upgrader   websocket.Upgrader
+}
+
+// Reserve a session slot, returning false if the server is full
+func (s *server) acquire() bool {
+	select {
+	case s.sessions <- struct{}{}:
+		return true
+	default:
+		return false
+	}
+}
+
+func (s *server) release() {
+	<-s.sessions
+}
+
+func (s *server) newSession(ctx context.Context, window float64) (*session, error) {
+	printer, err := s.newPrinter()
+	if err != nil {
+		return nil, err
+	}
+
+	return newSession(ctx, s.library, printer, window), nil
+}
+
+// When a session that is active now becomes idle, the zero time if there is no idle limit
+func (s *server) idleDeadline() time.Time {
+	if s.idle <= 0 {
+		return time.Time{}
+	}
+	return time.Now().Add(s.idle)
+}
+
+// Reads a request body, giving up on the client if it sends nothing for the idle time
+type idleReader struct {
+	r  io.Reader
+	rc *http.ResponseController
+	s  *server
+}
+
+func (i *idleReader) Read(p []byte) (int, error) {
+	// writers that can't set deadlines (as in tests) just have no limit
+	i.rc.SetReadDeadline(i.s.idleDeadline())
+	return i.r.Read(p)
+}
+
+func writeJSON(w http.ResponseWriter, status int, v interface{}) {
+	w.Header().Set("Content-Type", "application/json")
+	w.WriteHeader(status)
+	json.NewEncoder(w).Encode(v)
+}
+
+func (s *server) identify(w http.ResponseWriter, r *http.Request) {
+	if r.Method != http.MethodPost {
+		writeJSON(w, http.StatusMethodNotAllowed, response{Error: "POST audio or prints to identify"})
+		return
+	}
+	if !s.acquire() {
+		writeJSON(w, http.StatusServiceUnavailable, response{Error: "Too many sessions, try again later"})
+		return
+	}
+	defer s.release()
+
+	sess, err := s.newSession(r.Context(), 0)
+	if err != nil {
+		writeJSON(w, http.StatusInternalServerError, response{Error: err.Error()})
+		return
+	}
+
+	// a stalled upload mustn't hold on to its session slot
+	rc := http.NewResponseController(w)
+	body := &idleReader{http.MaxBytesReader(w, r.Body, MAX_MESSAGE_BYTES), rc, s}
+
+	if strings.HasPrefix(r.Header.Get("Content-Type"), "application/json") {
+		var req printsRequest
+		if err := json.NewDecoder(body).Decode(&req); err != nil {
+			writeJSON(w, http.StatusBadRequest, response{Error: fmt.Sprintf("Bad prints: %s", err)})
+			return
+		}
+		sess.addPrints(req.Prints)
+	} else {
+		data, err := io.ReadAll(body)
+		if err != nil {
+			writeJSON(w, http.StatusBadRequest, response{Error: fmt.Sprintf("Reading audio: %s", err)})
+			return
+		}
+		// nobody to reply to if the client has gone
+		if err := sess.addPCM(data); err != nil {
+			log.Printf("Identify for %s: %s", r.RemoteAddr, err)
+			return
+		}
+		sess.flush()
+	}
+
+	rc.SetWriteDeadline(s.idleDeadline())
+	writeJSON(w, http.StatusOK, sess.result(MAX_RESULTS))
+}
+
+func (s *server) session(w http.ResponseWriter, r *http.Request) {
+	if !s.acquire() {
+		writeJSON(w, http.StatusServiceUnavailable, response{Error: "Too many sessions, try again later"})
+		return
+	}
+	defer s.release()
+
+	conn, err := s.upgrader.Upgrade(w, r, nil)
+	if err != nil {
+		// the upgrader has already replied to the client
+		return
+	}
+	defer conn.Close()
+	conn.SetReadLimit(MAX_MESSAGE_BYTES)
+
+	sess, err := s.newSession(r.Context(), s.window)
+	if err != nil {
+		conn.WriteJSON(response{Error: err.Error()})
+		return
+	}
+
+	log.Printf("Session started for %s", r.RemoteAddr)
+	defer log.Printf("Session ended for %s", r.RemoteAddr)
+
+	var expires time.Time
+	if s.lifetime > 0 {
+		expires = time.Now().Add(s.lifetime)
+	}
+
+	nextReport := 1.0
+	for {
+		deadline := s.idleDeadline()
+		if !expires.IsZero() && (deadline.IsZero() || expires.Before(deadline)) {
+			deadline = expires
+		}
+		conn.SetReadDeadline(deadline)
+
+		msgType, data, err := conn.ReadMessage()
+		if err != nil {
+			if !websocket.IsCloseError(err, websocket.CloseNormalClosure, websocket.CloseGoingAway) {
+				log.Printf("Session for %s: %s", r.RemoteAddr, err)
+			}
+			return
+		}
+
+		switch msgType {
+		case websocket.BinaryMessage:
+			if err := sess.addPCM(data); err != nil {
+				log.Printf("Session for %s: %s", r.RemoteAddr, err)
+				return
+			}
+		case websocket.TextMessage:
+			var req printsRequest
+			if err := json.Unmarshal(data, &req); err != nil {
+				conn.WriteJSON(response{Time: sess.now, Error: fmt.Sprintf("Bad prints: %s", err)})
+				continue
+			}
+			sess.addPrints(req.Prints)
+		}
+
+		// report back once for each second of audio
+		if sess.now >= nextReport {
+			conn.SetWriteDeadline(s.idleDeadline())
+			if err := conn.WriteJSON(sess.result(MAX_RESULTS)); err != nil {
+				log.Printf("Session for %s: %s", r.RemoteAddr, err)
+				return
+			}
+			for nextReport <= sess.now {
+				nextReport++
+			}
+		}
+	}
+}
+
+func main() {
+	var optAnalyser, optFingerprint, optDatabase, optAddr string
+	var optMaxSessions int
+	var optIdle, optLifetime time.Duration
+	var optWindow float64
+	var analyser spectral.Analyser
+
+	flag.StringVar(&optAnalyser, "analyser", "bespoke", "Spectral analyser to use (pwelch | bespoke)")
+	flag.StringVar(&optFingerprint, "fingerprint", fingerprint.PRINTER_LANDMARK, "Fingerprinting method to use (banded | quantised | chroma | chromaprint | landmark | panako | philips)")
+	flag.StringVar(&optDatabase, "db", "", "Fingerprint database to match against (from sp_index)")
+	flag.StringVar(&optAddr, "addr", ":8080", "Address to listen on")
+	flag.IntVar(&optMaxSessions, "max-sessions", 32, "Maximum number of concurrent sessions")
+	flag.DurationVar(&optIdle, "idle-timeout", 30*time.Second, "Close sessions and /identify uploads that send nothing for this long (0 for no limit)")
+	flag.DurationVar(&optLifetime, "session-timeout", 4*time.Hour, "Close sessions open for this long (0 for no limit)")
+	flag.Float64Var(&optWindow, "window", 30, "Seconds of matches used by continuous sessions")
+
+	flag.Parse()
+
+	switch optAnalyser {
+	case "bespoke":
+		analyser = spectral.Amplitude
+	case "pwelch":
+		analyser = spectral.Pwelch
+	default:
+		flag.PrintDefaults()
+		log.Fatalf("Unrecognised spectral analyser requested: '%s'", optAnalyser)
+	}
+
+	if optDatabase == "" {
+		log.Println("Error: No fingerprint database (-db) given")
+		flag.PrintDefaults()
+		os.Exit(1)
+	}
+
+	newPrinter := func() (fingerprint.Printer, error) {
+		return fingerprint.NewPrinter(optFingerprint, analyser, fingerprint.MIC_SILENCE_THRESHOLD)
+	}
+	if _, err := newPrinter(); err != nil {
+		flag.PrintDefaults()
+		log.Fatal(err)
+	}
+
+	index, err := lookup.Load(optDatabase, indexer.Params(optFingerprint, optAnalyser))
+	if err != nil {
+		log.Fatalf("Fatal Error loading fingerprints: %s", err)
+	}
+
+	s := &server{
+		library:    audiomatcher.NewLibrary(index),
+		newPrinter: newPrinter,
+		sessions:   make(chan struct{}, optMaxSessions),
+		idle:       optIdle,
+		lifetime:   optLifetime,
+		window:     optWindow,
+	}
+
+	mux := http.NewServeMux()
+	mux.HandleFunc("/identify", s.identify)
+	mux.HandleFunc("/session", s.session)
+
+	srv := &http.Server{
+		Addr:              optAddr,
+		Handler:           mux,
+		ReadHeaderTimeout: 10 * time.Second,
+	}
+
+	log.Printf("Serving %d fingerprints for %d tracks on %s", index.Len(), len(index.Tracks()), optAddr)
+	log.Fatal(srv.ListenAndServe())
+}
@@ -0,0 +1,211 @@
+package main
+
+import (
+	"bufio"
+	"bytes"
+	"encoding/binary"
+	"encoding/json"
+	"fmt"
+	"github.com/gorilla/websocket"
+	"github.com/snuffpuppet/spectre/audiomatcher"
+	"github.com/snuffpuppet/spectre/fingerprint"
+	"github.com/snuffpuppet/spectre/indexer"
+	"github.com/snuffpuppet/spectre/lookup"
+	"github.com/snuffpuppet/spectre/pcm"
+	"github.com/snuffpuppet/spectre/spectral"
+	"math"
+	"math/rand"
+	"net"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+	"time"
+)
+
+const TRACK = "tones.mkv"
+
+func testPrinter() (fingerprint.Printer, error) {
+	return fingerprint.NewPrinter(fingerprint.PRINTER_LANDMARK, spectral.Amplitude, fingerprint.MIC_SILENCE_THRESHOLD)
+}
+
+// 30 seconds of random tones, changing four times a second
+func tones() []int16 {
+	r := rand.New(rand.NewSource(1))
+	samples := make([]int16, 30*fingerprint.SAMPLE_RATE)
+	f := 0.0
+	for i := range samples {
+		if i%(fingerprint.SAMPLE_RATE/4) == 0 {
+			f = 200 + 2000*r.Float64()
+		}
+		samples[i] = int16(8000 * math.Sin(2*math.Pi*f*float64(i)/fingerprint.SAMPLE_RATE))
+	}
+	return samples
+}
+
+func fingerprints(t *testing.T, samples []int16) []fingerprint.Print {
+	printer, err := testPrinter()
+	if err != nil {
+		t.Fatal(err)
+	}
+	var prints []fingerprint.Print
+	for i := 0; i+fingerprint.BLOCK_SIZE <= len(samples); i += fingerprint.BLOCK_SIZE {
+		frame := pcm.NewFrame(samples[i:i+fingerprint.BLOCK_SIZE], i/fingerprint.BLOCK_SIZE, fingerprint.SAMPLE_RATE)
+		prints = append(prints, printer.Prints(&frame)...)
+	}
+	return append(prints, printer.Flush()...)
+}
+
+func testServer(t *testing.T, maxSessions int) (*server, []int16) {
+	samples := tones()
+	idx := lookup.New()
+	indexer.Add(idx, TRACK, fingerprints(t, samples))
+	idx.SetLanguage(TRACK, "eng")
+
+	return &server{
+		library:    audiomatcher.NewLibrary(idx),
+		newPrinter: testPrinter,
+		sessions:   make(chan struct{}, maxSessions),
+		idle:       5 * time.Second,
+		window:     30,
+	}, samples
+}
+
+func pcmBytes(samples []int16) []byte {
+	var buf bytes.Buffer
+	binary.Write(&buf, binary.LittleEndian, samples)
+	return buf.Bytes()
+}
+
+// The snippet starts 10 seconds into the track
+func checkMatch(t *testing.T, resp response) {
+	t.Helper()
+	if resp.Error != "" || len(resp.Matches) == 0 {
+		t.Fatalf("No match: %+v", resp)
+	}
+	if m := resp.Matches[0]; m.Track != TRACK || m.Language != "eng" || math.Abs(m.Offset-10) > 0.5 {
+		t.Errorf("Matched %s (%q) at offset %.2f, expected %s (eng) at 10", m.Track, m.Language, m.Offset, TRACK)
+	}
+}
+
+func TestIdentify(t *testing.T) {
+	s, samples := testServer(t, 1)
+	snippet := samples[10*fingerprint.SAMPLE_RATE : 20*fingerprint.SAMPLE_RATE]
+
+	// raw pcm
+	w := httptest.NewRecorder()
+	s.identify(w, httptest.NewRequest(http.MethodPost, "/identify", bytes.NewReader(pcmBytes(snippet))))
+	if w.Code != http.StatusOK {
+		t.Fatalf("Identifying pcm gave %d: %s", w.Code, w.Body)
+	}
+	var resp response
+	if err := json.NewDecoder(w.Body).Decode(&resp); err != nil {
+		t.Fatal(err)
+	}
+	checkMatch(t, resp)
+
+	// prints from a client side fingerprinter
+	var req printsRequest
+	for _, fp := range fingerprints(t, snippet) {
+		req.Prints = append(req.Prints, clientPrint{Key: fp.Key, Timestamp: fp.Timestamp, Span: fp.Span})
+	}
+	body, _ := json.Marshal(req)
+	r := httptest.NewRequest(http.MethodPost, "/identify", bytes.NewReader(body))
+	r.Header.Set("Content-Type", "application/json")
+	w = httptest.NewRecorder()
+	s.identify(w, r)
+	if w.Code != http.StatusOK {
+		t.Fatalf("Identifying prints gave %d: %s", w.Code, w.Body)
+	}
+	resp = response{}
+	if err := json.NewDecoder(w.Body).Decode(&resp); err != nil {
+		t.Fatal(err)
+	}
+	checkMatch(t, resp)
+}
+
+func TestIdentifyRefused(t *testing.T) {
+	s, _ := testServer(t, 1)
+
+	w := httptest.NewRecorder()
+	s.identify(w, httptest.NewRequest(http.MethodGet, "/identify", nil))
+	if w.Code != http.StatusMethodNotAllowed {
+		t.Errorf("GET gave %d, expected %d", w.Code, http.StatusMethodNotAllowed)
+	}
+
+	// the only session slot is taken
+	s.acquire()
+	w = httptest.NewRecorder()
+	s.identify(w, httptest.NewRequest(http.MethodPost, "/identify", strings.NewReader("")))
+	if w.Code != http.StatusServiceUnavailable {
+		t.Errorf("Identifying with the server full gave %d, expected %d", w.Code, http.StatusServiceUnavailable)
+	}
+	s.release()
+}
+
+// An upload that stalls part way through is given up on and frees its session slot
+func TestIdentifyStalled(t *testing.T) {
+	s, _ := testServer(t, 1)
+	s.idle = 200 * time.Millisecond
+	srv := httptest.NewServer(http.HandlerFunc(s.identify))
+	defer srv.Close()
+
+	conn, err := net.Dial("tcp", strings.TrimPrefix(srv.URL, "http://"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer conn.Close()
+	fmt.Fprintf(conn, "POST /identify HTTP/1.1\r\nHost: spectre\r\nContent-Length: 100000\r\n\r\n")
+	conn.Write(make([]byte, 1000))
+
+	conn.SetReadDeadline(time.Now().Add(5 * time.Second))
+	resp, err := http.ReadResponse(bufio.NewReader(conn), nil)
+	if err != nil {
+		t.Fatalf("No response to a stalled upload: %s", err)
+	}
+	resp.Body.Close()
+	if resp.StatusCode != http.StatusBadRequest {
+		t.Errorf("Stalled upload gave %d, expected %d", resp.StatusCode, http.StatusBadRequest)
+	}
+
+	// the slot is released once the handler returns
+	for end := time.Now().Add(5 * time.Second); len(s.sessions) > 0; time.Sleep(10 * time.Millisecond) {
+		if time.Now().After(end) {
+			t.Fatalf("Session slot still held after a stalled upload")
+		}
+	}
+	if !s.acquire() {
+		t.Fatalf("No session slot free after a stalled upload")
+	}
+	s.release()
+}
+
+func TestSession(t *testing.T) {
+	s, samples := testServer(t, 1)
+	srv := httptest.NewServer(http.HandlerFunc(s.session))
+	defer srv.Close()
+
+	conn, _, err := websocket.DefaultDialer.Dial("ws"+strings.TrimPrefix(srv.URL, "http"), nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer conn.Close()
+
+	// a second of audio at a time, as a player would send it
+	for i := 10; i < 20; i++ {
+		second := samples[i*fingerprint.SAMPLE_RATE : (i+1)*fingerprint.SAMPLE_RATE]
+		if err := conn.WriteMessage(websocket.BinaryMessage, pcmBytes(second)); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	// the last report has heard all of it
+	conn.SetReadDeadline(time.Now().Add(10 * time.Second))
+	var resp response
+	for resp.Time < 9.5 {
+		if err := conn.ReadJSON(&resp); err != nil {
+			t.Fatalf("Reading results: %s", err)
+		}
+	}
+	checkMatch(t, resp)
+}
@@ -0,0 +1,184 @@
+package main
+
+import (
+	"context"
+	"errors"
+	"flag"
+	"fmt"
+	"github.com/snuffpuppet/spectre/audiomatcher"
+	"github.com/snuffpuppet/spectre/fingerprint"
+	"github.com/snuffpuppet/spectre/indexer"
+	"github.com/snuffpuppet/spectre/lookup"
+	"github.com/snuffpuppet/spectre/pcm"
+	"github.com/snuffpuppet/spectre/spectral"
+	"github.com/snuffpuppet/spectre/subtitle"
+	"io"
+	"log"
+	"os"
+	"os/signal"
+	"strings"
+)
+
+/*
+ * sp_subsync:
+ * Listen to a film playing and print its subtitles in time with it.
+ * The audio matcher follows the film, reporting when it locks on, seeks, pauses or loses it.  Between matches the
+ * film position rolls forward with the mic clock (or stands still while paused) and seeks move the subtitles along.
+ * Once the film is lost the subtitles are cleared and nothing more is shown until it is locked on to again.
+ */
+
+func showCues(pos float64, u subtitle.Update) {
+	if u.Seeked {
+		fmt.Printf("---- %s ----\n", audiomatcher.FormatTime(pos))
+	}
+	for _, c := range u.Show {
+		fmt.Printf("[%s] %s\n", audiomatcher.FormatTime(c.Start), strings.Join(c.Text, "\n             "))
+	}
+}
+
+func hideCues(hidden []subtitle.Cue) {
+	if len(hidden) > 0 {
+		fmt.Printf("---- cleared %d subtitles ----\n", len(hidden))
+	}
+}
+
+// What the subtitles are following after an event, or "" if the event doesn't change it
+func lockState(e audiomatcher.Event) string {
+	switch e.Type {
+	case audiomatcher.LOCKED, audiomatcher.SEEKED:
+		return "locked on " + e.Filename
+	case audiomatcher.PAUSED:
+		return "paused"
+	case audiomatcher.LOST:
+		return "searching"
+	}
+	return ""
+}
+
+func subsync(ctx context.Context, stream pcm.StartReader, matcher *audiomatcher.AudioMatcher, printer fingerprint.Printer, scheduler *subtitle.Scheduler, optVerbose bool) error {
+	if err := stream.Start(); err != nil {
+		return fmt.Errorf("Error starting microphone recording: %s", err)
+	}
+
+	fmt.Println("Listening for the film.  Press Ctrl-C to stop")
+
+	// subtitles are only scheduled while the film is locked on to (or paused), not once it is lost
+	state, following := "searching", false
+	fmt.Printf("==== %s ====\n", state)
+
+	for {
+		frame, err := stream.Read()
+		if err != nil {
+			if err == io.EOF || err == io.ErrUnexpectedEOF {
+				return nil
+			}
+			return fmt.Errorf("Error reading microphone: %w", err)
+		}
+
+		for _, fp := range printer.Prints(frame) {
+			indexer.PrintStatus(fp.Source, frame, optVerbose)
+			matcher.RegisterSpan(fp.Key, fp.Timestamp, fp.Span)
+		}
+
+		now := frame.Timestamp()
+
+		// Check every second to see if the lock has changed
+		if frame.BlockId()%fingerprint.BLOCKS_PER_SECOND == 0 {
+			// a new position is handled by the scheduler as a seek if it needs to be
+			for _, e := range matcher.Update(now) {
+				fmt.Printf("**** %s\n", e)
+				switch e.Type {
+				case audiomatcher.LOCKED, audiomatcher.SEEKED:
+					following = true
+				case audiomatcher.LOST:
+					// the next lock starts afresh, like a seek
+					following = false
+					hideCues(scheduler.Reset())
+				}
+				if s := lockState(e); s != "" && s != state {
+					state = s
+					fmt.Printf("==== %s ====\n", state)
+				}
+			}
+		}
+
+		// keep the subtitles rolling on the mic clock while we have a position
+		if _, pos, ok := matcher.LockPosition(now); ok && following {
+			showCues(pos, scheduler.Update(pos))
+		}
+
+		if err := ctx.Err(); err != nil {
+			return fmt.Errorf("Following the film: %w", err)
+		}
+	}
+}
+
+func main() {
+	var optVerbose bool
+	var optAnalyser, optInput, optFingerprint, optDatabase, optSubtitles string
+	var analyser spectral.Analyser
+
+	flag.BoolVar(&optVerbose, "verbose", false, "Verbose output of spectral analysis data")
+	flag.StringVar(&optAnalyser, "analyser", "bespoke", "Spectral analyser to use (pwelch | bespoke)")
+	flag.StringVar(&optInput, "input", "", "Input file to use instead of microphone")
+	flag.StringVar(&optFingerprint, "fingerprint", fingerprint.PRINTER_LANDMARK, "Fingerprinting method to use (banded | quantised | chroma | chromaprint | landmark | panako | philips)")
+	flag.StringVar(&optDatabase, "db", "", "Fingerprint database for the film (from sp_index)")
+	flag.StringVar(&optSubtitles, "subs", "", "Subtitle file for the film (srt | vtt)")
+
+	flag.Parse()
+
+	// Ctrl-C stops following the film
+	ctx, stop := signal.NotifyContext(context.Background(), os.Interrupt, os.Kill)
+	defer stop()
+
+	switch optAnalyser {
+	case "bespoke":
+		analyser = spectral.Amplitude
+	case "pwelch":
+		analyser = spectral.Pwelch
+	default:
+		flag.PrintDefaults()
+		log.Fatalf("Unrecognised spectral analyser requested: '%s'", optAnalyser)
+	}
+
+	if optDatabase == "" || optSubtitles == "" {
+		log.Println("Error: Both a fingerprint database (-db) and subtitle file (-subs) are required")
+		flag.PrintDefaults()
+		os.Exit(1)
+	}
+
+	printer, err := fingerprint.NewPrinter(optFingerprint, analyser, fingerprint.MIC_SILENCE_THRESHOLD)
+	if err != nil {
+		flag.PrintDefaults()
+		log.Fatal(err)
+	}
+
+	fingerprints, err := lookup.Load(optDatabase, indexer.Params(optFingerprint, optAnalyser))
+	if err != nil {
+		log.Fatalf("Fatal Error loading fingerprints: %s", err)
+	}
+
+	cues, err := subtitle.Load(optSubtitles)
+	if err != nil {
+		log.Fatalf("Fatal Error loading subtitles: %s", err)
+	}
+	fmt.Printf("Loaded %d fingerprints and %d subtitles\n", fingerprints.Len(), len(cues))
+
+	var input pcm.StartReader
+	if optInput != "" {
+		input, err = pcm.NewFileStream(ctx, optInput, fingerprint.SAMPLE_RATE, fingerprint.BLOCK_SIZE)
+	} else {
+		input, err = pcm.NewMicReader(ctx, fingerprint.SAMPLE_RATE, fingerprint.BLOCK_SIZE)
+	}
+	if err != nil {
+		log.Fatalf("Fatal Error opening stream: %s", err)
+	}
+
+	matcher := audiomatcher.New(audiomatcher.NewLibrary(fingerprints), fingerprint.TIME_DELTA_THRESHOLD)
+	matcher.SetWindow(audiomatcher.MATCH_WINDOW, audiomatcher.HIT_HALF_LIFE)
+
+	err = subsync(ctx, input, matcher, printer, subtitle.NewScheduler(cues), optVerbose)
+	if err != nil && !errors.Is(err, context.Canceled) {
+		log.Fatalf("Fatal Error following stream: %s", err)
+	}
+}
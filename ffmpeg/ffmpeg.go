@@ -1,13 +1,23 @@
 package ffmpeg
 
 import (
+	"context"
+	"errors"
 	"os/exec"
 	"fmt"
 	"strconv"
+	"strings"
+	"sync"
 	"io"
 	"log"
 )
 
+/*
+ * ffmpeg:
+ * Decode audio by running the ffmpeg binary and reading its output from a pipe.
+ * ffmpeg only has anything useful to say on stderr so the tail of it is kept to explain failures.
+ */
+
 const (
 	FMT_FLOAT32   = "f32"
 	FMT_INT16     = "s16"
@@ -15,11 +25,67 @@ const (
 	CONTAINER_WAV = "wav"
 )
 
-func Cmd(filename, containerType, pcmDataType string, sampleRate int) (*exec.Cmd, error) {
+const MAX_STDERR = 4096 // bytes of ffmpeg's complaints kept for error messages
+
+var ErrNotInstalled = errors.New("ffmpeg is not installed")
+
+// Check a binary from the ffmpeg suite is on the PATH before trying to run it
+func Installed(binary string) error {
+	if _, err := exec.LookPath(binary); err != nil {
+		return fmt.Errorf("%w (no %s on the PATH), it is needed for compressed audio but WAV and raw PCM files can be read without it", ErrNotInstalled, binary)
+	}
+	return nil
+}
+
+// The end of what a command wrote to stderr, limited to MAX_STDERR bytes
+type Stderr struct {
+	mu        sync.Mutex
+	buf       []byte
+	truncated bool
+}
+
+func (s *Stderr) Write(p []byte) (int, error) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	s.buf = append(s.buf, p...)
+	if over := len(s.buf) - MAX_STDERR; over > 0 {
+		s.buf = append(s.buf[:0], s.buf[over:]...)
+		s.truncated = true
+	}
+	return len(p), nil
+}
+
+func (s *Stderr) String() string {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	msg := strings.TrimSpace(string(s.buf))
+	if s.truncated && msg != "" {
+		msg = "..." + msg
+	}
+	return msg
+}
+
+// Add whatever the command had to say to an error
+func (s *Stderr) Wrap(err error) error {
+	msg := s.String()
+	if msg == "" {
+		return err
+	}
+	return fmt.Errorf("%w: %s", err, msg)
+}
+
+// The ffmpeg command to decode one of a file's audio streams, which is killed if the context is cancelled.
+// Streams chosen by language are found with ffprobe first.
+func Cmd(ctx context.Context, filename string, stream Select, containerType, pcmDataType string, sampleRate int) (*exec.Cmd, error) {
 	// containerType: "raw"|"wav", pcmFormat: "int16"|"float32"
 	// containerType describes if we want a raw output or a wav container
 	// pcmDataType describes the internal format of the data we want e.g. float32 / signed int 16 etc
 	// codec indicates (to ffmpeg) a raw format and which (raw) codec to use
+	if err := Installed("ffmpeg"); err != nil {
+		return nil, err
+	}
 
 	codec := ""    // indicates (to ffmpeg) how to encode the pcm data
 	format := ""   // indicates (to ffmpeg) how to format the file (wav or raw - with raw format 's16le' etc)
@@ -45,6 +111,23 @@ func Cmd(filename, containerType, pcmDataType string, sampleRate int) (*exec.Cmd
 		return nil, fmt.Errorf("ffmpegCmd: Unrecognised container type: %s", containerType)
 	}
 
+	// ffmpeg maps every stream in a language, which a wav container can't take, so map just the one
+	var mapArgs []string
+	if !stream.Default() {
+		if stream.Language != "" {
+			info, err := Probe(ctx, filename)
+			if err != nil {
+				return nil, err
+			}
+			a, err := info.Pick(stream)
+			if err != nil {
+				return nil, err
+			}
+			stream = Select{Index: a.AudioIndex}
+		}
+		mapArgs = []string{"-map", fmt.Sprintf("0:a:%d", stream.Index)}
+	}
+
 	//duration := "20"
 	channels := "1"
 	bitRate := "192k"
@@ -58,8 +141,11 @@ func Cmd(filename, containerType, pcmDataType string, sampleRate int) (*exec.Cmd
 	sampleRateArgs := []string{"-ar", strconv.Itoa(sampleRate)}
 	channelArgs := []string{"-ac", channels}
 	pipeArgs := []string{"pipe:1"}
+	quietArgs := []string{"-nostdin", "-hide_banner", "-loglevel", "error"}	// keep stderr to the errors
 
+	args = append(args, quietArgs...)
 	args = append(args, inputArgs...)
+	args = append(args, mapArgs...)
 	args = append(args, formatArgs...)
 	if containerType != "wav" {  // for wav containers, use default (int16) codec -otherwise trouble
 		args = append(args, codecArgs...)
@@ -69,22 +155,25 @@ func Cmd(filename, containerType, pcmDataType string, sampleRate int) (*exec.Cmd
 	args = append(args, channelArgs...)
 	args = append(args, pipeArgs...)
 
-	cmd := exec.Command("ffmpeg", args...)
+	cmd := exec.CommandContext(ctx, "ffmpeg", args...)
 
 	log.Printf("ffmpeg %s", args)
 
 	return cmd, nil
 }
 
-func StartStream(cmd *exec.Cmd) (io.ReadCloser, error) {
+// Start the command, returning its output and the tail of its stderr to explain any failure
+func StartStream(cmd *exec.Cmd) (io.ReadCloser, *Stderr, error) {
 	audio, err := cmd.StdoutPipe()
 	if err != nil {
-		return nil, err
+		return nil, nil, err
 	}
+	stderr := &Stderr{}
+	cmd.Stderr = stderr
 	if err := cmd.Start(); err != nil {
-		return nil, err
+		return nil, nil, err
 	}
 
-	return audio, nil
+	return audio, stderr, nil
 }
 
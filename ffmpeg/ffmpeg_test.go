@@ -0,0 +1,160 @@
+package ffmpeg_test
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"github.com/snuffpuppet/spectre/ffmpeg"
+	"reflect"
+	"strings"
+	"testing"
+)
+
+func TestStderr(t *testing.T) {
+	var s ffmpeg.Stderr
+	err := errors.New("Decoding film.mkv: exit status 1")
+	if wrapped := s.Wrap(err); wrapped != err {
+		t.Errorf("Wrapped %q with nothing on stderr", wrapped)
+	}
+
+	// only the end is kept, which is where ffmpeg says what went wrong
+	for i := 0; i < 1000; i++ {
+		fmt.Fprintf(&s, "Warning %d\n", i)
+	}
+	fmt.Fprintf(&s, "Unsupported codec\n")
+
+	msg := s.String()
+	if len(msg) > ffmpeg.MAX_STDERR+3 || !strings.HasPrefix(msg, "...") || !strings.HasSuffix(msg, "Unsupported codec") {
+		t.Errorf("Kept %d bytes of stderr: %.20q...%q", len(msg), msg, msg[len(msg)-20:])
+	}
+
+	wrapped := s.Wrap(err)
+	if !errors.Is(wrapped, err) || !strings.Contains(wrapped.Error(), "Unsupported codec") {
+		t.Errorf("Wrapped error is %q", wrapped)
+	}
+}
+
+func TestNotInstalled(t *testing.T) {
+	t.Setenv("PATH", t.TempDir())
+
+	if _, err := ffmpeg.Cmd(context.Background(), "film.mkv", ffmpeg.DEFAULT_STREAM, ffmpeg.CONTAINER_WAV, ffmpeg.FMT_INT16, 11025); !errors.Is(err, ffmpeg.ErrNotInstalled) {
+		t.Errorf("Cmd without ffmpeg gave %v", err)
+	}
+	if _, err := ffmpeg.Probe(context.Background(), "film.mkv"); !errors.Is(err, ffmpeg.ErrNotInstalled) || !strings.Contains(err.Error(), "ffprobe") {
+		t.Errorf("Probe without ffprobe gave %v", err)
+	}
+}
+
+func TestSelect(t *testing.T) {
+	info := &ffmpeg.Info{Filename: "film.mkv", Streams: []ffmpeg.AudioStream{
+		{Index: 1, AudioIndex: 0, Channels: 2, Language: "eng", Title: "Commentary"},
+		{Index: 2, AudioIndex: 1, Channels: 6, Language: "eng", Default: true},
+		{Index: 3, AudioIndex: 2, Channels: 6, Language: "fre"},
+		{Index: 4, AudioIndex: 3, Channels: 2},
+	}}
+
+	tests := []struct {
+		spec   string
+		stream int // audio index picked, -1 for an error
+	}{
+		{"", 1},
+		{"2", 2},
+		{"ENG", 1}, // the default english stream rather than the commentary
+		{"fre", 2},
+		{"ger", -1},
+		{"4", -1},
+	}
+	for _, test := range tests {
+		sel, err := ffmpeg.ParseSelect(test.spec)
+		if err != nil {
+			t.Errorf("ParseSelect(%q) failed: %s", test.spec, err)
+			continue
+		}
+		a, err := info.Pick(sel)
+		if test.stream < 0 {
+			if err == nil {
+				t.Errorf("Picked %s for %q, expected an error", a, test.spec)
+			}
+			continue
+		}
+		if err != nil || a.AudioIndex != test.stream {
+			t.Errorf("Picked %s (%v) for %q, expected #%d", a, err, test.spec, test.stream)
+		}
+	}
+
+	for _, spec := range []string{"-1", "en g", "eng2"} {
+		if sel, err := ffmpeg.ParseSelect(spec); err == nil {
+			t.Errorf("ParseSelect(%q) gave %s", spec, sel)
+		}
+	}
+}
+
+// Trimmed down output of ffprobe -print_format json -show_format -show_streams -select_streams a
+const PROBE_JSON = `{
+    "streams": [
+        {
+            "index": 1,
+            "codec_name": "ac3",
+            "sample_rate": "48000",
+            "channels": 6,
+            "disposition": { "default": 0 },
+            "tags": { "language": "fre" }
+        },
+        {
+            "index": 2,
+            "codec_name": "aac",
+            "sample_rate": "44100",
+            "channels": 2,
+            "disposition": { "default": 1 },
+            "tags": { "language": "eng", "title": "Stereo" }
+        },
+        {
+            "index": 3,
+            "codec_name": "opus",
+            "sample_rate": "48000",
+            "channels": 1,
+            "disposition": { "default": 0 }
+        }
+    ],
+    "format": {
+        "filename": "film.mkv",
+        "duration": "5423.104000"
+    }
+}`
+
+func TestParseProbe(t *testing.T) {
+	info, err := ffmpeg.ParseProbe("film.mkv", strings.NewReader(PROBE_JSON))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if info.Filename != "film.mkv" || info.Duration != 5423.104 {
+		t.Errorf("Parsed %s", info)
+	}
+
+	expected := []ffmpeg.AudioStream{
+		{Index: 1, AudioIndex: 0, Codec: "ac3", Channels: 6, SampleRate: 48000, Language: "fre"},
+		{Index: 2, AudioIndex: 1, Codec: "aac", Channels: 2, SampleRate: 44100, Language: "eng", Title: "Stereo", Default: true},
+		{Index: 3, AudioIndex: 2, Codec: "opus", Channels: 1, SampleRate: 48000},
+	}
+	if !reflect.DeepEqual(info.Streams, expected) {
+		t.Errorf("Parsed streams %v, expected %v", info.Streams, expected)
+	}
+
+	// the default stream wins over the one with more channels
+	if info.Codec != "aac" || info.Channels != 2 || info.SampleRate != 44100 {
+		t.Errorf("Picked %s %dHz %dch as the default stream, expected aac 44100Hz 2ch", info.Codec, info.SampleRate, info.Channels)
+	}
+
+	// still being written so no duration
+	info, err = ffmpeg.ParseProbe("live.ts", strings.NewReader(`{"streams": [{"index": 0, "codec_name": "mp2", "channels": 2}], "format": {}}`))
+	if err != nil || info.Duration != 0 || info.Codec != "mp2" {
+		t.Errorf("Parsed %v (%v) for a file without a duration", info, err)
+	}
+
+	if _, err := ffmpeg.ParseProbe("silent.mkv", strings.NewReader(`{"streams": [], "format": {"duration": "10.0"}}`)); err == nil || !strings.Contains(err.Error(), "No audio streams") {
+		t.Errorf("Parsing a file with no audio streams gave %v", err)
+	}
+	if _, err := ffmpeg.ParseProbe("film.mkv", strings.NewReader("Invalid data found")); err == nil {
+		t.Errorf("No error parsing output that isn't JSON")
+	}
+}
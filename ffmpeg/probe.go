@@ -0,0 +1,152 @@
+package ffmpeg
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"fmt"
+	"io"
+	"os/exec"
+	"strconv"
+	"strings"
+)
+
+/*
+ * probe:
+ * Ask ffprobe what is in a file before decoding it: how long it is and which audio streams it has.
+ * Films usually carry several audio streams, one for each dub, tagged with their language.
+ */
+
+// An audio stream in a file
+type AudioStream struct {
+	Index      int // stream number in the file
+	AudioIndex int // position amongst the audio streams, as used by ffmpeg's 0:a:N
+	Codec      string
+	Channels   int
+	SampleRate int
+	Language   string // ISO 639-2 code if the stream is tagged with one
+	Title      string
+	Default    bool
+}
+
+func (a AudioStream) String() string {
+	s := fmt.Sprintf("#%d %s %dHz %dch", a.AudioIndex, a.Codec, a.SampleRate, a.Channels)
+	if a.Language != "" {
+		s += " " + a.Language
+	}
+	if a.Title != "" {
+		s += fmt.Sprintf(" '%s'", a.Title)
+	}
+	if a.Default {
+		s += " (default)"
+	}
+	return s
+}
+
+// What ffprobe found in a file.  Codec, Channels and SampleRate are those of the stream ffmpeg decodes by default.
+type Info struct {
+	Filename   string
+	Duration   float64 // seconds
+	Codec      string
+	Channels   int
+	SampleRate int
+	Streams    []AudioStream
+}
+
+func (i *Info) String() string {
+	streams := make([]string, len(i.Streams))
+	for n, a := range i.Streams {
+		streams[n] = a.String()
+	}
+	return fmt.Sprintf("%s: %.1fs of %s %dHz %dch, audio streams [%s]", i.Filename, i.Duration, i.Codec, i.SampleRate, i.Channels, strings.Join(streams, ", "))
+}
+
+// The parts of ffprobe's JSON output we use
+type probeOutput struct {
+	Format struct {
+		Duration string `json:"duration"`
+	} `json:"format"`
+	Streams []struct {
+		Index       int               `json:"index"`
+		CodecName   string            `json:"codec_name"`
+		Channels    int               `json:"channels"`
+		SampleRate  string            `json:"sample_rate"`
+		Tags        map[string]string `json:"tags"`
+		Disposition struct {
+			Default int `json:"default"`
+		} `json:"disposition"`
+	} `json:"streams"`
+}
+
+// Describe the audio in a file using ffprobe, which is killed if the context is cancelled
+func Probe(ctx context.Context, filename string) (*Info, error) {
+	if err := Installed("ffprobe"); err != nil {
+		return nil, err
+	}
+
+	cmd := exec.CommandContext(ctx, "ffprobe", "-v", "error", "-print_format", "json", "-show_format", "-show_streams", "-select_streams", "a", filename)
+	stderr := &Stderr{}
+	cmd.Stderr = stderr
+	out, err := cmd.Output()
+	if err != nil {
+		if ctx.Err() != nil {
+			return nil, fmt.Errorf("Probing %s: %w", filename, ctx.Err())
+		}
+		return nil, stderr.Wrap(fmt.Errorf("Probing %s: %s", filename, err))
+	}
+
+	return ParseProbe(filename, bytes.NewReader(out))
+}
+
+// Parse the JSON output of `ffprobe -print_format json -show_format -show_streams -select_streams a` for a file
+func ParseProbe(filename string, r io.Reader) (*Info, error) {
+	var probe probeOutput
+	if err := json.NewDecoder(r).Decode(&probe); err != nil {
+		return nil, fmt.Errorf("Probing %s: Reading ffprobe output: %s", filename, err)
+	}
+	if len(probe.Streams) == 0 {
+		return nil, fmt.Errorf("Probing %s: No audio streams found", filename)
+	}
+
+	info := Info{Filename: filename}
+	// files that are still being written or piped in have no duration
+	if probe.Format.Duration != "" {
+		info.Duration, _ = strconv.ParseFloat(probe.Format.Duration, 64)
+	}
+
+	for n, s := range probe.Streams {
+		rate, _ := strconv.Atoi(s.SampleRate)
+		info.Streams = append(info.Streams, AudioStream{
+			Index:      s.Index,
+			AudioIndex: n,
+			Codec:      s.CodecName,
+			Channels:   s.Channels,
+			SampleRate: rate,
+			Language:   s.Tags["language"],
+			Title:      s.Tags["title"],
+			Default:    s.Disposition.Default != 0,
+		})
+	}
+
+	a := info.Streams[defaultStream(info.Streams)]
+	info.Codec, info.Channels, info.SampleRate = a.Codec, a.Channels, a.SampleRate
+
+	return &info, nil
+}
+
+// The stream ffmpeg decodes when it isn't told which: the default one with the most channels, the first of any ties
+func defaultStream(streams []AudioStream) int {
+	best := 0
+	score := func(a AudioStream) int {
+		if a.Default {
+			return a.Channels + 1000
+		}
+		return a.Channels
+	}
+	for n, a := range streams {
+		if score(a) > score(streams[best]) {
+			best = n
+		}
+	}
+	return best
+}
@@ -0,0 +1,86 @@
+package ffmpeg
+
+import (
+	"fmt"
+	"strconv"
+	"strings"
+)
+
+/*
+ * select:
+ * Choose which of a file's audio streams to decode, by its position amongst the audio streams or by its language.
+ */
+
+// An audio stream to decode.  Index is the position amongst the audio streams and is only used without a Language.
+type Select struct {
+	Index    int
+	Language string
+}
+
+// Leave the choice of stream to ffmpeg
+var DEFAULT_STREAM = Select{Index: -1}
+
+// Parse a stream choice from the command line: nothing for the default stream, a number or a language tag (eng, fre...)
+func ParseSelect(spec string) (Select, error) {
+	if spec == "" {
+		return DEFAULT_STREAM, nil
+	}
+	if n, err := strconv.Atoi(spec); err == nil {
+		if n < 0 {
+			return DEFAULT_STREAM, fmt.Errorf("Audio stream number %d is negative", n)
+		}
+		return Select{Index: n}, nil
+	}
+	for _, c := range spec {
+		if !(c >= 'a' && c <= 'z' || c >= 'A' && c <= 'Z' || c == '-') {
+			return DEFAULT_STREAM, fmt.Errorf("Audio stream '%s' is neither a stream number nor a language", spec)
+		}
+	}
+	return Select{Index: -1, Language: strings.ToLower(spec)}, nil
+}
+
+func (s Select) Default() bool {
+	return s.Index < 0 && s.Language == ""
+}
+
+func (s Select) String() string {
+	switch {
+	case s.Language != "":
+		return s.Language
+	case s.Index >= 0:
+		return fmt.Sprintf("#%d", s.Index)
+	}
+	return "default"
+}
+
+// Find the chosen stream amongst those ffprobe found.  Of several streams in a language the one ffmpeg would pick wins.
+func (i *Info) Pick(s Select) (AudioStream, error) {
+	if s.Default() {
+		return i.Streams[defaultStream(i.Streams)], nil
+	}
+
+	if s.Language == "" {
+		if s.Index >= len(i.Streams) {
+			return AudioStream{}, fmt.Errorf("%s has no audio stream #%d, only %d streams", i.Filename, s.Index, len(i.Streams))
+		}
+		return i.Streams[s.Index], nil
+	}
+
+	var languages []string
+	var streams []AudioStream
+	for _, a := range i.Streams {
+		if strings.EqualFold(a.Language, s.Language) {
+			streams = append(streams, a)
+		} else if a.Language != "" {
+			languages = append(languages, a.Language)
+		}
+	}
+	if len(streams) == 0 {
+		if len(languages) == 0 {
+			return AudioStream{}, fmt.Errorf("%s has no '%s' audio stream, none are tagged with a language", i.Filename, s.Language)
+		}
+		return AudioStream{}, fmt.Errorf("%s has no '%s' audio stream, only %s", i.Filename, s.Language, strings.Join(languages, ", "))
+	}
+
+	return streams[defaultStream(streams)], nil
+}
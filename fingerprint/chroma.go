@@ -10,6 +10,7 @@ import (
 )
 
 // Chroma based Fingerprint info on a block of audio data
+// (a hash of the loudest frequency of each note, not the Chromaprint algorithm: see ChromaprintPrinter for that)
 type Chromaprint struct {
 	Key           []byte
 	//Timestamp     float64
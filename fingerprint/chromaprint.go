@@ -0,0 +1,558 @@
+package fingerprint
+
+import (
+	"bufio"
+	"encoding/base64"
+	"fmt"
+	"github.com/mjibson/go-dsp/window"
+	"github.com/snuffpuppet/spectre/pcm"
+	"github.com/snuffpuppet/spectre/spectral"
+	"io"
+	"math"
+	"math/bits"
+	"sort"
+	"strconv"
+	"strings"
+)
+
+/*
+ * chromaprint:
+ * Fingerprints compatible with Chromaprint (the library behind fpcalc and AcoustID), using its default algorithm.
+ * Overlapping frames are folded into a 12 bin chroma vector (the energy of each note whatever its octave), smoothed
+ * over time and normalised.  Sixteen classifiers, each a Haar-like filter over a 16 frame by 12 note patch of the
+ * chroma image and a quantiser, give two bits each for a 32 bit sub-fingerprint every 1365 samples (~0.124s).
+ * Sub-fingerprints are matched by bit error rate like the Philips ones (see lookup.BitIndex), and whole
+ * fingerprints can be aligned and compared with those from fpcalc.
+ * ref: Ke, Hoiem & Sukthankar, "Computer Vision for Music Identification", CVPR 2005
+ * ref: Lalinsky, "How does Chromaprint work?" (2011), and the Chromaprint source for the classifiers
+ */
+
+const CHROMAPRINT_FRAME = 4096    // samples in each frame (~0.37s at 11025Hz)
+const CHROMAPRINT_HOP = 1365      // samples between frames, an overlap of 2/3
+const CHROMAPRINT_MIN_FREQ = 28.0 // frequency range folded into the chroma bins
+const CHROMAPRINT_MAX_FREQ = 3520.0
+const CHROMAPRINT_NORM_THRESHOLD = 0.01 // chroma vectors quieter than this are treated as silence
+const CHROMAPRINT_ALGORITHM = 1         // the algorithm number of fpcalc's default fingerprints
+const CHROMAPRINT_BLOCK = 64            // sub-fingerprints compared at a time when matching (~8s)
+const CHROMAPRINT_BER_THRESHOLD = 0.35  // blocks with a bit error rate below this are a match
+const CHROMAPRINT_MATCH_BITS = 14       // top bits of each sub-fingerprint used to find candidate alignments
+const CHROMAPRINT_ALIGN_CANDIDATES = 5  // most voted offsets compared in full
+
+const chromaBins = 12
+const chromaFilterWidth = 16 // frames covered by the widest classifier
+
+// time smoothing of the chroma vectors
+var chromaFilterCoefficients = []float64{0.25, 0.75, 1.0, 0.75, 0.25}
+
+// A Haar-like filter over a patch of the chroma image, then quantised to 2 bits
+type chromaClassifier struct {
+	filter     int // filter type, 0-5
+	y, height  int // chroma bins covered
+	width      int // frames covered
+	t0, t1, t2 float64
+}
+
+// the classifiers of Chromaprint's default algorithm
+var chromaClassifiers = []chromaClassifier{
+	{0, 4, 3, 15, 1.98215, 2.35817, 2.63523},
+	{4, 4, 6, 15, -1.03809, -0.651211, -0.282167},
+	{1, 0, 4, 16, -0.298702, 0.119262, 0.558497},
+	{3, 8, 2, 12, -0.105439, 0.0153946, 0.135898},
+	{3, 4, 4, 8, -0.142891, 0.0258736, 0.200632},
+	{4, 0, 3, 5, -0.826319, -0.590612, -0.368214},
+	{1, 2, 2, 9, -0.557409, -0.233035, 0.0534525},
+	{2, 7, 3, 4, -0.0646826, 0.00620476, 0.0784847},
+	{2, 6, 2, 16, -0.192387, -0.029699, 0.215855},
+	{2, 1, 3, 2, -0.0397818, -0.00568076, 0.0292026},
+	{5, 10, 1, 15, -0.53823, -0.369934, -0.190235},
+	{3, 6, 2, 10, -0.124877, 0.0296483, 0.139239},
+	{2, 1, 1, 14, -0.101475, 0.0225617, 0.231971},
+	{3, 5, 6, 4, -0.0799915, -0.00729616, 0.063262},
+	{1, 9, 2, 12, -0.272556, 0.019424, 0.302559},
+	{3, 4, 2, 14, -0.164292, -0.0321188, 0.0846339},
+}
+
+// 2 bit quantised values are gray coded so that neighbouring values differ by a single bit
+var chromaGrayCode = []uint32{0, 1, 3, 2}
+
+// Seconds between sub-fingerprints at the given sample rate
+func ChromaprintHop(fs int) float64 {
+	return float64(CHROMAPRINT_HOP) / float64(fs)
+}
+
+// Streaming Chromaprint sub-fingerprint generator
+type ChromaprintPrinter struct {
+	stft     *spectral.STFT
+	notes    []int       // chroma bin of each FFT bin, -1 for bins outside the frequency range
+	chroma   [][]float64 // the latest chroma vectors, for smoothing
+	starts   []float64   // start time of the frame of each chroma vector
+	frames   int         // chroma vectors seen so far
+	features [][]float64 // the latest smoothed and normalised vectors, for the classifiers
+	times    []float64   // start time of the frame each feature vector began at
+}
+
+func NewChromaprintPrinter(fs int) *ChromaprintPrinter {
+	// samples are 16 bit, which Chromaprint scales to +/-1 through the window
+	w := window.Hamming(CHROMAPRINT_FRAME)
+	for i := range w {
+		w[i] /= math.MaxInt16
+	}
+
+	notes := make([]int, CHROMAPRINT_FRAME/2+1)
+	lo := int(math.Floor(CHROMAPRINT_FRAME*CHROMAPRINT_MIN_FREQ/float64(fs) + 0.5))
+	hi := int(math.Floor(CHROMAPRINT_FRAME*CHROMAPRINT_MAX_FREQ/float64(fs) + 0.5))
+	if lo < 1 {
+		lo = 1
+	}
+	if hi > CHROMAPRINT_FRAME/2 {
+		hi = CHROMAPRINT_FRAME / 2
+	}
+	for i := range notes {
+		notes[i] = -1
+		if i >= lo && i < hi {
+			// octaves counted from A0
+			octave := math.Log2(float64(i) * float64(fs) / CHROMAPRINT_FRAME / (440.0 / 16))
+			notes[i] = int(chromaBins * (octave - math.Floor(octave)))
+		}
+	}
+
+	return &ChromaprintPrinter{
+		stft:  spectral.NewWindowedSTFT(fs, CHROMAPRINT_FRAME, CHROMAPRINT_HOP, w),
+		notes: notes,
+	}
+}
+
+func (c *ChromaprintPrinter) Prints(frame *pcm.Frame) []Print {
+	return c.Finish(c.Analyse(frame)())
+}
+
+func (c *ChromaprintPrinter) Analyse(frame *pcm.Frame) func() interface{} {
+	w := c.stft.Split(frame)
+	return func() interface{} { return w.Transform() }
+}
+
+func (c *ChromaprintPrinter) Finish(analysis interface{}) (prints []Print) {
+	s := analysis.(spectral.Spectrogram)
+	for col, mag := range s.Pxx {
+		features, start, ok := c.smooth(c.fold(mag), s.Times[col])
+		if !ok {
+			continue
+		}
+		c.features = append(c.features, normalise(features))
+		c.times = append(c.times, start)
+		if len(c.features) > chromaFilterWidth {
+			c.features = c.features[1:]
+			c.times = c.times[1:]
+		}
+		if len(c.features) == chromaFilterWidth {
+			sub := SubFingerprint{Bits: classify(integralImage(c.features)), Timestamp: c.times[0]}
+			prints = append(prints, Print{Key: sub.Key(), Timestamp: sub.Timestamp, Source: sub})
+		}
+	}
+
+	return
+}
+
+func (c *ChromaprintPrinter) Flush() []Print {
+	return nil
+}
+
+// fold the power spectrum of a frame into chroma bins
+func (c *ChromaprintPrinter) fold(mag []float64) []float64 {
+	chroma := make([]float64, chromaBins)
+	for i, n := range c.notes {
+		if n >= 0 {
+			chroma[n] += mag[i] * mag[i]
+		}
+	}
+
+	return chroma
+}
+
+// Smooth the chroma vectors over time, returning false until there are enough of them.
+// Like Chromaprint, the very first vector only ever fills the filter and is never part of the output.
+func (c *ChromaprintPrinter) smooth(chroma []float64, start float64) ([]float64, float64, bool) {
+	n := len(chromaFilterCoefficients)
+	c.chroma = append(c.chroma, chroma)
+	c.starts = append(c.starts, start)
+	if len(c.chroma) > n {
+		c.chroma = c.chroma[1:]
+		c.starts = c.starts[1:]
+	}
+	c.frames++
+	if c.frames <= n {
+		return nil, 0, false
+	}
+
+	out := make([]float64, chromaBins)
+	for j, coeff := range chromaFilterCoefficients {
+		for i := range out {
+			out[i] += c.chroma[j][i] * coeff
+		}
+	}
+
+	return out, c.starts[0], true
+}
+
+// scale to unit length, or to zero if it's too quiet to say anything about
+func normalise(v []float64) []float64 {
+	norm := 0.0
+	for _, x := range v {
+		norm += x * x
+	}
+	norm = math.Sqrt(norm)
+
+	out := make([]float64, len(v))
+	if norm < CHROMAPRINT_NORM_THRESHOLD {
+		return out
+	}
+	for i, x := range v {
+		out[i] = x / norm
+	}
+
+	return out
+}
+
+// integral image of feature vectors: image[r][c] is the sum of all features before row r and column c
+func integralImage(features [][]float64) [][]float64 {
+	image := make([][]float64, len(features)+1)
+	image[0] = make([]float64, chromaBins+1)
+	for r, row := range features {
+		image[r+1] = make([]float64, chromaBins+1)
+		for c, x := range row {
+			image[r+1][c+1] = image[r+1][c] + image[r][c+1] - image[r][c] + x
+		}
+	}
+
+	return image
+}
+
+// sum of the features in rows [r1, r2) and columns [c1, c2)
+func area(image [][]float64, r1, c1, r2, c2 int) float64 {
+	return image[r2][c2] - image[r1][c2] - image[r2][c1] + image[r1][c1]
+}
+
+func subtractLog(a, b float64) float64 {
+	return math.Log((1 + a) / (1 + b))
+}
+
+// apply the classifier's filter to the image
+func (cl chromaClassifier) apply(image [][]float64) float64 {
+	y, w, h := cl.y, cl.width, cl.height
+	switch cl.filter {
+	case 0:
+		return subtractLog(area(image, 0, y, w, y+h), 0)
+	case 1:
+		h2 := h / 2
+		return subtractLog(area(image, 0, y+h2, w, y+h), area(image, 0, y, w, y+h2))
+	case 2:
+		w2 := w / 2
+		return subtractLog(area(image, w2, y, w, y+h), area(image, 0, y, w2, y+h))
+	case 3:
+		w2, h2 := w/2, h/2
+		a := area(image, 0, y+h2, w2, y+h) + area(image, w2, y, w, y+h2)
+		b := area(image, 0, y, w2, y+h2) + area(image, w2, y+h2, w, y+h)
+		return subtractLog(a, b)
+	case 4:
+		h3 := h / 3
+		a := area(image, 0, y+h3, w, y+2*h3)
+		b := area(image, 0, y, w, y+h3) + area(image, 0, y+2*h3, w, y+h)
+		return subtractLog(a, b)
+	case 5:
+		w3 := w / 3
+		a := area(image, w3, y, 2*w3, y+h)
+		b := area(image, 0, y, w3, y+h) + area(image, 2*w3, y, w, y+h)
+		return subtractLog(a, b)
+	}
+
+	return 0
+}
+
+func (cl chromaClassifier) quantise(x float64) int {
+	switch {
+	case x < cl.t0:
+		return 0
+	case x < cl.t1:
+		return 1
+	case x < cl.t2:
+		return 2
+	}
+	return 3
+}
+
+// the sub-fingerprint for the image of the latest features
+func classify(image [][]float64) (sub uint32) {
+	for _, cl := range chromaClassifiers {
+		sub = sub<<2 | chromaGrayCode[cl.quantise(cl.apply(image))]
+	}
+
+	return
+}
+
+/*
+ * Compressed fingerprints, as output by fpcalc and used by AcoustID.
+ * Each sub-fingerprint is XORed with the one before and the positions of its set bits are written as the gaps
+ * between them, ending with a 0.  Gaps are packed as 3 bit values, with gaps of 7 or more written as 7 and the
+ * rest in a second list of 5 bit values.  A header gives the algorithm and number of sub-fingerprints, and the
+ * whole thing is base64 (URL safe without padding).
+ */
+
+const chromaNormalBits = 3
+const chromaExceptionBits = 5
+const chromaMaxNormal = 1<<chromaNormalBits - 1
+
+// Compress a fingerprint into fpcalc's string form
+func EncodeChromaprint(fp []uint32, algorithm int) string {
+	var normal, exceptions []int
+	for i, sub := range fp {
+		if i > 0 {
+			sub ^= fp[i-1]
+		}
+		bit, last := 1, 0
+		for ; sub != 0; sub >>= 1 {
+			if sub&1 != 0 {
+				if gap := bit - last; gap >= chromaMaxNormal {
+					normal = append(normal, chromaMaxNormal)
+					exceptions = append(exceptions, gap-chromaMaxNormal)
+				} else {
+					normal = append(normal, gap)
+				}
+				last = bit
+			}
+			bit++
+		}
+		normal = append(normal, 0)
+	}
+
+	out := []byte{byte(algorithm), byte(len(fp) >> 16), byte(len(fp) >> 8), byte(len(fp))}
+	out = append(out, packBits(normal, chromaNormalBits)...)
+	out = append(out, packBits(exceptions, chromaExceptionBits)...)
+
+	return base64.RawURLEncoding.EncodeToString(out)
+}
+
+// Uncompress a fingerprint from fpcalc's string form
+func DecodeChromaprint(s string) (fp []uint32, algorithm int, err error) {
+	data, err := base64.RawURLEncoding.DecodeString(strings.TrimRight(s, "="))
+	if err != nil {
+		return nil, 0, fmt.Errorf("Bad compressed fingerprint: %s", err)
+	}
+	if len(data) < 4 {
+		return nil, 0, fmt.Errorf("Compressed fingerprint is too short (%d bytes)", len(data))
+	}
+	algorithm = int(data[0])
+	size := int(data[1])<<16 | int(data[2])<<8 | int(data[3])
+	data = data[4:]
+
+	// the normal values run until every sub-fingerprint has its terminating 0
+	var normal []int
+	ends, nExceptions := 0, 0
+	for pos := 0; ends < size; pos++ {
+		if (pos+1)*chromaNormalBits > len(data)*8 {
+			return nil, 0, fmt.Errorf("Compressed fingerprint is truncated (%d of %d sub-fingerprints)", ends, size)
+		}
+		v := unpackBits(data, pos, chromaNormalBits)
+		switch v {
+		case 0:
+			ends++
+		case chromaMaxNormal:
+			nExceptions++
+		}
+		normal = append(normal, v)
+	}
+	data = data[(len(normal)*chromaNormalBits+7)/8:]
+	if nExceptions*chromaExceptionBits > len(data)*8 {
+		return nil, 0, fmt.Errorf("Compressed fingerprint is missing %d exception values", nExceptions)
+	}
+
+	fp = make([]uint32, 0, size)
+	var sub uint32
+	bit, e := 0, 0
+	for _, v := range normal {
+		if v == 0 {
+			if len(fp) > 0 {
+				sub ^= fp[len(fp)-1]
+			}
+			fp = append(fp, sub)
+			sub, bit = 0, 0
+			continue
+		}
+		if v == chromaMaxNormal {
+			v += unpackBits(data, e, chromaExceptionBits)
+			e++
+		}
+		bit += v
+		if bit > 32 {
+			return nil, 0, fmt.Errorf("Bad compressed fingerprint: bit %d set in sub-fingerprint %d", bit, len(fp))
+		}
+		sub |= 1 << uint(bit-1)
+	}
+
+	return fp, algorithm, nil
+}
+
+// pack values of the given bit width, least significant bits first
+func packBits(values []int, width int) []byte {
+	out := make([]byte, (len(values)*width+7)/8)
+	for i, v := range values {
+		for b := 0; b < width; b++ {
+			if v>>uint(b)&1 != 0 {
+				pos := i*width + b
+				out[pos/8] |= 1 << uint(pos%8)
+			}
+		}
+	}
+
+	return out
+}
+
+// the nth value of the given bit width from packed data
+func unpackBits(data []byte, n, width int) (v int) {
+	for b := 0; b < width; b++ {
+		pos := n*width + b
+		if data[pos/8]>>uint(pos%8)&1 != 0 {
+			v |= 1 << uint(b)
+		}
+	}
+
+	return
+}
+
+// A fingerprint as output by fpcalc
+type FpcalcResult struct {
+	Duration    float64
+	Fingerprint []uint32
+}
+
+// Parse the output of fpcalc, either with -raw (comma separated sub-fingerprints) or without (compressed)
+func ParseFpcalc(r io.Reader) (result FpcalcResult, err error) {
+	scanner := bufio.NewScanner(r)
+	scanner.Buffer(nil, 16*1024*1024)
+	found := false
+	for scanner.Scan() {
+		line := strings.TrimSpace(scanner.Text())
+		switch {
+		case strings.HasPrefix(line, "DURATION="):
+			result.Duration, err = strconv.ParseFloat(strings.TrimPrefix(line, "DURATION="), 64)
+			if err != nil {
+				return result, fmt.Errorf("Bad fpcalc duration: %s", err)
+			}
+		case strings.HasPrefix(line, "FINGERPRINT="):
+			result.Fingerprint, err = parseFpcalcFingerprint(strings.TrimPrefix(line, "FINGERPRINT="))
+			if err != nil {
+				return
+			}
+			found = true
+		}
+	}
+	if err = scanner.Err(); err != nil {
+		return result, fmt.Errorf("Error reading fpcalc output: %s", err)
+	}
+	if !found {
+		return result, fmt.Errorf("No fingerprint in fpcalc output")
+	}
+
+	return
+}
+
+func parseFpcalcFingerprint(s string) ([]uint32, error) {
+	if !strings.Contains(s, ",") {
+		if _, err := strconv.ParseInt(s, 10, 64); err != nil {
+			fp, _, err := DecodeChromaprint(s)
+			return fp, err
+		}
+	}
+
+	// older versions of fpcalc print the sub-fingerprints as signed
+	var fp []uint32
+	for _, field := range strings.Split(s, ",") {
+		v, err := strconv.ParseInt(field, 10, 64)
+		if err != nil {
+			return nil, fmt.Errorf("Bad fpcalc sub-fingerprint '%s': %s", field, err)
+		}
+		fp = append(fp, uint32(v))
+	}
+
+	return fp, nil
+}
+
+// The best alignment of two fingerprints
+type ChromaprintMatch struct {
+	Offset   int // a[i] lines up with b[i-Offset]
+	BER      float64
+	Compared int // sub-fingerprints in the overlap
+}
+
+// The offset in seconds at the given sample rate
+func (m ChromaprintMatch) Seconds(fs int) float64 {
+	return float64(m.Offset) * ChromaprintHop(fs)
+}
+
+func (m ChromaprintMatch) String() string {
+	return fmt.Sprintf("offset %d, BER %.3f over %d", m.Offset, m.BER, m.Compared)
+}
+
+/*
+ * Align two fingerprints the way AcoustID does: sub-fingerprints whose top bits agree vote for the offset between
+ * them, and the offsets with the most votes are then compared bit by bit over the overlap.  Offsets are limited to
+ * maxOffset either way (0 for no limit) and overlaps to at least minOverlap sub-fingerprints.
+ */
+func CompareChromaprints(a, b []uint32, maxOffset, minOverlap int) (best ChromaprintMatch, ok bool) {
+	strip := func(sub uint32) uint32 { return sub >> (32 - CHROMAPRINT_MATCH_BITS) }
+
+	positions := make(map[uint32][]int)
+	for j, sub := range b {
+		positions[strip(sub)] = append(positions[strip(sub)], j)
+	}
+	votes := make(map[int]int)
+	for i, sub := range a {
+		for _, j := range positions[strip(sub)] {
+			if maxOffset == 0 || (i-j <= maxOffset && j-i <= maxOffset) {
+				votes[i-j]++
+			}
+		}
+	}
+
+	offsets := make([]int, 0, len(votes))
+	for offset := range votes {
+		offsets = append(offsets, offset)
+	}
+	sort.Slice(offsets, func(i, j int) bool {
+		if votes[offsets[i]] != votes[offsets[j]] {
+			return votes[offsets[i]] > votes[offsets[j]]
+		}
+		return offsets[i] < offsets[j]
+	})
+
+	best.BER = 1
+	for n, offset := range offsets {
+		if n == CHROMAPRINT_ALIGN_CANDIDATES {
+			break
+		}
+		m := compareAt(a, b, offset)
+		if m.Compared >= minOverlap && m.Compared > 0 && m.BER < best.BER {
+			best, ok = m, true
+		}
+	}
+
+	return
+}
+
+// bit error rate with a[i] against b[i-offset]
+func compareAt(a, b []uint32, offset int) ChromaprintMatch {
+	m := ChromaprintMatch{Offset: offset}
+	errors := 0
+	for i := range a {
+		j := i - offset
+		if j < 0 || j >= len(b) {
+			continue
+		}
+		errors += bits.OnesCount32(a[i] ^ b[j])
+		m.Compared++
+	}
+	if m.Compared > 0 {
+		m.BER = float64(errors) / float64(32*m.Compared)
+	}
+
+	return m
+}
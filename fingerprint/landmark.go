@@ -0,0 +1,200 @@
+package fingerprint
+
+import (
+	"encoding/binary"
+	"fmt"
+	"github.com/snuffpuppet/spectre/pcm"
+	"github.com/snuffpuppet/spectre/spectral"
+	"math"
+)
+
+/*
+ * landmark:
+ * Constellation map fingerprinting as used by Shazam and Dejavu.
+ * A spectrogram is built over consecutive frames and the peaks in the time-frequency plane are picked out (see
+ * spectral.PeakPicker for how the number of peaks is kept under control).
+ * Each peak (the anchor) is then paired with the peaks in a target zone a little ahead of it in time and each
+ * pair is hashed from (f1, f2, dt).  The hashes carry the time of their anchor so the matcher can line them up.
+ * ref: https://www.ee.columbia.edu/~dpwe/papers/Wang03-shazam.pdf
+ */
+
+const LANDMARK_NFFT = 1024     // FFT size for each spectrogram column
+const LANDMARK_HOP = 256       // samples between spectrogram columns (~23ms at 11025Hz)
+const LANDMARK_MIN_FREQ = 30.0 // frequency range peaks are picked from
+const LANDMARK_MAX_FREQ = 5500.0
+const PEAK_TIME_RADIUS = 6     // a peak must be the maximum over +/- this many columns
+const PEAK_FREQ_RADIUS = 10    // and +/- this many frequency bins
+const PEAK_BANDS = 8           // frequency bands with their own adaptive threshold
+const PEAK_MEDIAN_COLUMNS = 43 // columns in the running median of each band (~1s)
+const PEAK_MARGIN = 3.0        // dB a peak must be above the median level of its band
+const PEAKS_PER_SECOND = 30    // most peaks kept in each second
+const TARGET_START = 1         // target zone starts this many columns after the anchor
+const TARGET_WIDTH = 48        // and extends for this many columns
+const TARGET_HEIGHT = 64       // maximum frequency bin distance from the anchor
+const FAN_OUT = 5              // maximum number of pairs made for each anchor
+
+// A point in the time-frequency plane
+type peak struct {
+	col  int     // spectrogram column
+	bin  int     // frequency bin
+	pxx  float64 // strength in dB
+	time float64 // stream time of the column
+}
+
+// A hashed pair of peaks
+type Landmark struct {
+	F1, F2    int     // frequency bins of the anchor and target peaks
+	Dt        int     // number of columns from anchor to target
+	Timestamp float64 // time of the anchor peak
+}
+
+// Pack the landmark into a 32 bit key: f1 (10 bits) | f2 (10 bits) | dt (12 bits)
+func (l Landmark) Key() []byte {
+	key := make([]byte, 4)
+	h := uint32(l.F1&0x3ff)<<22 | uint32(l.F2&0x3ff)<<12 | uint32(l.Dt&0xfff)
+	binary.BigEndian.PutUint32(key, h)
+
+	return key
+}
+
+func (l Landmark) String() string {
+	fstep := float64(SAMPLE_RATE) / float64(LANDMARK_NFFT)
+	return fmt.Sprintf("%7.2f -> %7.2f (+%.3fs)", float64(l.F1)*fstep, float64(l.F2)*fstep, float64(l.Dt*LANDMARK_HOP)/float64(SAMPLE_RATE))
+}
+
+// Make the prints for an anchor peak from the peaks in its target zone (in time order)
+type anchorHasher func(anchor peak, zone []peak) []Print
+
+// Streaming constellation map fingerprinter
+type Landmarker struct {
+	fstep  float64 // width of a frequency bin
+	stft   *spectral.STFT
+	picker *spectral.PeakPicker
+	hash   anchorHasher
+
+	anchored int    // columns [0, anchored) have had their anchors paired
+	peaks    []peak // peaks that may still be needed as anchors or targets
+}
+
+// Peak picking for landmarks, silenceThreshold is the floor under the adaptive threshold
+func LandmarkPeakOptions(silenceThreshold float64) spectral.PeakOptions {
+	return spectral.PeakOptions{
+		TimeRadius:    PEAK_TIME_RADIUS,
+		FreqRadius:    PEAK_FREQ_RADIUS,
+		Bands:         PEAK_BANDS,
+		MedianColumns: PEAK_MEDIAN_COLUMNS,
+		Margin:        PEAK_MARGIN,
+		Floor:         silenceThreshold,
+		MaxPerSecond:  PEAKS_PER_SECOND,
+	}
+}
+
+func NewLandmarker(fs int, silenceThreshold float64) *Landmarker {
+	return &Landmarker{
+		fstep:  float64(fs) / float64(LANDMARK_NFFT),
+		stft:   spectral.NewSTFT(fs, LANDMARK_NFFT, LANDMARK_HOP),
+		picker: spectral.NewPeakPicker(LandmarkPeakOptions(silenceThreshold)),
+		hash:   pairs,
+	}
+}
+
+// Add a frame of audio and return the prints for any anchors that are now complete
+func (l *Landmarker) Prints(frame *pcm.Frame) []Print {
+	return l.Finish(l.Analyse(frame)())
+}
+
+// The spectrogram columns of a frame
+func (l *Landmarker) Analyse(frame *pcm.Frame) func() interface{} {
+	w := l.stft.Split(frame)
+	return func() interface{} {
+		return w.Transform().DB().Band(LANDMARK_MIN_FREQ, LANDMARK_MAX_FREQ)
+	}
+}
+
+// Pick the peaks from the spectrogram columns of a frame and return the prints for any anchors that are now complete
+func (l *Landmarker) Finish(analysis interface{}) []Print {
+	l.addPeaks(l.picker.Add(analysis.(spectral.Spectrogram)))
+
+	// an anchor can only be paired once the peaks in its whole target zone are known
+	return l.landmarks(l.picker.Done() - TARGET_START - TARGET_WIDTH + 1)
+}
+
+// Finish off the stream, returning the prints for all remaining anchors
+func (l *Landmarker) Flush() []Print {
+	l.addPeaks(l.picker.Flush())
+	return l.landmarks(l.picker.Done())
+}
+
+func (l *Landmarker) addPeaks(points []spectral.Point) {
+	for _, p := range points {
+		// the picker only sees the landmark band so the bin is worked out again from the frequency
+		bin := int(math.Floor(p.Freq/l.fstep + 0.5))
+		l.peaks = append(l.peaks, peak{col: p.Column, bin: bin, pxx: p.Pxx, time: p.Time})
+	}
+}
+
+// pair up the anchors in columns [anchored, upto) with the peaks in their target zones
+func (l *Landmarker) landmarks(upto int) (prints []Print) {
+	if upto <= l.anchored {
+		return nil
+	}
+
+	for i, anchor := range l.peaks {
+		if anchor.col < l.anchored {
+			continue
+		}
+		if anchor.col >= upto {
+			break
+		}
+
+		var zone []peak
+		for _, target := range l.peaks[i+1:] {
+			dt := target.col - anchor.col
+			if dt < TARGET_START {
+				continue
+			}
+			if dt >= TARGET_START+TARGET_WIDTH {
+				break
+			}
+			if abs(target.bin-anchor.bin) <= TARGET_HEIGHT {
+				zone = append(zone, target)
+			}
+		}
+		prints = append(prints, l.hash(anchor, zone)...)
+	}
+	l.anchored = upto
+
+	// peaks are only needed while they can still be an anchor or fall within an anchor's target zone
+	keep := 0
+	for keep < len(l.peaks) && l.peaks[keep].col < l.anchored {
+		keep++
+	}
+	l.peaks = append([]peak(nil), l.peaks[keep:]...)
+
+	return
+}
+
+// pair the anchor with the first few peaks in its zone
+func pairs(anchor peak, zone []peak) (prints []Print) {
+	for n, target := range zone {
+		if n == FAN_OUT {
+			break
+		}
+		lm := Landmark{
+			F1:        anchor.bin,
+			F2:        target.bin,
+			Dt:        target.col - anchor.col,
+			Timestamp: anchor.time,
+		}
+		prints = append(prints, Print{Key: lm.Key(), Timestamp: lm.Timestamp, Source: lm})
+	}
+
+	return
+}
+
+func abs(x int) int {
+	if x < 0 {
+		return -x
+	}
+	return x
+}
@@ -0,0 +1,114 @@
+package fingerprint_test
+
+import (
+	"encoding/binary"
+	"fmt"
+	"github.com/snuffpuppet/spectre/fingerprint"
+	"github.com/snuffpuppet/spectre/pcm"
+	"math/rand"
+	"testing"
+)
+
+// Landmarks for samples fed through in blocks
+func landmarks(samples []int16) (lms []fingerprint.Landmark) {
+	l := fingerprint.NewLandmarker(fingerprint.SAMPLE_RATE, fingerprint.FILE_SILENCE_THRESHOLD)
+	var prints []fingerprint.Print
+	for b := 0; (b+1)*fingerprint.BLOCK_SIZE <= len(samples); b++ {
+		frame := pcm.NewFrame(samples[b*fingerprint.BLOCK_SIZE:(b+1)*fingerprint.BLOCK_SIZE], b, fingerprint.SAMPLE_RATE)
+		prints = append(prints, l.Prints(&frame)...)
+	}
+	for _, p := range append(prints, l.Flush()...) {
+		lms = append(lms, p.Source.(fingerprint.Landmark))
+	}
+
+	return
+}
+
+func TestLandmarkKey(t *testing.T) {
+	// the largest values the landmarker can make still fit in their fields
+	maxBin := fingerprint.LANDMARK_NFFT / 2
+	maxDt := fingerprint.TARGET_START + fingerprint.TARGET_WIDTH - 1
+	tests := []fingerprint.Landmark{
+		{F1: 0, F2: 0, Dt: 1},
+		{F1: 1, F2: 2, Dt: 3},
+		{F1: maxBin, F2: maxBin - fingerprint.TARGET_HEIGHT, Dt: maxDt},
+		{F1: maxBin - fingerprint.TARGET_HEIGHT, F2: maxBin, Dt: fingerprint.TARGET_START},
+	}
+
+	keys := make(map[uint32]fingerprint.Landmark)
+	for _, lm := range tests {
+		key := lm.Key()
+		if len(key) != 4 {
+			t.Fatalf("Key of %+v is %d bytes", lm, len(key))
+		}
+		h := binary.BigEndian.Uint32(key)
+		if f1, f2, dt := int(h>>22), int(h>>12&0x3ff), int(h&0xfff); f1 != lm.F1 || f2 != lm.F2 || dt != lm.Dt {
+			t.Errorf("Key of %+v unpacks as f1 %d, f2 %d, dt %d", lm, f1, f2, dt)
+		}
+		if other, ok := keys[h]; ok {
+			t.Errorf("Landmarks %+v and %+v have the same key", lm, other)
+		}
+		keys[h] = lm
+	}
+
+	// the timestamp isn't part of the key
+	a, b := tests[1], tests[1]
+	b.Timestamp = 10
+	if binary.BigEndian.Uint32(a.Key()) != binary.BigEndian.Uint32(b.Key()) {
+		t.Errorf("Key of %+v depends on its timestamp", a)
+	}
+}
+
+func TestLandmarkerTargetZone(t *testing.T) {
+	lms := landmarks(chords(rand.New(rand.NewSource(4)), 20, 0))
+	if len(lms) < 100 {
+		t.Fatalf("Only %d landmarks from 20s of audio", len(lms))
+	}
+
+	// targets are in the zone ahead of their anchor, with at most FAN_OUT of them for each
+	fanOut := make(map[string]int)
+	for _, lm := range lms {
+		if lm.Dt < fingerprint.TARGET_START || lm.Dt >= fingerprint.TARGET_START+fingerprint.TARGET_WIDTH {
+			t.Errorf("Landmark %+v has its target outside the zone in time", lm)
+		}
+		if d := lm.F2 - lm.F1; d > fingerprint.TARGET_HEIGHT || d < -fingerprint.TARGET_HEIGHT {
+			t.Errorf("Landmark %+v has its target outside the zone in frequency", lm)
+		}
+		anchor := fmt.Sprintf("%d@%.4f", lm.F1, lm.Timestamp)
+		if fanOut[anchor]++; fanOut[anchor] > fingerprint.FAN_OUT {
+			t.Errorf("More than %d landmarks for the anchor at %s", fingerprint.FAN_OUT, anchor)
+		}
+	}
+
+	// and the landmarks come out in time order
+	for i := 1; i < len(lms); i++ {
+		if lms[i].Timestamp < lms[i-1].Timestamp {
+			t.Fatalf("Landmark %d at %.3fs comes after one at %.3fs", i, lms[i].Timestamp, lms[i-1].Timestamp)
+		}
+	}
+}
+
+// The same audio heard later gives the same landmarks, shifted in time
+func TestLandmarkerShift(t *testing.T) {
+	samples := chords(rand.New(rand.NewSource(5)), 30, 0)
+	all := landmarks(samples)
+
+	// start the excerpt on a spectrogram column so the columns line up
+	cols := 200
+	shift := float64(cols*fingerprint.LANDMARK_HOP) / fingerprint.SAMPLE_RATE
+	excerpt := landmarks(samples[cols*fingerprint.LANDMARK_HOP : cols*fingerprint.LANDMARK_HOP+15*fingerprint.SAMPLE_RATE])
+
+	at := make(map[string]bool)
+	for _, lm := range all {
+		at[fmt.Sprintf("%x@%.3f", lm.Key(), lm.Timestamp)] = true
+	}
+	found := 0
+	for _, lm := range excerpt {
+		if at[fmt.Sprintf("%x@%.3f", lm.Key(), lm.Timestamp+shift)] {
+			found++
+		}
+	}
+	if len(excerpt) == 0 || float64(found) < 0.8*float64(len(excerpt)) {
+		t.Errorf("%d of %d landmarks from the excerpt found %.3fs later in the original", found, len(excerpt), shift)
+	}
+}
@@ -0,0 +1,107 @@
+package fingerprint
+
+import (
+	"encoding/binary"
+	"fmt"
+	"math"
+)
+
+/*
+ * panako:
+ * Peak triplet hashes that survive playback at a different speed, as in Panako.
+ * Films shown on PAL TV run about 4% fast with the pitch raised to match, which moves every peak in both time and
+ * frequency so absolute landmark hashes never line up with the reference.  Here each anchor peak is combined with
+ * two of the peaks in its target zone and hashed only from things that don't change with speed: the ratios of the
+ * frequencies to the anchor's, the ratio of the two time gaps, and a coarse band for the anchor frequency.
+ * The time covered by the triplet goes along with the hash so the matcher can work out the speed from the ratio
+ * of the reference and mic spans.
+ * ref: Six & Leman, "Panako - A Scalable Acoustic Fingerprinting System Handling Time-Scale and Pitch
+ *      Modification", ISMIR 2014
+ */
+
+const TRIPLET_ZONE_PEAKS = 6   // peaks from the start of each target zone that are combined into triplets
+const TRIPLET_PITCH_STEPS = 2  // coarse anchor frequency bands per octave
+const TRIPLET_RATIO_STEPS = 12 // frequency ratio steps per octave
+const TRIPLET_TIME_STEPS = 4   // steps in the ratio of the two time gaps (peaks jitter by a column so it's coarse)
+
+// A hashed triplet of peaks
+type Triplet struct {
+	F1, F2, F3 int     // frequency bins of the anchor and the two target peaks
+	Dt2, Dt3   int     // number of columns from the anchor to each target
+	Timestamp  float64 // time of the anchor peak
+	Span       float64 // seconds from the anchor to the last peak
+}
+
+// Pack the speed invariant parts of the triplet into a 24 bit key:
+// anchor band (4 bits) | f2/f1 (8 bits) | f3/f1 (8 bits) | dt2/dt3 (4 bits)
+func (t Triplet) Key() []byte {
+	fstep := float64(SAMPLE_RATE) / float64(LANDMARK_NFFT)
+	band := clamp(int(math.Floor(math.Log2(float64(t.F1)*fstep/LANDMARK_MIN_FREQ)*TRIPLET_PITCH_STEPS)), 0, 0xf)
+	r2 := clamp(ratioStep(t.F2, t.F1)+0x80, 0, 0xff)
+	r3 := clamp(ratioStep(t.F3, t.F1)+0x80, 0, 0xff)
+	tr := clamp(int(math.Floor(float64(t.Dt2*TRIPLET_TIME_STEPS)/float64(t.Dt3)+0.5)), 0, 0xf)
+
+	h := uint32(band)<<20 | uint32(r2)<<12 | uint32(r3)<<4 | uint32(tr)
+	key := make([]byte, 4)
+	binary.BigEndian.PutUint32(key, h)
+
+	return key[1:]
+}
+
+func (t Triplet) String() string {
+	fstep := float64(SAMPLE_RATE) / float64(LANDMARK_NFFT)
+	colTime := float64(LANDMARK_HOP) / float64(SAMPLE_RATE)
+	return fmt.Sprintf("%7.2f -> %7.2f (+%.3fs) -> %7.2f (+%.3fs)",
+		float64(t.F1)*fstep, float64(t.F2)*fstep, float64(t.Dt2)*colTime, float64(t.F3)*fstep, float64(t.Dt3)*colTime)
+}
+
+// the frequency ratio in steps of TRIPLET_RATIO_STEPS per octave
+func ratioStep(bin, anchor int) int {
+	return int(math.Floor(math.Log2(float64(bin)/float64(anchor))*TRIPLET_RATIO_STEPS + 0.5))
+}
+
+func clamp(x, lo, hi int) int {
+	if x < lo {
+		return lo
+	}
+	if x > hi {
+		return hi
+	}
+	return x
+}
+
+// Constellation map fingerprinter that makes triplets rather than pairs
+func NewTripletPrinter(fs int, silenceThreshold float64) *Landmarker {
+	l := NewLandmarker(fs, silenceThreshold)
+	l.hash = triplets
+
+	return l
+}
+
+// combine the anchor with each pair of the first few peaks in its zone
+func triplets(anchor peak, zone []peak) (prints []Print) {
+	if len(zone) > TRIPLET_ZONE_PEAKS {
+		zone = zone[:TRIPLET_ZONE_PEAKS]
+	}
+
+	for i, p2 := range zone {
+		for _, p3 := range zone[i+1:] {
+			// the time ratio needs the targets to be in order
+			if p3.col == p2.col {
+				continue
+			}
+			t := Triplet{
+				F1:        anchor.bin,
+				F2:        p2.bin,
+				F3:        p3.bin,
+				Dt2:       p2.col - anchor.col,
+				Dt3:       p3.col - anchor.col,
+				Timestamp: anchor.time,
+				Span:      p3.time - anchor.time,
+			}
+			prints = append(prints, Print{Key: t.Key(), Timestamp: t.Timestamp, Source: t, Span: t.Span})
+		}
+	}
+
+	return
+}
@@ -0,0 +1,39 @@
+package fingerprint_test
+
+import (
+	"bytes"
+	"github.com/snuffpuppet/spectre/fingerprint"
+	"math"
+	"testing"
+)
+
+// The triplet heard at a different speed, with the peaks moved to the nearest bin and column
+func stretched(t fingerprint.Triplet, speed float64) fingerprint.Triplet {
+	bin := func(b int) int { return int(math.Floor(float64(b)*speed + 0.5)) }
+	col := func(c int) int { return int(math.Floor(float64(c)/speed + 0.5)) }
+	return fingerprint.Triplet{F1: bin(t.F1), F2: bin(t.F2), F3: bin(t.F3), Dt2: col(t.Dt2), Dt3: col(t.Dt3)}
+}
+
+func TestTripletKey(t *testing.T) {
+	// away from the edges of the quantisation steps, where a bin either way can change the key
+	triplets := []fingerprint.Triplet{
+		{F1: 37, F2: 55, F3: 92, Dt2: 10, Dt3: 30},
+		{F1: 100, F2: 80, F3: 150, Dt2: 4, Dt3: 40},
+		{F1: 60, F2: 45, F3: 120, Dt2: 9, Dt3: 33},
+	}
+
+	for _, tr := range triplets {
+		for _, speed := range []float64{25 / 23.976, 23.976 / 25} {
+			if s := stretched(tr, speed); !bytes.Equal(tr.Key(), s.Key()) {
+				t.Errorf("Key of %+v changed at speed %.4f (%+v)", tr, speed, s)
+			}
+		}
+	}
+
+	// a different shape is a different key
+	other := triplets[0]
+	other.F3 = 120
+	if bytes.Equal(triplets[0].Key(), other.Key()) {
+		t.Errorf("Triplets %+v and %+v have the same key", triplets[0], other)
+	}
+}
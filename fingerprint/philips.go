@@ -0,0 +1,137 @@
+package fingerprint
+
+import (
+	"encoding/binary"
+	"fmt"
+	"github.com/snuffpuppet/spectre/pcm"
+	"github.com/snuffpuppet/spectre/spectral"
+	"math"
+)
+
+/*
+ * philips:
+ * Haitsma-Kalker sub-fingerprints as used in the Philips audio fingerprinting system.
+ * Heavily overlapping frames are split into 33 log spaced bands between 300Hz and 2kHz and each pair of adjacent
+ * bands gives one bit: whether the energy difference between them went up or down since the previous frame.
+ * Rather than relying on exact key matches, a block of 256 consecutive sub-fingerprints is compared with the
+ * reference by bit error rate (see lookup.BitIndex), which stays low enough through the noise of a mic.
+ * ref: Haitsma & Kalker, "A Highly Robust Audio Fingerprinting System", ISMIR 2002
+ */
+
+const PHILIPS_FRAME = 4096     // samples in each frame (~0.37s at 11025Hz)
+const PHILIPS_HOP = 128        // samples between frames, an overlap of 31/32 (~11.6ms)
+const PHILIPS_BANDS = 33       // bands per frame, giving 32 bits
+const PHILIPS_MIN_FREQ = 300.0 // frequency range the bands cover
+const PHILIPS_MAX_FREQ = 2000.0
+const PHILIPS_BLOCK = 256          // sub-fingerprints compared at a time when matching (~3s)
+const PHILIPS_BER_THRESHOLD = 0.35 // blocks with a bit error rate below this are a match
+
+// A 32 bit sub-fingerprint for a single frame
+type SubFingerprint struct {
+	Bits      uint32
+	Timestamp float64
+}
+
+// The key is the sub-fingerprint itself, big endian
+func (s SubFingerprint) Key() []byte {
+	key := make([]byte, 4)
+	binary.BigEndian.PutUint32(key, s.Bits)
+
+	return key
+}
+
+func (s SubFingerprint) String() string {
+	return fmt.Sprintf("%032b", s.Bits)
+}
+
+// The bits of a sub-fingerprint key as a vector of 0s and 1s for approximate lookups
+func SubFingerprintVector(key []byte) []float64 {
+	if len(key) != 4 {
+		return nil
+	}
+	bits := binary.BigEndian.Uint32(key)
+
+	v := make([]float64, 32)
+	for i := range v {
+		v[i] = float64(bits >> uint(31-i) & 1)
+	}
+
+	return v
+}
+
+// Seconds between sub-fingerprints at the given sample rate
+func PhilipsHop(fs int) float64 {
+	return float64(PHILIPS_HOP) / float64(fs)
+}
+
+// Streaming sub-fingerprint generator
+type PhilipsPrinter struct {
+	stft     *spectral.STFT
+	bands    []int     // first bin of each band, with the end of the last band at the end
+	prev     []float64 // band energy differences of the previous frame
+	havePrev bool
+}
+
+func NewPhilipsPrinter(fs int) *PhilipsPrinter {
+	fstep := float64(fs) / float64(PHILIPS_FRAME)
+	bands := make([]int, PHILIPS_BANDS+1)
+	for m := range bands {
+		f := PHILIPS_MIN_FREQ * math.Pow(PHILIPS_MAX_FREQ/PHILIPS_MIN_FREQ, float64(m)/PHILIPS_BANDS)
+		bands[m] = int(math.Floor(f/fstep + 0.5))
+	}
+
+	return &PhilipsPrinter{
+		stft:  spectral.NewSTFT(fs, PHILIPS_FRAME, PHILIPS_HOP),
+		bands: bands,
+	}
+}
+
+func (p *PhilipsPrinter) Prints(frame *pcm.Frame) []Print {
+	return p.Finish(p.Analyse(frame)())
+}
+
+func (p *PhilipsPrinter) Analyse(frame *pcm.Frame) func() interface{} {
+	w := p.stft.Split(frame)
+	return func() interface{} { return w.Transform() }
+}
+
+func (p *PhilipsPrinter) Finish(analysis interface{}) (prints []Print) {
+	s := analysis.(spectral.Spectrogram)
+	for c, col := range s.Pxx {
+		diff := p.differences(col)
+		if p.havePrev {
+			sub := SubFingerprint{Timestamp: s.Times[c]}
+			for m := range diff {
+				if diff[m]-p.prev[m] > 0 {
+					sub.Bits |= 1 << uint(31-m)
+				}
+			}
+			prints = append(prints, Print{Key: sub.Key(), Timestamp: sub.Timestamp, Source: sub})
+		}
+		p.prev = diff
+		p.havePrev = true
+	}
+
+	return
+}
+
+func (p *PhilipsPrinter) Flush() []Print {
+	return nil
+}
+
+// the energy differences between adjacent bands of a frame
+func (p *PhilipsPrinter) differences(col []float64) []float64 {
+	energy := make([]float64, PHILIPS_BANDS)
+	for m := range energy {
+		for _, x := range col[p.bands[m]:p.bands[m+1]] {
+			energy[m] += x * x
+		}
+	}
+
+	diff := make([]float64, PHILIPS_BANDS-1)
+	for m := range diff {
+		diff[m] = energy[m] - energy[m+1]
+	}
+
+	return diff
+}
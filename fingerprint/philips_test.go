@@ -0,0 +1,102 @@
+package fingerprint_test
+
+import (
+	"github.com/snuffpuppet/spectre/fingerprint"
+	"github.com/snuffpuppet/spectre/pcm"
+	"math"
+	"math/bits"
+	"math/rand"
+	"testing"
+)
+
+// Philips sub-fingerprints and their times for samples fed through in blocks
+func philips(samples []int16) (fp []uint32, times []float64) {
+	printer := fingerprint.NewPhilipsPrinter(fingerprint.SAMPLE_RATE)
+	for b := 0; (b+1)*fingerprint.BLOCK_SIZE <= len(samples); b++ {
+		frame := pcm.NewFrame(samples[b*fingerprint.BLOCK_SIZE:(b+1)*fingerprint.BLOCK_SIZE], b, fingerprint.SAMPLE_RATE)
+		for _, p := range printer.Prints(&frame) {
+			sub := p.Source.(fingerprint.SubFingerprint)
+			fp = append(fp, sub.Bits)
+			times = append(times, sub.Timestamp)
+		}
+	}
+
+	return
+}
+
+// Bit error rate between the first PHILIPS_BLOCK sub-fingerprints of a and b
+func blockBER(a, b []uint32) float64 {
+	errors := 0
+	for i := 0; i < fingerprint.PHILIPS_BLOCK; i++ {
+		errors += bits.OnesCount32(a[i] ^ b[i])
+	}
+	return float64(errors) / (32 * fingerprint.PHILIPS_BLOCK)
+}
+
+func scaled(samples []int16, gain float64) []int16 {
+	out := make([]int16, len(samples))
+	for i, x := range samples {
+		out[i] = int16(float64(x) * gain)
+	}
+	return out
+}
+
+func TestPhilipsPrinter(t *testing.T) {
+	clean := chords(rand.New(rand.NewSource(6)), 10, 0)
+	fp, times := philips(clean)
+
+	// one per frame apart from the first, which has nothing to be compared with
+	fed := len(clean) - len(clean)%fingerprint.BLOCK_SIZE
+	frames := (fed-fingerprint.PHILIPS_FRAME)/fingerprint.PHILIPS_HOP + 1
+	if len(fp) != frames-1 {
+		t.Fatalf("%d sub-fingerprints from %d frames", len(fp), frames)
+	}
+	hop := fingerprint.PhilipsHop(fingerprint.SAMPLE_RATE)
+	for i := 1; i < len(times); i++ {
+		if math.Abs(times[i]-times[i-1]-hop) > 1e-9 {
+			t.Fatalf("Sub-fingerprints %d and %d are %.4fs apart, expected %.4fs", i-1, i, times[i]-times[i-1], hop)
+		}
+	}
+
+	again, _ := philips(clean)
+	if ber := blockBER(fp, again); ber != 0 {
+		t.Errorf("The same audio has a bit error rate of %.3f", ber)
+	}
+
+	noisy, _ := philips(chords(rand.New(rand.NewSource(6)), 10, 1000))
+	if ber := blockBER(fp, noisy); ber > fingerprint.PHILIPS_BER_THRESHOLD {
+		t.Errorf("Noisy copy has a bit error rate of %.3f, over the match threshold of %.2f", ber, fingerprint.PHILIPS_BER_THRESHOLD)
+	}
+
+	quiet, _ := philips(scaled(clean, 0.25))
+	if ber := blockBER(fp, quiet); ber > 0.05 {
+		t.Errorf("Quieter copy has a bit error rate of %.3f", ber)
+	}
+
+	other, _ := philips(chords(rand.New(rand.NewSource(7)), 10, 0))
+	if ber := blockBER(fp, other); ber < 0.4 || ber > 0.6 {
+		t.Errorf("Unrelated audio has a bit error rate of %.3f, expected about 0.5", ber)
+	}
+}
+
+// Each bit says whether the energy difference between a band and the next one up rose since the last frame
+func TestPhilipsBits(t *testing.T) {
+	// a tone in the middle of band 16 getting louder
+	f := fingerprint.PHILIPS_MIN_FREQ * math.Pow(fingerprint.PHILIPS_MAX_FREQ/fingerprint.PHILIPS_MIN_FREQ, 16.5/fingerprint.PHILIPS_BANDS)
+	samples := make([]int16, 3*fingerprint.SAMPLE_RATE)
+	for i := range samples {
+		gain := 1000 + 8000*float64(i)/float64(len(samples))
+		samples[i] = int16(gain * math.Sin(2*math.Pi*f*float64(i)/fingerprint.SAMPLE_RATE))
+	}
+
+	fp, _ := philips(samples)
+	if len(fp) == 0 {
+		t.Fatalf("No sub-fingerprints")
+	}
+	for i, sub := range fp {
+		// band 16 against band 17 rises, band 15 against band 16 falls
+		if sub>>(31-16)&1 != 1 || sub>>(31-15)&1 != 0 {
+			t.Fatalf("Sub-fingerprint %d is %032b, expected bit 16 set and bit 15 clear", i, sub)
+		}
+	}
+}
@@ -0,0 +1,159 @@
+package fingerprint
+
+import (
+	"fmt"
+	"github.com/snuffpuppet/spectre/pcm"
+	"github.com/snuffpuppet/spectre/spectral"
+)
+
+/*
+ * printer:
+ * A common interface over the different fingerprinting methods so that the commands can switch between them.
+ * Block based methods (banded, chroma) produce at most one key per frame whereas time based methods (landmark,
+ * panako, philips, chromaprint) keep state across frames and can produce many keys per frame, each with its own
+ * time offset.
+ */
+
+const (
+	PRINTER_BANDED      = "banded"
+	PRINTER_CHROMA      = "chroma"
+	PRINTER_CHROMAPRINT = "chromaprint"
+	PRINTER_LANDMARK    = "landmark"
+	PRINTER_PANAKO      = "panako"
+	PRINTER_PHILIPS     = "philips"
+	PRINTER_QUANTISED   = "quantised"
+)
+
+// A fingerprint key along with the stream time that it applies to
+type Print struct {
+	Key       []byte
+	Timestamp float64
+	Source    fmt.Stringer // the fingerprint data the key was generated from (for debugging)
+	Near      [][]byte     // keys of similar fingerprints that can also be looked up (if the method has them)
+	Span      float64      // seconds of audio the key covers, for methods that can estimate playback speed (0 otherwise)
+}
+
+// A Printer turns a stream of pcm frames into fingerprint keys.
+// Printers may keep state between frames so a new one is required for each stream
+type Printer interface {
+	Prints(frame *pcm.Frame) []Print
+	Flush() []Print
+}
+
+// A Printer that can have the spectral analysis of its frames done on other goroutines, ahead of the rest of its
+// work.  Analyse is called for each frame in order and returns the analysis, which can be run on any goroutine.
+// Finish is then given the result of each analysis, again in frame order, and returns the prints for the frame.
+// Analyse and Finish can be running at the same time so they mustn't share any state.
+// Prints(frame) is the same as Finish(Analyse(frame)()).
+type PipelinedPrinter interface {
+	Printer
+	Analyse(frame *pcm.Frame) func() interface{}
+	Finish(analysis interface{}) []Print
+}
+
+// Create a new Printer of the named type
+func NewPrinter(name string, analyser spectral.Analyser, silenceThreshold float64) (Printer, error) {
+	switch name {
+	case PRINTER_BANDED:
+		return &blockPrinter{analyser, silenceThreshold, generateBanded}, nil
+	case PRINTER_QUANTISED:
+		return &blockPrinter{analyser, silenceThreshold, generateQuantised}, nil
+	case PRINTER_CHROMA:
+		return &blockPrinter{analyser, silenceThreshold, generateChroma}, nil
+	case PRINTER_LANDMARK:
+		return NewLandmarker(SAMPLE_RATE, silenceThreshold), nil
+	case PRINTER_PANAKO:
+		return NewTripletPrinter(SAMPLE_RATE, silenceThreshold), nil
+	case PRINTER_PHILIPS:
+		return NewPhilipsPrinter(SAMPLE_RATE), nil
+	case PRINTER_CHROMAPRINT:
+		return NewChromaprintPrinter(SAMPLE_RATE), nil
+	}
+
+	return nil, fmt.Errorf("Unrecognised fingerprinter requested: '%s'", name)
+}
+
+// The function to turn keys of the named type into vectors, for the methods where keys that are close together
+// are similar fingerprints
+func KeyVector(name string) (func(key []byte) []float64, error) {
+	switch name {
+	case PRINTER_QUANTISED:
+		return QuantisedVector, nil
+	case PRINTER_PHILIPS, PRINTER_CHROMAPRINT:
+		return SubFingerprintVector, nil
+	}
+
+	return nil, fmt.Errorf("Fingerprints of type '%s' have no vector form", name)
+}
+
+// Generate the key (and the data it came from) for a single block of samples
+type blockGenerator func(analyser spectral.Analyser, samples []float64, silenceThreshold float64) ([]byte, fmt.Stringer)
+
+// Printer for the fingerprint methods that work on one pcm frame at a time
+type blockPrinter struct {
+	analyser         spectral.Analyser
+	silenceThreshold float64
+	generate         blockGenerator
+}
+
+func (b *blockPrinter) Prints(frame *pcm.Frame) []Print {
+	key, src := b.generate(b.analyser, frame.AsFloat64(), b.silenceThreshold)
+	if key == nil {
+		return nil
+	}
+
+	p := Print{Key: key, Timestamp: frame.Timestamp(), Source: src}
+	if n, ok := src.(neighbours); ok {
+		p.Near = n.NeighbourKeys()
+	}
+
+	return []Print{p}
+}
+
+// Each block stands alone so all of the work can be done as the analysis
+func (b *blockPrinter) Analyse(frame *pcm.Frame) func() interface{} {
+	return func() interface{} { return b.Prints(frame) }
+}
+
+func (b *blockPrinter) Finish(analysis interface{}) []Print {
+	return analysis.([]Print)
+}
+
+// Fingerprints that can list the keys of their near neighbours
+type neighbours interface {
+	NeighbourKeys() [][]byte
+}
+
+func (b *blockPrinter) Flush() []Print {
+	return nil
+}
+
+func generateBanded(analyser spectral.Analyser, samples []float64, silenceThreshold float64) ([]byte, fmt.Stringer) {
+	fp := Generate(analyser, samples, silenceThreshold)
+
+	return Hash(fp.Fingerprint()), fp
+}
+
+func generateQuantised(analyser spectral.Analyser, samples []float64, silenceThreshold float64) ([]byte, fmt.Stringer) {
+	qp := QuantisedPeaks{Generate(analyser, samples, silenceThreshold).(*BandPeaks)}
+	if qp.Peaks() < REQUIRED_NUM_CANDIDATES {
+		return nil, nil
+	}
+
+	return qp.Key(), qp
+}
+
+func generateChroma(analyser spectral.Analyser, samples []float64, silenceThreshold float64) ([]byte, fmt.Stringer) {
+	spectra := analyser(samples, SAMPLE_RATE, NFFT, NOVERLAP, DB_SCALING)
+	spectra = spectra.Filter(
+		func(freq, pwr float64) bool {
+			return freq >= LOWER_FREQ_CUTOFF && freq <= UPPER_FREQ_CUTOFF && pwr > silenceThreshold
+		})
+
+	cp := NewChromaprint(spectra.Maxima())
+	if cp == nil {
+		return nil, nil
+	}
+
+	return cp.Fingerprint(), cp
+}
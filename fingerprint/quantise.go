@@ -0,0 +1,135 @@
+package fingerprint
+
+import (
+	"encoding/binary"
+	"fmt"
+	"math"
+)
+
+/*
+ * quantise:
+ * Locality preserving keys for banded fingerprints.
+ * Hashing the exact peak frequencies means a peak one bin out between the reference and the mic gives an unrelated
+ * key.  Here the peak in each band is quantised to a coarse bin and the bins are packed side by side into an integer
+ * key, so nearby fingerprints have nearby keys.  A peak that lands just over a coarse bin boundary can still be
+ * found by also looking up the neighbouring keys: the same key with one band moved up or down a bin.
+ */
+
+const QUANT_BIN_WIDTH = 4 // FFT bins in each quantised bin
+
+// Banded peaks with quantised keys
+type QuantisedPeaks struct {
+	*BandPeaks
+}
+
+// number of distinct values for each band: 0 for no peak and then one for each coarse bin
+func (q QuantisedPeaks) levels() []int {
+	return bandLevels(q.fbands)
+}
+
+func bandLevels(fb bands) []int {
+	levels := make([]int, len(fb.bands))
+	for i, b := range fb.bands {
+		levels[i] = 1 + (b.end-b.start+QUANT_BIN_WIDTH-1)/QUANT_BIN_WIDTH
+	}
+
+	return levels
+}
+
+// The coarse bin of the peak in each band, 0 if there is no peak
+func (q QuantisedPeaks) Bins() []int {
+	levels := q.levels()
+	bins := make([]int, len(q.freq))
+	for i, f := range q.freq {
+		if f == 0 {
+			continue
+		}
+		fftBin := int(math.Floor(f/q.fbands.fstep + 0.5))
+		bins[i] = 1 + (fftBin-q.fbands.bands[i].start)/QUANT_BIN_WIDTH
+		// a peak right at the top of a band can round up into the next bin
+		if bins[i] >= levels[i] {
+			bins[i] = levels[i] - 1
+		}
+	}
+
+	return bins
+}
+
+// Pack the bins into a big endian 64 bit key, each band taking just enough bits for its levels
+func packKey(bins, levels []int) []byte {
+	var k uint64
+	for i, b := range bins {
+		width := uint(bitsFor(levels[i]))
+		k = k<<width | uint64(b)
+	}
+
+	key := make([]byte, 8)
+	binary.BigEndian.PutUint64(key, k)
+
+	return key
+}
+
+// Unpack a quantised key into the coarse bin of each band, as a vector for approximate lookups
+func QuantisedVector(key []byte) []float64 {
+	if len(key) != 8 {
+		return nil
+	}
+	k := binary.BigEndian.Uint64(key)
+	levels := bandLevels(newBands(SAMPLE_RATE))
+
+	v := make([]float64, len(levels))
+	for i := len(levels) - 1; i >= 0; i-- {
+		width := uint(bitsFor(levels[i]))
+		v[i] = float64(k & (1<<width - 1))
+		k >>= width
+	}
+
+	return v
+}
+
+func bitsFor(n int) int {
+	bits := 0
+	for (1 << uint(bits)) < n {
+		bits++
+	}
+	return bits
+}
+
+func (q QuantisedPeaks) Key() []byte {
+	return packKey(q.Bins(), q.levels())
+}
+
+// The keys with the peak in one band moved up or down a bin
+func (q QuantisedPeaks) NeighbourKeys() (keys [][]byte) {
+	bins := q.Bins()
+	levels := q.levels()
+	for i, b := range bins {
+		if b == 0 {
+			continue
+		}
+		for _, d := range []int{-1, 1} {
+			if b+d < 1 || b+d >= levels[i] {
+				continue
+			}
+			bins[i] = b + d
+			keys = append(keys, packKey(bins, levels))
+		}
+		bins[i] = b
+	}
+
+	return
+}
+
+// Number of bands with a peak in them
+func (q QuantisedPeaks) Peaks() (n int) {
+	for _, f := range q.freq {
+		if f != 0 {
+			n++
+		}
+	}
+	return
+}
+
+func (q QuantisedPeaks) String() string {
+	return fmt.Sprintf("%s%v", q.BandPeaks, q.Bins())
+}
@@ -0,0 +1,60 @@
+package fingerprint_test
+
+import (
+	"bytes"
+	"github.com/snuffpuppet/spectre/fingerprint"
+	"github.com/snuffpuppet/spectre/spectral"
+	"testing"
+)
+
+// Quantised fingerprint of a spectrum with peaks at the given FFT bins (of 1024)
+func quantised(bins ...int) fingerprint.QuantisedPeaks {
+	fstep := float64(fingerprint.SAMPLE_RATE) / 1024
+	freqs := make([]float64, len(bins))
+	pxx := make([]float64, len(bins))
+	for i, b := range bins {
+		freqs[i] = float64(b) * fstep
+		pxx[i] = 50
+	}
+
+	return fingerprint.QuantisedPeaks{BandPeaks: fingerprint.NewBandedprint(fingerprint.SAMPLE_RATE, spectral.NewSpectra(freqs, pxx))}
+}
+
+func hasKey(keys [][]byte, key []byte) bool {
+	for _, k := range keys {
+		if bytes.Equal(k, key) {
+			return true
+		}
+	}
+	return false
+}
+
+func TestQuantisedKeys(t *testing.T) {
+	// one bin out inside a coarse bin gives the same key
+	if a, b := quantised(44, 130, 400), quantised(45, 131, 401); !bytes.Equal(a.Key(), b.Key()) {
+		t.Errorf("Peaks one bin apart have different keys: %v and %v", a.Bins(), b.Bins())
+	}
+
+	// one bin out across a coarse bin boundary gives a neighbouring key
+	a, b := quantised(47, 130, 400), quantised(48, 130, 400)
+	if bytes.Equal(a.Key(), b.Key()) {
+		t.Fatalf("Peaks in different coarse bins have the same key: %v", a.Bins())
+	}
+	if !hasKey(a.NeighbourKeys(), b.Key()) || !hasKey(b.NeighbourKeys(), a.Key()) {
+		t.Errorf("Keys for %v and %v are not neighbours", a.Bins(), b.Bins())
+	}
+
+	// two bands out is not a neighbour
+	c := quantised(48, 134, 400)
+	if hasKey(a.NeighbourKeys(), c.Key()) {
+		t.Errorf("Keys for %v and %v are neighbours", a.Bins(), c.Bins())
+	}
+
+	// each band with a peak can move up and down (apart from at the edges)
+	if n := len(quantised(47, 130, 400).NeighbourKeys()); n != 6 {
+		t.Errorf("%d neighbour keys for 3 peaks", n)
+	}
+	if n := len(quantised(40).NeighbourKeys()); n != 1 {
+		t.Errorf("%d neighbour keys for a peak at the bottom of a band", n)
+	}
+}
@@ -0,0 +1,362 @@
+package indexer
+
+import (
+	"context"
+	"fmt"
+	"github.com/snuffpuppet/spectre/ffmpeg"
+	"github.com/snuffpuppet/spectre/fingerprint"
+	"github.com/snuffpuppet/spectre/lookup"
+	"github.com/snuffpuppet/spectre/pcm"
+	"io"
+	"log"
+)
+
+/*
+ * indexer:
+ * Fingerprint reference audio files and add the results to a lookup index.
+ * Shared by the commands that build an index from raw media (sp_index, sp_listen).
+ * Several files are fingerprinted at once, each with its own decoder (an ffmpeg process for compressed media)
+ * reading ahead of its printer, and the results are merged into the index in a fixed order.  Within a file the
+ * spectral analysis of the frames (see fingerprint.PipelinedPrinter) is shared out between the same number of
+ * workers so that one long film is spread over the cores too, while the rest of the printer's work sees the
+ * frames in order.
+ * Films can have each of their audio streams indexed as a separate track tagged with its language (see
+ * lookup.TrackName), with the language also recorded against the track in the index so matches can report which
+ * dub is playing.
+ */
+
+// Create a new fingerprint printer for each stream we process
+type PrinterFactory func(silenceThreshold float64) (fingerprint.Printer, error)
+
+// The database params for fingerprints generated with the current settings
+func Params(fingerprinter, analyser string) lookup.Params {
+	return lookup.Params{
+		SampleRate:    fingerprint.SAMPLE_RATE,
+		BlockSize:     fingerprint.BLOCK_SIZE,
+		NFFT:          fingerprint.NFFT,
+		NOverlap:      fingerprint.NOVERLAP,
+		Fingerprinter: fingerprinter,
+		Analyser:      analyser,
+	}
+}
+
+const DECODE_AHEAD = 64  // frames a file can be decoded ahead of its fingerprinting
+const ANALYSE_AHEAD = 64 // frames that can be analysed ahead of the rest of their fingerprinting
+
+const ALL_TRACKS = "all" // index every audio stream of each file
+
+// An audio stream of a file and the name it is indexed under
+type Track struct {
+	Filename string
+	Name     string
+	Stream   ffmpeg.Select
+	Language string // ISO 639-2 code of the stream if it is tagged with one
+}
+
+// The tracks to index for each file.  The audio is "" for the default stream of each file, indexed under the
+// filename as it always has been, ALL_TRACKS for all of their streams or a stream number or language to pick one.
+// Anything but the default stream needs ffprobe to find the streams and their languages.
+func Tracks(ctx context.Context, filenames []string, audio string) ([]Track, error) {
+	var tracks []Track
+	if audio == "" {
+		for _, filename := range filenames {
+			tracks = append(tracks, Track{filename, filename, ffmpeg.DEFAULT_STREAM, ""})
+		}
+		return tracks, nil
+	}
+
+	var sel ffmpeg.Select
+	if audio != ALL_TRACKS {
+		var err error
+		if sel, err = ffmpeg.ParseSelect(audio); err != nil {
+			return nil, err
+		}
+	}
+
+	for _, filename := range filenames {
+		info, err := ffmpeg.Probe(ctx, filename)
+		if err != nil {
+			return nil, err
+		}
+		streams := info.Streams
+		if audio != ALL_TRACKS {
+			a, err := info.Pick(sel)
+			if err != nil {
+				return nil, err
+			}
+			streams = []ffmpeg.AudioStream{a}
+		}
+		for _, a := range streams {
+			name := lookup.TrackName(filename, streamTag(a, info.Streams))
+			tracks = append(tracks, Track{filename, name, ffmpeg.Select{Index: a.AudioIndex}, a.Language})
+		}
+	}
+
+	return tracks, nil
+}
+
+// Tag a stream with its language, adding its number if the language doesn't pick it out from the file's other streams
+func streamTag(a ffmpeg.AudioStream, streams []ffmpeg.AudioStream) string {
+	if a.Language == "" {
+		return fmt.Sprintf("#%d", a.AudioIndex)
+	}
+	for _, other := range streams {
+		if other.AudioIndex != a.AudioIndex && other.Language == a.Language {
+			return fmt.Sprintf("%s #%d", a.Language, a.AudioIndex)
+		}
+	}
+	return a.Language
+}
+
+// Fingerprint the chosen audio tracks (see Tracks) of each of the files and add them to the index, working on up to
+// workers tracks at once.  The prints are added to the index in the order the files are given so the index comes
+// out the same however many workers there are.  Verbose output is given for every frame so the tracks are done one
+// at a time with it.  The first error, or the context being cancelled, stops all the tracks being worked on.
+func Files(ctx context.Context, matches *lookup.Index, filenames []string, audio string, newPrinter PrinterFactory, workers int, verbose bool) error {
+	tracks, err := Tracks(ctx, filenames, audio)
+	if err != nil {
+		return err
+	}
+
+	if workers < 1 || verbose {
+		workers = 1
+	}
+	ctx, cancel := context.WithCancel(ctx)
+	defer cancel()
+
+	// the spectral analysis for all the tracks shares one pool of workers
+	analysts := make(chan struct{}, workers)
+
+	type result struct {
+		prints []fingerprint.Print
+		err    error
+	}
+	results := make([]chan result, len(tracks))
+	for i := range results {
+		results[i] = make(chan result, 1)
+	}
+
+	// start the tracks in order as workers become free
+	slots := make(chan struct{}, workers)
+	go func() {
+		for i, track := range tracks {
+			select {
+			case slots <- struct{}{}:
+			case <-ctx.Done():
+				return
+			}
+			go func(i int, track Track) {
+				defer func() { <-slots }()
+				prints, err := file(ctx, track.Filename, track.Stream, newPrinter, analysts, verbose)
+				results[i] <- result{prints, err}
+			}(i, track)
+		}
+	}()
+
+	for i, track := range tracks {
+		var r result
+		select {
+		case r = <-results[i]:
+		case <-ctx.Done():
+			r.err = ctx.Err()
+		}
+		if r.err != nil {
+			return fmt.Errorf("Fingerprinting %s: %w", track.Name, r.err)
+		}
+		if track.Language != "" {
+			matches.SetLanguage(track.Name, track.Language)
+		}
+		Add(matches, track.Name, r.prints)
+	}
+
+	return nil
+}
+
+// Fingerprint an audio stream of a file, decoding it in one goroutine while its frames are fingerprinted in others,
+// with the spectral analysis of up to workers frames at once
+func File(ctx context.Context, filename string, track ffmpeg.Select, newPrinter PrinterFactory, workers int, verbose bool) ([]fingerprint.Print, error) {
+	if workers < 1 {
+		workers = 1
+	}
+	return file(ctx, filename, track, newPrinter, make(chan struct{}, workers), verbose)
+}
+
+// analysts is the pool the frames' spectral analysis is shared out over
+func file(ctx context.Context, filename string, track ffmpeg.Select, newPrinter PrinterFactory, analysts chan struct{}, verbose bool) ([]fingerprint.Print, error) {
+	if track.Default() {
+		fmt.Printf("Processing fingerprints for %s...\n", filename)
+	} else {
+		fmt.Printf("Processing fingerprints for %s audio stream %s...\n", filename, track)
+	}
+	stream, err := pcm.NewTrackStream(ctx, filename, track, fingerprint.SAMPLE_RATE, fingerprint.BLOCK_SIZE)
+	if err != nil {
+		return nil, err
+	}
+	defer stream.Close()
+
+	printer, err := newPrinter(fingerprint.FILE_SILENCE_THRESHOLD)
+	if err != nil {
+		return nil, err
+	}
+
+	ahead := readAhead(ctx, stream, DECODE_AHEAD)
+	var prints []fingerprint.Print
+	if pipelined, ok := printer.(fingerprint.PipelinedPrinter); ok && cap(analysts) > 1 && !verbose {
+		prints, err = pipelinedPrints(ctx, ahead, pipelined, analysts)
+	} else {
+		prints, err = Prints(ctx, ahead, printer, verbose)
+	}
+
+	// the decoder has to be finished with the stream before it is closed
+	for range ahead.frames {
+	}
+
+	return prints, err
+}
+
+// Fingerprint a stream of audio.  Printers carry state from one frame to the next so the frames go through in order.
+func Prints(ctx context.Context, stream pcm.Reader, printer fingerprint.Printer, verbose bool) ([]fingerprint.Print, error) {
+	var prints []fingerprint.Print
+	for {
+		if err := ctx.Err(); err != nil {
+			return nil, err
+		}
+		frame, err := stream.Read()
+		if err != nil {
+			if err == io.EOF || err == io.ErrUnexpectedEOF {
+				break
+			}
+			return nil, err
+		}
+
+		fps := printer.Prints(frame)
+
+		if verbose {
+			if len(fps) == 0 {
+				PrintStatus(nil, frame, verbose)
+			}
+			for _, fp := range fps {
+				PrintStatus(fp.Source, frame, verbose)
+			}
+		}
+
+		prints = append(prints, fps...)
+	}
+
+	return append(prints, printer.Flush()...), nil
+}
+
+// Fingerprint a stream of audio with the spectral analysis of its frames running on the analysts, up to
+// ANALYSE_AHEAD frames ahead of the rest of the printer's work, which sees them in order as Prints does
+func pipelinedPrints(ctx context.Context, stream pcm.Reader, printer fingerprint.PipelinedPrinter, analysts chan struct{}) ([]fingerprint.Print, error) {
+	ctx, cancel := context.WithCancel(ctx)
+	defer cancel()
+
+	// the result of each frame's analysis, in frame order
+	pending := make(chan chan interface{}, ANALYSE_AHEAD)
+	var readErr error
+	go func() {
+		defer close(pending)
+		for {
+			frame, err := stream.Read()
+			if err != nil {
+				readErr = err
+				return
+			}
+			analyse := printer.Analyse(frame)
+
+			select {
+			case analysts <- struct{}{}:
+			case <-ctx.Done():
+				readErr = ctx.Err()
+				return
+			}
+			result := make(chan interface{}, 1)
+			go func() {
+				defer func() { <-analysts }()
+				result <- analyse()
+			}()
+
+			select {
+			case pending <- result:
+			case <-ctx.Done():
+				readErr = ctx.Err()
+				return
+			}
+		}
+	}()
+
+	var prints []fingerprint.Print
+	for result := range pending {
+		if err := ctx.Err(); err != nil {
+			return nil, err
+		}
+		prints = append(prints, printer.Finish(<-result)...)
+	}
+	if readErr != io.EOF && readErr != io.ErrUnexpectedEOF {
+		return nil, readErr
+	}
+
+	return append(prints, printer.Flush()...), nil
+}
+
+// Add the prints for a file to the index
+func Add(matches *lookup.Index, filename string, prints []fingerprint.Print) {
+	sharedCount := 0
+	for _, fp := range prints {
+		if matches.Postings(fp.Key) != nil {
+			sharedCount++
+		}
+		matches.AddSpan(fp.Key, filename, fp.Timestamp, fp.Span)
+	}
+
+	log.Printf("%s:\tFingerprints %d, shared keys: %d\n", filename, len(prints), sharedCount)
+}
+
+// Frames read from a stream by a goroutine of their own, up to ahead frames before they are wanted
+type aheadReader struct {
+	frames chan *pcm.Frame
+	err    error // why the stream ended, once frames is closed
+}
+
+func readAhead(ctx context.Context, stream pcm.Reader, ahead int) *aheadReader {
+	r := &aheadReader{frames: make(chan *pcm.Frame, ahead)}
+	go func() {
+		defer close(r.frames)
+		for {
+			frame, err := stream.Read()
+			if err != nil {
+				r.err = err
+				return
+			}
+			select {
+			case r.frames <- frame:
+			case <-ctx.Done():
+				r.err = ctx.Err()
+				return
+			}
+		}
+	}()
+
+	return r
+}
+
+func (r *aheadReader) Read() (*pcm.Frame, error) {
+	frame, ok := <-r.frames
+	if !ok {
+		return nil, r.err
+	}
+	return frame, nil
+}
+
+// Print out the fingerprint data for a frame
+func PrintStatus(fp fmt.Stringer, frame *pcm.Frame, verbose bool) {
+	if verbose {
+		header := fmt.Sprintf("[%4d:%6.2f]", frame.BlockId(), frame.Timestamp())
+		if fp == nil {
+			fmt.Printf("%s fp: nil\n", header)
+		} else {
+			fmt.Printf("%s %s\n", header, fp)
+		}
+	}
+}
@@ -0,0 +1,120 @@
+package indexer_test
+
+import (
+	"bytes"
+	"context"
+	"encoding/binary"
+	"fmt"
+	"github.com/snuffpuppet/spectre/ffmpeg"
+	"github.com/snuffpuppet/spectre/fingerprint"
+	"github.com/snuffpuppet/spectre/indexer"
+	"github.com/snuffpuppet/spectre/lookup"
+	"github.com/snuffpuppet/spectre/spectral"
+	"math"
+	"math/rand"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+)
+
+// Raw audio files of random tones at the fingerprint sample rate
+func toneFiles(t testing.TB, n int) (filenames []string) {
+	dir := t.TempDir()
+	r := rand.New(rand.NewSource(1))
+	for i := 0; i < n; i++ {
+		samples := make([]int16, (5+r.Intn(5))*fingerprint.SAMPLE_RATE)
+		f := 0.0
+		for j := range samples {
+			if j%(fingerprint.SAMPLE_RATE/4) == 0 {
+				f = 200 + 2000*r.Float64()
+			}
+			samples[j] = int16(8000 * math.Sin(2*math.Pi*f*float64(j)/fingerprint.SAMPLE_RATE))
+		}
+
+		var buf bytes.Buffer
+		binary.Write(&buf, binary.LittleEndian, samples)
+		filename := filepath.Join(dir, fmt.Sprintf("tones%d.s16le", i))
+		if err := os.WriteFile(filename, buf.Bytes(), 0644); err != nil {
+			t.Fatal(err)
+		}
+		filenames = append(filenames, filename)
+	}
+
+	return
+}
+
+func newPrinter(silenceThreshold float64) (fingerprint.Printer, error) {
+	return fingerprint.NewPrinter(fingerprint.PRINTER_LANDMARK, spectral.Amplitude, silenceThreshold)
+}
+
+// The frames of each file are analysed on several workers too, which mustn't change the prints
+func TestFilesDeterministic(t *testing.T) {
+	filenames := toneFiles(t, 6)
+
+	for _, name := range []string{fingerprint.PRINTER_LANDMARK, fingerprint.PRINTER_PHILIPS, fingerprint.PRINTER_CHROMAPRINT, fingerprint.PRINTER_QUANTISED} {
+		newPrinter := func(silenceThreshold float64) (fingerprint.Printer, error) {
+			return fingerprint.NewPrinter(name, spectral.Amplitude, silenceThreshold)
+		}
+		params := indexer.Params(name, "bespoke")
+
+		var expected []byte
+		for _, workers := range []int{1, 4, 8} {
+			idx := lookup.New()
+			if err := indexer.Files(context.Background(), idx, filenames, "", newPrinter, workers, false); err != nil {
+				t.Fatal(err)
+			}
+			if idx.Size() == 0 {
+				t.Fatalf("No %s fingerprints from %d workers", name, workers)
+			}
+
+			var db bytes.Buffer
+			if err := idx.Write(&db, params); err != nil {
+				t.Fatal(err)
+			}
+			if expected == nil {
+				expected = db.Bytes()
+			} else if !bytes.Equal(db.Bytes(), expected) {
+				t.Errorf("%s index from %d workers differs from the one from 1 worker", name, workers)
+			}
+		}
+	}
+}
+
+func TestFilesError(t *testing.T) {
+	filenames := toneFiles(t, 3)
+	missing := filepath.Join(filepath.Dir(filenames[0]), "missing.wav")
+	filenames = append(filenames[:1], append([]string{missing}, filenames[1:]...)...)
+
+	err := indexer.Files(context.Background(), lookup.New(), filenames, "", newPrinter, 4, false)
+	if err == nil || !strings.Contains(err.Error(), missing) {
+		t.Errorf("Indexing with a missing file gave %v", err)
+	}
+}
+
+// One long file, where the only speed up is from analysing its frames on several workers
+func BenchmarkFile(b *testing.B) {
+	var samples []int16
+	for _, filename := range toneFiles(b, 20) {
+		data, _ := os.ReadFile(filename)
+		for i := 0; i+1 < len(data); i += 2 {
+			samples = append(samples, int16(binary.LittleEndian.Uint16(data[i:])))
+		}
+	}
+	var buf bytes.Buffer
+	binary.Write(&buf, binary.LittleEndian, samples)
+	filename := filepath.Join(b.TempDir(), "long.s16le")
+	if err := os.WriteFile(filename, buf.Bytes(), 0644); err != nil {
+		b.Fatal(err)
+	}
+
+	for _, workers := range []int{1, 4} {
+		b.Run(fmt.Sprintf("workers=%d", workers), func(b *testing.B) {
+			for i := 0; i < b.N; i++ {
+				if _, err := indexer.File(context.Background(), filename, ffmpeg.DEFAULT_STREAM, newPrinter, workers, false); err != nil {
+					b.Fatal(err)
+				}
+			}
+		})
+	}
+}
@@ -0,0 +1,167 @@
+package lookup
+
+import (
+	"encoding/binary"
+	"fmt"
+	"math"
+	"math/bits"
+)
+
+/*
+ * bitindex:
+ * Matching for 32 bit sub-fingerprints (fingerprint.PRINTER_PHILIPS and PRINTER_CHROMAPRINT) by bit error rate.
+ * The reference sub-fingerprints are stored in the normal index, one posting per frame, and are laid out again here
+ * as a sequence for each track.  A query block is lined up against the tracks wherever one of its sub-fingerprints
+ * (or one a single bit away) appears in the reference, and the alignment with the fewest differing bits wins.
+ * With an LSH index of the sub-fingerprints (see UseVectors) blocks are also lined up wherever a sub-fingerprint
+ * several bits away from one of theirs appears, for noisier audio than the single bit search copes with.
+ */
+
+const BIT_NEIGHBOURS = 8 // most near sub-fingerprints tried for each one in a query block
+
+// The best alignment of a query block with a track
+type BitMatch struct {
+	Filename string
+	Offset   float64 // track time - query time
+	BER      float64 // fraction of bits that differ
+	Compared int     // sub-fingerprints compared
+}
+
+func (m BitMatch) String() string {
+	return fmt.Sprintf("BER %.3f over %d at offset %.2fs - %s", m.BER, m.Compared, m.Offset, m.Filename)
+}
+
+// A place in a track's sequence of sub-fingerprints
+type bitPosition struct {
+	track uint32
+	pos   int32
+}
+
+type bitTrack struct {
+	bits []uint32
+	have []bool // false where there was no sub-fingerprint (e.g. a gap in the stream)
+}
+
+type BitIndex struct {
+	tracks     []string
+	sequences  []bitTrack
+	hop        float64 // seconds between sub-fingerprints
+	candidates map[uint32][]bitPosition
+	vectors    *LSH // nil without approximate lookups
+	decode     func(key []byte) []float64
+	radius     float64
+}
+
+// Lay out the 4 byte keys of an index as a sequence of sub-fingerprints, hop seconds apart, for each track
+func NewBitIndex(idx *Index, hop float64) *BitIndex {
+	b := &BitIndex{
+		tracks:     idx.tracks,
+		sequences:  make([]bitTrack, len(idx.tracks)),
+		hop:        hop,
+		candidates: make(map[uint32][]bitPosition, len(idx.keys)),
+	}
+
+	for key, pl := range idx.keys {
+		if len(key) != 4 {
+			continue
+		}
+		sub := binary.BigEndian.Uint32([]byte(key))
+		for e := pl.head; e >= 0; e = idx.entries[e].next {
+			p := idx.entries[e].Posting
+			pos := int32(math.Floor(float64(p.Offset)/hop + 0.5))
+			b.set(p.TrackId, pos, sub)
+			b.candidates[sub] = append(b.candidates[sub], bitPosition{p.TrackId, pos})
+		}
+	}
+
+	return b
+}
+
+func (b *BitIndex) set(track uint32, pos int32, sub uint32) {
+	t := &b.sequences[track]
+	for int(pos) >= len(t.bits) {
+		t.bits = append(t.bits, 0)
+		t.have = append(t.have, false)
+	}
+	t.bits[pos] = sub
+	t.have[pos] = true
+}
+
+// Also line query blocks up with the sub-fingerprints found within radius of theirs in an LSH index built over
+// the same index with decode (see fingerprint.SubFingerprintVector)
+func (b *BitIndex) UseVectors(vectors *LSH, decode func(key []byte) []float64, radius float64) {
+	b.vectors = vectors
+	b.decode = decode
+	b.radius = radius
+}
+
+// Find the best match for a block of consecutive sub-fingerprints, the first of which is at query time start.
+// The match is only returned if its bit error rate is below threshold.
+func (b *BitIndex) Match(query []uint32, start, threshold float64) (best BitMatch, ok bool) {
+	tried := make(map[bitPosition]bool)
+	best.BER = math.Inf(1)
+
+	// line the block up with everywhere probe appears in the reference, as the i'th sub-fingerprint of the block
+	try := func(i int, probe uint32) {
+		for _, c := range b.candidates[probe] {
+			align := bitPosition{c.track, c.pos - int32(i)}
+			if tried[align] {
+				continue
+			}
+			tried[align] = true
+
+			ber, compared := b.compare(query, align)
+			// at least half of the block must line up with the track
+			if compared*2 >= len(query) && ber < best.BER {
+				best = BitMatch{
+					Filename: b.tracks[align.track],
+					Offset:   float64(align.pos)*b.hop - start,
+					BER:      ber,
+					Compared: compared,
+				}
+			}
+		}
+	}
+
+	key := make([]byte, 4)
+	for i, q := range query {
+		// the sub-fingerprint itself and everything one bit away from it
+		for flip := -1; flip < 32; flip++ {
+			probe := q
+			if flip >= 0 {
+				probe ^= 1 << uint(flip)
+			}
+			try(i, probe)
+		}
+
+		if b.vectors != nil {
+			binary.BigEndian.PutUint32(key, q)
+			for _, n := range b.vectors.Query(b.decode(key), b.radius, BIT_NEIGHBOURS) {
+				if len(n.Key) == 4 {
+					try(i, binary.BigEndian.Uint32(n.Key))
+				}
+			}
+		}
+	}
+
+	return best, best.BER < threshold
+}
+
+// bit error rate between the query and a track, with the start of the query at align
+func (b *BitIndex) compare(query []uint32, align bitPosition) (ber float64, compared int) {
+	t := b.sequences[align.track]
+	errors := 0
+	for i, q := range query {
+		pos := int(align.pos) + i
+		if pos < 0 || pos >= len(t.bits) || !t.have[pos] {
+			continue
+		}
+		errors += bits.OnesCount32(q ^ t.bits[pos])
+		compared++
+	}
+	if compared == 0 {
+		return 1, 0
+	}
+
+	return float64(errors) / float64(32*compared), compared
+}
@@ -0,0 +1,134 @@
+package lookup_test
+
+import (
+	"encoding/binary"
+	"github.com/snuffpuppet/spectre/lookup"
+	"math"
+	"math/rand"
+	"testing"
+)
+
+const hop = 128.0 / 11025
+
+func subKey(sub uint32) []byte {
+	key := make([]byte, 4)
+	binary.BigEndian.PutUint32(key, sub)
+	return key
+}
+
+// Random sub-fingerprint sequences for some tracks
+func bitTracks(r *rand.Rand, names []string, n int) map[string][]uint32 {
+	tracks := make(map[string][]uint32)
+	for _, name := range names {
+		seq := make([]uint32, n)
+		for i := range seq {
+			seq[i] = r.Uint32()
+		}
+		tracks[name] = seq
+	}
+	return tracks
+}
+
+// Flip each bit with the given probability
+func noisy(r *rand.Rand, seq []uint32, p float64) []uint32 {
+	out := make([]uint32, len(seq))
+	for i, sub := range seq {
+		for b := 0; b < 32; b++ {
+			if r.Float64() < p {
+				sub ^= 1 << uint(b)
+			}
+		}
+		out[i] = sub
+	}
+	return out
+}
+
+func TestBitIndexMatch(t *testing.T) {
+	r := rand.New(rand.NewSource(1))
+	names := []string{"film.mkv", "other.mkv", "third.mkv"}
+	tracks := bitTracks(r, names, 5000)
+
+	idx := lookup.New()
+	for _, name := range names {
+		for i, sub := range tracks[name] {
+			idx.Add(subKey(sub), name, float64(i)*hop)
+		}
+	}
+	bits := lookup.NewBitIndex(idx, hop)
+
+	// a noisy block from the middle of the film, heard at 20s on the query clock
+	query := noisy(r, tracks["other.mkv"][1000:1256], 0.1)
+	m, ok := bits.Match(query, 20, 0.35)
+	if !ok {
+		t.Fatalf("No match for a noisy block: %s", m)
+	}
+	if m.Filename != "other.mkv" || math.Abs(m.Offset-(1000*hop-20)) > 1e-6 || m.BER > 0.15 || m.Compared != 256 {
+		t.Errorf("Matched %s, expected offset %.2fs in other.mkv", m, 1000*hop-20)
+	}
+
+	// something that is not in the index at all
+	if m, ok := bits.Match(noisy(r, query, 0.5), 0, 0.35); ok {
+		t.Errorf("Random block matched: %s", m)
+	}
+}
+
+func TestBitIndexGaps(t *testing.T) {
+	r := rand.New(rand.NewSource(2))
+	seq := bitTracks(r, []string{"film.mkv"}, 1000)["film.mkv"]
+
+	// every other second of the track is missing
+	idx := lookup.New()
+	for i, sub := range seq {
+		if (i/86)%2 == 0 {
+			idx.Add(subKey(sub), "film.mkv", float64(i)*hop)
+		}
+	}
+	bits := lookup.NewBitIndex(idx, hop)
+
+	m, ok := bits.Match(seq[150:406], 0, 0.35)
+	if !ok || m.BER != 0 || m.Compared >= 256 || m.Compared < 128 {
+		t.Errorf("Matching across gaps gave %s", m)
+	}
+}
+
+// Sub-fingerprints as vectors of bits, as fingerprint.SubFingerprintVector does
+func subVector(key []byte) []float64 {
+	sub := binary.BigEndian.Uint32(key)
+	v := make([]float64, 32)
+	for i := range v {
+		v[i] = float64(sub >> uint(31-i) & 1)
+	}
+	return v
+}
+
+func TestBitIndexVectors(t *testing.T) {
+	r := rand.New(rand.NewSource(3))
+	names := []string{"film.mkv", "other.mkv"}
+	tracks := bitTracks(r, names, 2000)
+
+	idx := lookup.New()
+	for _, name := range names {
+		for i, sub := range tracks[name] {
+			idx.Add(subKey(sub), name, float64(i)*hop)
+		}
+	}
+	bits := lookup.NewBitIndex(idx, hop)
+
+	// three bits wrong in every sub-fingerprint, too many for the single bit search to line the block up
+	query := make([]uint32, 256)
+	for i, sub := range tracks["film.mkv"][500:756] {
+		for _, b := range r.Perm(32)[:3] {
+			sub ^= 1 << uint(b)
+		}
+		query[i] = sub
+	}
+	if m, ok := bits.Match(query, 0, 0.35); ok {
+		t.Fatalf("Matched %s without vectors", m)
+	}
+
+	bits.UseVectors(lookup.IndexLSH(idx, subVector, 10, 4, 4.0), subVector, 2)
+	m, ok := bits.Match(query, 0, 0.35)
+	if !ok || m.Filename != "film.mkv" || math.Abs(m.Offset-500*hop) > 1e-6 {
+		t.Errorf("Matched %s with vectors, expected offset %.2fs in film.mkv", m, 500*hop)
+	}
+}
@@ -0,0 +1,227 @@
+package lookup
+
+import (
+	"bufio"
+	"encoding/binary"
+	"fmt"
+	"io"
+	"os"
+	"sort"
+)
+
+/*
+ * database:
+ * Binary file format for saving an Index so that reference audio only needs fingerprinting once.
+ * The settings used to generate the fingerprints are stored in the header and checked when loading, since
+ * fingerprints made with different settings will never match.
+ *
+ * All values are little endian:
+ *   magic "SPDB", version uint16
+ *   params:   sample rate, block size, nfft, noverlap (uint32 each), fingerprinter, analyser (strings)
+ *   tracks:   count uint32, then for each track: name (string), language (string, empty if unknown)
+ *   keys:     count uint32, then for each key: key (bytes), posting count uint32,
+ *             postings (track uint32, offset float32, span float32)
+ *   strings and bytes are stored as a uint16 length followed by the data
+ */
+
+const DB_MAGIC = "SPDB"
+const DB_VERSION = 3
+
+// The settings that the fingerprints in an index were generated with
+type Params struct {
+	SampleRate    int
+	BlockSize     int
+	NFFT          int
+	NOverlap      int
+	Fingerprinter string
+	Analyser      string
+}
+
+func (p Params) String() string {
+	return fmt.Sprintf("rate=%d block=%d nfft=%d noverlap=%d fingerprint=%s analyser=%s",
+		p.SampleRate, p.BlockSize, p.NFFT, p.NOverlap, p.Fingerprinter, p.Analyser)
+}
+
+// Save the index to a database file
+func (idx *Index) Save(filename string, params Params) error {
+	f, err := os.Create(filename)
+	if err != nil {
+		return err
+	}
+
+	if err := idx.Write(f, params); err != nil {
+		f.Close()
+		return fmt.Errorf("Writing database %s: %s", filename, err)
+	}
+
+	return f.Close()
+}
+
+// Load an index from a database file, refusing it if it was generated with different params
+func Load(filename string, params Params) (*Index, error) {
+	f, err := os.Open(filename)
+	if err != nil {
+		return nil, err
+	}
+	defer f.Close()
+
+	idx, dbParams, err := Read(f)
+	if err != nil {
+		return nil, fmt.Errorf("Reading database %s: %s", filename, err)
+	}
+
+	if dbParams != params {
+		return nil, fmt.Errorf("Database %s was generated with different settings (%s) to those requested (%s)", filename, dbParams, params)
+	}
+
+	return idx, nil
+}
+
+func (idx *Index) Write(w io.Writer, params Params) error {
+	bw := &dbWriter{w: bufio.NewWriter(w)}
+
+	bw.bytes([]byte(DB_MAGIC))
+	bw.uint16(DB_VERSION)
+
+	bw.uint32(uint32(params.SampleRate))
+	bw.uint32(uint32(params.BlockSize))
+	bw.uint32(uint32(params.NFFT))
+	bw.uint32(uint32(params.NOverlap))
+	bw.string(params.Fingerprinter)
+	bw.string(params.Analyser)
+
+	bw.uint32(uint32(len(idx.tracks)))
+	for id, t := range idx.tracks {
+		bw.string(t)
+		bw.string(idx.languages[id])
+	}
+
+	// write the keys in order so the same index always gives the same file
+	keys := make([]string, 0, len(idx.keys))
+	for k := range idx.keys {
+		keys = append(keys, k)
+	}
+	sort.Strings(keys)
+
+	bw.uint32(uint32(len(keys)))
+	for _, k := range keys {
+		postings := idx.Postings([]byte(k))
+		bw.string(k)
+		bw.uint32(uint32(len(postings)))
+		for _, p := range postings {
+			bw.uint32(p.TrackId)
+			bw.write(p.Offset)
+			bw.write(p.Span)
+		}
+	}
+
+	if bw.err != nil {
+		return bw.err
+	}
+
+	return bw.w.Flush()
+}
+
+func Read(r io.Reader) (*Index, Params, error) {
+	var params Params
+	br := &dbReader{r: bufio.NewReader(r)}
+
+	magic := br.fixed(len(DB_MAGIC))
+	if br.err == nil && string(magic) != DB_MAGIC {
+		return nil, params, fmt.Errorf("Not a fingerprint database")
+	}
+	version := br.uint16()
+	if br.err == nil && version != DB_VERSION {
+		return nil, params, fmt.Errorf("Unsupported database version %d (expected %d)", version, DB_VERSION)
+	}
+
+	params.SampleRate = int(br.uint32())
+	params.BlockSize = int(br.uint32())
+	params.NFFT = int(br.uint32())
+	params.NOverlap = int(br.uint32())
+	params.Fingerprinter = br.string()
+	params.Analyser = br.string()
+
+	idx := New()
+
+	nTracks := br.uint32()
+	for i := uint32(0); i < nTracks && br.err == nil; i++ {
+		name := br.string()
+		idx.SetLanguage(name, br.string())
+	}
+
+	nKeys := br.uint32()
+	for i := uint32(0); i < nKeys && br.err == nil; i++ {
+		key := []byte(br.string())
+		nPostings := br.uint32()
+		for j := uint32(0); j < nPostings && br.err == nil; j++ {
+			var p Posting
+			p.TrackId = br.uint32()
+			br.read(&p.Offset)
+			br.read(&p.Span)
+			if br.err == nil && p.TrackId >= nTracks {
+				return nil, params, fmt.Errorf("Posting refers to unknown track %d", p.TrackId)
+			}
+			idx.add(key, p)
+		}
+	}
+
+	if br.err != nil {
+		return nil, params, br.err
+	}
+
+	return idx, params, nil
+}
+
+// Writes values in the database byte order, remembering the first error
+type dbWriter struct {
+	w   *bufio.Writer
+	err error
+}
+
+func (d *dbWriter) write(v interface{}) {
+	if d.err == nil {
+		d.err = binary.Write(d.w, binary.LittleEndian, v)
+	}
+}
+
+func (d *dbWriter) uint16(v uint16) { d.write(v) }
+func (d *dbWriter) uint32(v uint32) { d.write(v) }
+func (d *dbWriter) bytes(b []byte)  { d.write(b) }
+
+func (d *dbWriter) string(s string) {
+	if len(s) > 0xffff {
+		d.err = fmt.Errorf("String too long for database: %d bytes", len(s))
+		return
+	}
+	d.uint16(uint16(len(s)))
+	d.bytes([]byte(s))
+}
+
+// Reads values in the database byte order, remembering the first error
+type dbReader struct {
+	r   *bufio.Reader
+	err error
+}
+
+func (d *dbReader) read(v interface{}) {
+	if d.err == nil {
+		d.err = binary.Read(d.r, binary.LittleEndian, v)
+		if d.err == io.EOF {
+			d.err = io.ErrUnexpectedEOF
+		}
+	}
+}
+
+func (d *dbReader) uint16() (v uint16) { d.read(&v); return }
+func (d *dbReader) uint32() (v uint32) { d.read(&v); return }
+
+func (d *dbReader) fixed(n int) []byte {
+	b := make([]byte, n)
+	d.read(b)
+	return b
+}
+
+func (d *dbReader) string() string {
+	return string(d.fixed(int(d.uint16())))
+}
@@ -0,0 +1,92 @@
+package lookup_test
+
+import (
+	"bytes"
+	"github.com/snuffpuppet/spectre/lookup"
+	"os"
+	"path/filepath"
+	"reflect"
+	"testing"
+)
+
+var params = lookup.Params{
+	SampleRate:    11025,
+	BlockSize:     2048,
+	NFFT:          1024,
+	NOverlap:      512,
+	Fingerprinter: "landmark",
+	Analyser:      "bespoke",
+}
+
+func testIndex() *lookup.Index {
+	idx := lookup.New()
+	idx.Add([]byte("key1"), "film.mkv", 1.5)
+	idx.Add([]byte("key2"), "film.mkv", 2.0)
+	idx.Add([]byte("key1"), "other.mkv", 10.25)
+	idx.Add([]byte("key1"), "film.mkv", 30.0)
+	idx.AddSpan([]byte("key3"), "other.mkv", 12.5, 0.75)
+	idx.SetLanguage("other.mkv", "fre")
+
+	return idx
+}
+
+func TestDatabaseRoundTrip(t *testing.T) {
+	idx := testIndex()
+
+	var buf bytes.Buffer
+	if err := idx.Write(&buf, params); err != nil {
+		t.Fatalf("Write failed: %s", err)
+	}
+
+	loaded, loadedParams, err := lookup.Read(&buf)
+	if err != nil {
+		t.Fatalf("Read failed: %s", err)
+	}
+
+	if loadedParams != params {
+		t.Errorf("Params not preserved: got %s, want %s", loadedParams, params)
+	}
+	if !reflect.DeepEqual(loaded.Tracks(), idx.Tracks()) {
+		t.Errorf("Tracks not preserved: got %v, want %v", loaded.Tracks(), idx.Tracks())
+	}
+	for _, track := range idx.Tracks() {
+		if loaded.Language(track) != idx.Language(track) {
+			t.Errorf("Language of %s not preserved: got %q, want %q", track, loaded.Language(track), idx.Language(track))
+		}
+	}
+	if loaded.Language("other.mkv") != "fre" {
+		t.Errorf("Language of other.mkv loaded as %q", loaded.Language("other.mkv"))
+	}
+	for _, key := range []string{"key1", "key2", "key3", "missing"} {
+		got, want := loaded.Postings([]byte(key)), idx.Postings([]byte(key))
+		if !reflect.DeepEqual(got, want) {
+			t.Errorf("Postings for %s not preserved: got %v, want %v", key, got, want)
+		}
+	}
+}
+
+func TestDatabaseParamsMismatch(t *testing.T) {
+	filename := filepath.Join(t.TempDir(), "test.db")
+	if err := testIndex().Save(filename, params); err != nil {
+		t.Fatalf("Save failed: %s", err)
+	}
+
+	if _, err := lookup.Load(filename, params); err != nil {
+		t.Errorf("Load with matching params failed: %s", err)
+	}
+
+	other := params
+	other.Fingerprinter = "banded"
+	if _, err := lookup.Load(filename, other); err == nil {
+		t.Errorf("Load with mismatched params succeeded")
+	}
+}
+
+func TestDatabaseBadFile(t *testing.T) {
+	filename := filepath.Join(t.TempDir(), "junk.db")
+	os.WriteFile(filename, []byte("not a database"), 0644)
+
+	if _, err := lookup.Load(filename, params); err == nil {
+		t.Errorf("Load of junk file succeeded")
+	}
+}
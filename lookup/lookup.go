@@ -1,5 +1,11 @@
 package lookup
 
+/*
+ * lookup:
+ * Index of fingerprint keys to every place in the reference audio that they were found.
+ * Each key maps to a posting list of (track, offset) entries so that keys shared between tracks, or repeated
+ * within a track, are all kept rather than the last one written winning.
+ */
 
 // The data that the fingerprint maps to
 type Match struct {
@@ -7,19 +13,137 @@ type Match struct {
 	Timestamp   float64
 }
 
-type Matches map[string]Match
+// A single place in the reference audio that a fingerprint was found
+type Posting struct {
+	TrackId uint32
+	Offset  float32
+	Span    float32 // seconds of audio the fingerprint covers, 0 if the method doesn't say
+}
+
+// Postings for all keys are kept in one slice, each entry linking to the next entry for the same key.
+// This saves a slice header and allocation for every key in the index.
+type entry struct {
+	Posting
+	next int32 // index of the next entry for the same key, -1 at the end of the list
+}
+
+// first and last entries in a key's posting list
+type postingList struct {
+	head, tail int32
+}
+
+type Index struct {
+	tracks    []string
+	languages []string // language of each track, "" if it wasn't tagged with one
+	trackIds  map[string]uint32
+	keys      map[string]postingList
+	entries   []entry
+}
+
+func New() *Index {
+	return &Index{
+		trackIds: make(map[string]uint32),
+		keys:     make(map[string]postingList),
+	}
+}
+
+// Get the id for a track, adding it to the index if it is new
+func (idx *Index) trackId(filename string) uint32 {
+	id, ok := idx.trackIds[filename]
+	if !ok {
+		id = uint32(len(idx.tracks))
+		idx.tracks = append(idx.tracks, filename)
+		idx.languages = append(idx.languages, "")
+		idx.trackIds[filename] = id
+	}
+
+	return id
+}
 
-func (m Matches) Add(fp []byte, filename string, ts float64) {
-	m[string(fp)] = Match{ filename, ts }
+func (idx *Index) Add(fp []byte, filename string, ts float64) {
+	idx.AddSpan(fp, filename, ts, 0)
 }
 
-func (m Matches) Lookup(fp []byte) (*Match, bool) {
-	 v, ok := m[string(fp)]
+// Add a fingerprint along with the time it covers, so that the playback speed can be worked out when matching
+func (idx *Index) AddSpan(fp []byte, filename string, ts, span float64) {
+	idx.add(fp, Posting{idx.trackId(filename), float32(ts), float32(span)})
+}
+
+// Append a posting to the end of a key's posting list
+func (idx *Index) add(fp []byte, p Posting) {
+	e := int32(len(idx.entries))
+	idx.entries = append(idx.entries, entry{p, -1})
 
-	return &v, ok
+	pl, ok := idx.keys[string(fp)]
+	if ok {
+		idx.entries[pl.tail].next = e
+		pl.tail = e
+	} else {
+		pl = postingList{e, e}
+	}
+	idx.keys[string(fp)] = pl
 }
 
-func New() Matches {
-	return make(Matches)
+// Return all the postings for a fingerprint in the order they were added
+func (idx *Index) Postings(fp []byte) []Posting {
+	pl, ok := idx.keys[string(fp)]
+	if !ok {
+		return nil
+	}
+
+	postings := make([]Posting, 0, 1)
+	for e := pl.head; e >= 0; e = idx.entries[e].next {
+		postings = append(postings, idx.entries[e].Posting)
+	}
+
+	return postings
 }
 
+// Return all the matches for a fingerprint with the track names filled in
+func (idx *Index) Lookup(fp []byte) ([]Match, bool) {
+	postings := idx.Postings(fp)
+	if postings == nil {
+		return nil, false
+	}
+
+	matches := make([]Match, len(postings))
+	for i, p := range postings {
+		matches[i] = Match{idx.Track(p.TrackId), float64(p.Offset)}
+	}
+
+	return matches, true
+}
+
+// Name of the track with the given id
+func (idx *Index) Track(id uint32) string {
+	return idx.tracks[id]
+}
+
+// Names of all the tracks in the index, indexed by track id
+func (idx *Index) Tracks() []string {
+	return idx.tracks
+}
+
+// Record the language of a track's audio (an ISO 639-2 code), adding the track to the index if it is new
+func (idx *Index) SetLanguage(track, language string) {
+	idx.languages[idx.trackId(track)] = language
+}
+
+// Language of a track's audio, "" if it is unknown or the track isn't in the index
+func (idx *Index) Language(track string) string {
+	id, ok := idx.trackIds[track]
+	if !ok {
+		return ""
+	}
+	return idx.languages[id]
+}
+
+// Number of distinct fingerprint keys
+func (idx *Index) Len() int {
+	return len(idx.keys)
+}
+
+// Total number of postings over all keys
+func (idx *Index) Size() int {
+	return len(idx.entries)
+}
@@ -0,0 +1,64 @@
+package lookup_test
+
+import (
+	"github.com/snuffpuppet/spectre/lookup"
+	"reflect"
+	"testing"
+)
+
+func TestIndex(t *testing.T) {
+	idx := lookup.New()
+	if idx.Len() != 0 || idx.Size() != 0 || len(idx.Tracks()) != 0 {
+		t.Fatalf("New index has %d keys, %d postings and %d tracks", idx.Len(), idx.Size(), len(idx.Tracks()))
+	}
+
+	idx.Add([]byte("key1"), "film.mkv", 1.5)
+	idx.AddSpan([]byte("key1"), "other.mkv", 10.25, 0.5)
+	idx.Add([]byte("key2"), "film.mkv", 2.0)
+	idx.Add([]byte("key1"), "film.mkv", 30.0)
+
+	// each filename gets one track id, in the order they were first seen
+	if tracks := idx.Tracks(); !reflect.DeepEqual(tracks, []string{"film.mkv", "other.mkv"}) {
+		t.Errorf("Tracks are %v", tracks)
+	}
+	if idx.Track(0) != "film.mkv" || idx.Track(1) != "other.mkv" {
+		t.Errorf("Track ids give %s and %s", idx.Track(0), idx.Track(1))
+	}
+
+	// every place a key was found is kept, in the order added
+	expected := []lookup.Posting{
+		{TrackId: 0, Offset: 1.5},
+		{TrackId: 1, Offset: 10.25, Span: 0.5},
+		{TrackId: 0, Offset: 30.0},
+	}
+	if postings := idx.Postings([]byte("key1")); !reflect.DeepEqual(postings, expected) {
+		t.Errorf("Postings for key1 are %v, expected %v", postings, expected)
+	}
+
+	matches, ok := idx.Lookup([]byte("key1"))
+	expectedMatches := []lookup.Match{{"film.mkv", 1.5}, {"other.mkv", 10.25}, {"film.mkv", 30.0}}
+	if !ok || !reflect.DeepEqual(matches, expectedMatches) {
+		t.Errorf("Lookup for key1 gave %v, expected %v", matches, expectedMatches)
+	}
+
+	if postings := idx.Postings([]byte("missing")); postings != nil {
+		t.Errorf("Postings for an unknown key are %v", postings)
+	}
+	if matches, ok := idx.Lookup([]byte("missing")); ok || matches != nil {
+		t.Errorf("Lookup for an unknown key gave %v", matches)
+	}
+
+	// languages are kept for each track, and a track can be added along with its language before its prints
+	idx.SetLanguage("other.mkv", "fre")
+	idx.SetLanguage("film.mkv [ger]", "ger")
+	if idx.Language("film.mkv") != "" || idx.Language("other.mkv") != "fre" || idx.Language("film.mkv [ger]") != "ger" || idx.Language("missing.mkv") != "" {
+		t.Errorf("Languages are %q, %q, %q and %q", idx.Language("film.mkv"), idx.Language("other.mkv"), idx.Language("film.mkv [ger]"), idx.Language("missing.mkv"))
+	}
+	if len(idx.Tracks()) != 3 {
+		t.Errorf("Tracks are %v after setting a language", idx.Tracks())
+	}
+
+	if idx.Len() != 2 || idx.Size() != 4 {
+		t.Errorf("Index has %d keys and %d postings, expected 2 and 4", idx.Len(), idx.Size())
+	}
+}
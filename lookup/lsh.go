@@ -0,0 +1,168 @@
+package lookup
+
+import (
+	"math"
+	"math/rand"
+	"sort"
+)
+
+/*
+ * lsh:
+ * Locality sensitive hashing for approximate lookups of fingerprints that are close to, but not exactly, a key in
+ * the index.  Each key is turned into a vector (see fingerprint.KeyVector) and hashed into a number of tables with
+ * random projections (p-stable LSH for euclidean distance): h(v) = floor((a.v + b) / width).  Each table combines
+ * several projections so that only close vectors are likely to share a bucket, and using several tables makes it
+ * likely that close vectors share at least one.  Binary fingerprints work as vectors of 0/1, where the squared
+ * distance is the number of differing bits.
+ * ref: Datar et al, "Locality-Sensitive Hashing Scheme Based on p-Stable Distributions", SCG 2004
+ */
+
+const LSH_SEED = 1 // projections are random but fixed so that results are repeatable
+
+// A key near to the one being looked up
+type Neighbour struct {
+	Key      []byte
+	Distance float64
+}
+
+type lshTable struct {
+	a       [][]float64 // one projection per hash
+	b       []float64
+	buckets map[uint64][]int32 // bucket hash to vector numbers
+}
+
+type LSH struct {
+	tables  []lshTable
+	hashes  int     // projections combined in each table
+	width   float64 // bucket width of each projection
+	dim     int
+	rnd     *rand.Rand
+	keys    []string
+	vectors [][]float64
+}
+
+// An empty LSH index with the given number of tables, each combining hashes projections of the given width
+func NewLSH(tables, hashes int, width float64) *LSH {
+	return &LSH{
+		tables: make([]lshTable, tables),
+		hashes: hashes,
+		width:  width,
+		rnd:    rand.New(rand.NewSource(LSH_SEED)),
+	}
+}
+
+// Build an LSH index over all the keys of an index, decode turns a key into its vector (nil to leave it out)
+func IndexLSH(idx *Index, decode func(key []byte) []float64, tables, hashes int, width float64) *LSH {
+	l := NewLSH(tables, hashes, width)
+
+	// sorted so that the tables come out the same every time
+	keys := make([]string, 0, len(idx.keys))
+	for key := range idx.keys {
+		keys = append(keys, key)
+	}
+	sort.Strings(keys)
+
+	for _, key := range keys {
+		if v := decode([]byte(key)); v != nil {
+			l.Add([]byte(key), v)
+		}
+	}
+
+	return l
+}
+
+// Set up the projections once the number of dimensions is known
+func (l *LSH) init(dim int) {
+	l.dim = dim
+	for t := range l.tables {
+		table := &l.tables[t]
+		table.a = make([][]float64, l.hashes)
+		table.b = make([]float64, l.hashes)
+		for h := range table.a {
+			table.a[h] = make([]float64, dim)
+			for i := range table.a[h] {
+				table.a[h][i] = l.rnd.NormFloat64()
+			}
+			table.b[h] = l.rnd.Float64() * l.width
+		}
+		table.buckets = make(map[uint64][]int32)
+	}
+}
+
+// the bucket a vector falls in for a table
+func (l *LSH) bucket(table *lshTable, v []float64) uint64 {
+	// FNV-1a over the projections
+	h := uint64(14695981039346656037)
+	for i, a := range table.a {
+		dot := table.b[i]
+		for j, x := range v {
+			dot += a[j] * x
+		}
+		h ^= uint64(int64(math.Floor(dot / l.width)))
+		h *= 1099511628211
+	}
+
+	return h
+}
+
+// Add a key and its vector, all vectors must be the same length
+func (l *LSH) Add(key []byte, v []float64) {
+	if l.dim == 0 {
+		l.init(len(v))
+	}
+	if len(v) != l.dim {
+		return
+	}
+
+	n := int32(len(l.vectors))
+	l.keys = append(l.keys, string(key))
+	l.vectors = append(l.vectors, v)
+	for t := range l.tables {
+		table := &l.tables[t]
+		b := l.bucket(table, v)
+		table.buckets[b] = append(table.buckets[b], n)
+	}
+}
+
+// Find the keys within radius of a vector, closest first, returning at most max of them (0 for all)
+func (l *LSH) Query(v []float64, radius float64, max int) []Neighbour {
+	if len(v) != l.dim {
+		return nil
+	}
+
+	seen := make(map[int32]bool)
+	var near []Neighbour
+	for t := range l.tables {
+		table := &l.tables[t]
+		for _, n := range table.buckets[l.bucket(table, v)] {
+			if seen[n] {
+				continue
+			}
+			seen[n] = true
+			if d := distance(v, l.vectors[n]); d <= radius {
+				near = append(near, Neighbour{Key: []byte(l.keys[n]), Distance: d})
+			}
+		}
+	}
+
+	sort.SliceStable(near, func(i, j int) bool { return near[i].Distance < near[j].Distance })
+	if max > 0 && len(near) > max {
+		near = near[:max]
+	}
+
+	return near
+}
+
+// Number of vectors in the index
+func (l *LSH) Len() int {
+	return len(l.vectors)
+}
+
+func distance(a, b []float64) float64 {
+	sum := 0.0
+	for i := range a {
+		d := a[i] - b[i]
+		sum += d * d
+	}
+	return math.Sqrt(sum)
+}
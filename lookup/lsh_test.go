@@ -0,0 +1,94 @@
+package lookup_test
+
+import (
+	"bytes"
+	"encoding/binary"
+	"github.com/snuffpuppet/spectre/lookup"
+	"math"
+	"math/rand"
+	"testing"
+)
+
+// Sub-fingerprint bits as a vector of 0/1
+func bitVector(sub uint32) []float64 {
+	v := make([]float64, 32)
+	for b := range v {
+		v[b] = float64(sub >> uint(b) & 1)
+	}
+	return v
+}
+
+func TestLSHQuery(t *testing.T) {
+	r := rand.New(rand.NewSource(3))
+	idx := lookup.New()
+	subs := make([]uint32, 2000)
+	for i := range subs {
+		subs[i] = r.Uint32()
+		idx.Add(subKey(subs[i]), "film.mkv", float64(i)*hop)
+	}
+	target := subs[500]
+	near := target ^ 1<<3                    // one bit out
+	further := target ^ 1<<3 ^ 1<<17 ^ 1<<29 // three bits out
+	idx.Add(subKey(near), "film.mkv", 1)
+	idx.Add(subKey(further), "film.mkv", 2)
+
+	decode := func(key []byte) []float64 {
+		return bitVector(binary.BigEndian.Uint32(key))
+	}
+	l := lookup.IndexLSH(idx, decode, 16, 4, 4)
+	if l.Len() != len(subs)+2 {
+		t.Fatalf("%d vectors indexed, expected %d", l.Len(), len(subs)+2)
+	}
+
+	// the target itself, then one bit out, then three bits out
+	found := l.Query(bitVector(target), 2, 0)
+	if len(found) != 3 {
+		t.Fatalf("Found %d neighbours within radius 2, expected 3", len(found))
+	}
+	for i, expected := range []uint32{target, near, further} {
+		if !bytes.Equal(found[i].Key, subKey(expected)) {
+			t.Errorf("Neighbour %d is %x, expected %08x", i, found[i].Key, expected)
+		}
+	}
+	if found[1].Distance != 1 || math.Abs(found[2].Distance-math.Sqrt(3)) > 1e-9 {
+		t.Errorf("Distances %.3f and %.3f, expected 1 and %.3f", found[1].Distance, found[2].Distance, math.Sqrt(3))
+	}
+
+	// limit the number of neighbours
+	if found := l.Query(bitVector(target), 2, 1); len(found) != 1 || !bytes.Equal(found[0].Key, subKey(target)) {
+		t.Errorf("Closest neighbour only gave %v", found)
+	}
+
+	// random vectors are about 4 bits out, so none are within the radius
+	if found := l.Query(bitVector(r.Uint32()), 2, 0); len(found) != 0 {
+		t.Errorf("Random vector has %d neighbours", len(found))
+	}
+}
+
+func TestLSHTables(t *testing.T) {
+	r := rand.New(rand.NewSource(4))
+	subs := make([]uint32, 500)
+	for i := range subs {
+		subs[i] = r.Uint32()
+	}
+
+	// how many noisy vectors are found with a number of tables
+	recall := func(tables int) int {
+		l := lookup.NewLSH(tables, 4, 4)
+		for _, sub := range subs {
+			l.Add(subKey(sub), bitVector(sub))
+		}
+		n := 0
+		for _, sub := range subs {
+			if len(l.Query(bitVector(sub^1<<uint(r.Intn(32))^1<<uint(r.Intn(32))), 2, 0)) > 0 {
+				n++
+			}
+		}
+		return n
+	}
+
+	one, many := recall(1), recall(16)
+	if many <= one || many < len(subs)*9/10 {
+		t.Errorf("Found %d/%d noisy vectors with 1 table and %d with 16", one, len(subs), many)
+	}
+}
@@ -0,0 +1,19 @@
+package lookup
+
+import "fmt"
+
+/*
+ * tracks:
+ * A file with several audio streams, a film with a dub for each language, is indexed as a track for each stream.
+ * The track is named after the file with a tag for the stream, e.g. "film.mkv [eng]" or "film.mkv [eng #2]" when
+ * two streams share a language, so that the tracks of a file can be told apart when they are listed.  The language
+ * itself is kept with the track in the index (see Index.SetLanguage) rather than read back out of the name.
+ */
+
+// The name a stream of a file is indexed under, just the filename without a tag
+func TrackName(filename, tag string) string {
+	if tag == "" {
+		return filename
+	}
+	return fmt.Sprintf("%s [%s]", filename, tag)
+}
@@ -0,0 +1,22 @@
+package lookup_test
+
+import (
+	"github.com/snuffpuppet/spectre/lookup"
+	"testing"
+)
+
+func TestTrackNames(t *testing.T) {
+	tests := []struct {
+		filename, tag, name string
+	}{
+		{"film.mkv", "", "film.mkv"},
+		{"film.mkv", "eng", "film.mkv [eng]"},
+		{"film [1999].mkv", "eng #2", "film [1999].mkv [eng #2]"},
+		{"film.mkv", "#3", "film.mkv [#3]"},
+	}
+	for _, test := range tests {
+		if name := lookup.TrackName(test.filename, test.tag); name != test.name {
+			t.Errorf("TrackName(%q, %q) = %q, expected %q", test.filename, test.tag, name, test.name)
+		}
+	}
+}
@@ -1,10 +1,15 @@
 package pcm
 
 import (
+	"context"
 	"os/exec"
 	"github.com/mjibson/go-dsp/wav"
 	"io"
 	"fmt"
+	"os"
+	"strings"
+	"errors"
+	"path/filepath"
 	//"log"
 	"github.com/snuffpuppet/spectre/ffmpeg"
 )
@@ -14,10 +19,21 @@ import (
  * Provide abstraction over an audio stream source.
  * File streams are provided via ffmpeg decoding and microphone streams are provided through the portaudio library
  * The Stream struct abstracts the differences
+ * WAV and raw PCM files are decoded natively (see wavstream) so ffmpeg is only needed for compressed formats.
+ * Raw files are recognised by their extension (.raw/.pcm/.s16le or .f32le) and taken to be mono at the requested
+ * sample rate, as written by sp_record.
+ * Cancelling the stream's context kills ffmpeg and makes the next Read return the context's error.
+ * Files with several audio streams (films with a dub for each language) can have any one of them decoded.
+ * If ffmpeg fails, during start up or part way through, its error output is returned rather than an early end of file.
  */
 
 type FileStream struct {
+	ctx        context.Context
+	filename   string
+	native     *WavStream	// set if the file is being decoded without ffmpeg
 	cmd	   *exec.Cmd
+	stderr     *ffmpeg.Stderr	// the tail of ffmpeg's complaints
+	waited     bool			// set once ffmpeg has exited
 	in	   io.ReadCloser
 	audio	   *wav.Wav
 	blockSize  int
@@ -27,13 +43,53 @@ type FileStream struct {
 }
 
 func (f *FileStream) Close() (err error) {
+	if f.native != nil {
+		return f.native.Close()
+	}
 	f.in.Close()
-	return f.cmd.Wait()
+	if f.waited {
+		return nil
+	}
+	return f.wait()
+}
+
+// Wait for ffmpeg to exit, explaining why if it failed
+func (f *FileStream) wait() error {
+	f.waited = true
+	if err := f.cmd.Wait(); err != nil {
+		// ffmpeg was killed because the stream was cancelled
+		if f.ctx.Err() != nil {
+			return f.cancelled()
+		}
+		return f.stderr.Wrap(fmt.Errorf("Decoding %s: ffmpeg %s", f.filename, err))
+	}
+	return nil
+}
+
+func (f *FileStream) cancelled() error {
+	return fmt.Errorf("Reading %s: %w", f.filename, f.ctx.Err())
 }
 
 func (f *FileStream) Read() (*Frame, error) {
+	if f.ctx.Err() != nil {
+		return nil, f.cancelled()
+	}
+	if f.native != nil {
+		return f.native.Read()
+	}
+
 	block, err := f.audio.ReadSamples(f.blockSize)
 	if err != nil {
+		// the pipe ends early when ffmpeg is killed
+		if f.ctx.Err() != nil {
+			return nil, f.cancelled()
+		}
+		// only the end of the file if ffmpeg got there without failing
+		if (err == io.EOF || err == io.ErrUnexpectedEOF) && !f.waited {
+			if werr := f.wait(); werr != nil {
+				return nil, werr
+			}
+		}
 		return nil, err
 	}
 
@@ -53,31 +109,100 @@ func (f *FileStream) Start() (err error) {
 }
 
 
-func NewFileStream(filename string, sampleRate, blockSize int) (*FileStream, error) {
-	cmd, err := ffmpeg.Cmd(filename, ffmpeg.CONTAINER_WAV, ffmpeg.FMT_INT16, sampleRate)
-	if (err != nil) {
+// Open the file without ffmpeg if it is WAV or raw PCM, returning nil if it needs ffmpeg to decode it
+func openNative(filename string, sampleRate, blockSize int) (*WavStream, error) {
+	rawFormat := ""
+	switch strings.ToLower(filepath.Ext(filename)) {
+	case ".raw", ".pcm", ".s16le":
+		rawFormat = RAW_S16LE
+	case ".f32le":
+		rawFormat = RAW_F32LE
+	}
+
+	in, err := os.Open(filename)
+	if err != nil {
+		return nil, err
+	}
+
+	if rawFormat != "" {
+		return NewRawStream(in, rawFormat, sampleRate, 1, sampleRate, blockSize)
+	}
+
+	stream, err := NewWavStream(in, sampleRate, blockSize)
+	if err != nil {
+		in.Close()
+		if errors.Is(err, ErrUnsupportedWav) {
+			// a WAV that ffmpeg may be able to decode for us
+			return nil, nil
+		}
+		if strings.ToLower(filepath.Ext(filename)) == ".wav" {
+			return nil, fmt.Errorf("Opening %s: %s", filename, err)
+		}
+		// not a WAV file, leave it to ffmpeg
+		return nil, nil
+	}
+
+	return stream, nil
+}
+
+// Stream the default audio stream of a file
+func NewFileStream(ctx context.Context, filename string, sampleRate, blockSize int) (*FileStream, error) {
+	return NewTrackStream(ctx, filename, ffmpeg.DEFAULT_STREAM, sampleRate, blockSize)
+}
+
+// Stream the chosen audio stream of a file
+func NewTrackStream(ctx context.Context, filename string, track ffmpeg.Select, sampleRate, blockSize int) (*FileStream, error) {
+	native, err := openNative(filename, sampleRate, blockSize)
+	if err != nil {
 		return nil, err
 	}
+	if native != nil {
+		// WAV and raw files only have the one stream, with no language
+		if !track.Default() && !(track.Index == 0 && track.Language == "") {
+			native.Close()
+			return nil, fmt.Errorf("Opening %s: No %s audio stream, it only has one", filename, track)
+		}
+		return &FileStream{ctx: ctx, filename: filename, native: native, blockSize: blockSize, sampleRate: sampleRate}, nil
+	}
 
-	in, err := ffmpeg.StartStream(cmd)
+	cmd, err := ffmpeg.Cmd(ctx, filename, track, ffmpeg.CONTAINER_WAV, ffmpeg.FMT_INT16, sampleRate)
 	if (err != nil) {
 		return nil, err
 	}
 
+	in, stderr, err := ffmpeg.StartStream(cmd)
+	if (err != nil) {
+		return nil, fmt.Errorf("Starting ffmpeg for %s: %s", filename, err)
+	}
+
 	audio, err := wav.New(in)
 	if err != nil {
-		return nil, fmt.Errorf("Opening Wav file: %s", err)
+		in.Close()
+		cmd.Wait()
+		if ctx.Err() != nil {
+			return nil, fmt.Errorf("Opening %s: %w", filename, ctx.Err())
+		}
+		// ffmpeg's complaint says more than the missing WAV header does
+		if msg := stderr.String(); msg != "" {
+			return nil, fmt.Errorf("Decoding %s: %s", filename, msg)
+		}
+		return nil, fmt.Errorf("Decoding %s: No audio from ffmpeg (%s)", filename, err)
 	}
 	if audio.SampleRate != uint32(sampleRate) {
+		in.Close()
+		cmd.Wait()
 		return nil, fmt.Errorf("Wav file has different sample rate (%d) to requested rate (%d)", audio.SampleRate, sampleRate)
 	}
 
 
 	stream := FileStream{
+		ctx:        ctx,
+		filename:   filename,
 		blockSize:  blockSize,
 		sampleRate: sampleRate,
 		audio:      audio,
 		cmd:        cmd,
+		stderr:     stderr,
 		in:         in,
 		empty:	    true,
 		blockId:    0,
@@ -23,6 +23,15 @@ func NewFrame(data []int16, blockId, sampleRate int) Frame {
 	}
 }
 
+// Frame starting at a known time, for streams whose blocks are not all the same size
+func NewFrameAt(data []int16, blockId int, timestamp float64) Frame {
+	return Frame {
+		data: data,
+		blockId: blockId,
+		timestamp: timestamp,
+	}
+}
+
 func (f Frame) AsFloat64() (f64 []float64) {
 	f64 = make([]float64, len(f.data))
 	for i, x := range f.data {
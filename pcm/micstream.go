@@ -1,24 +1,48 @@
 package pcm
 
-import "github.com/gordonklaus/portaudio"
+import (
+	"context"
+	"fmt"
+	"github.com/gordonklaus/portaudio"
+	"sync"
+)
 
+// Cancelling the context aborts the portaudio stream so a blocked Read returns straight away with the context's error
 type MicStream struct {
+	ctx        context.Context
 	blockSize  int
 	sampleRate int
 	mic	   *portaudio.Stream
 	buf	   []int16
 	blockId	   int
 	empty	   bool
+	closed     chan struct{} // stops the cancellation watcher
+	watching   sync.WaitGroup
+	closeOnce  sync.Once
+	closeErr   error
 }
 
+// Close the stream, which is safe to do more than once
 func (m *MicStream) Close() (err error) {
-	m.mic.Close()
-	return portaudio.Terminate()
+	m.closeOnce.Do(func() {
+		// the watcher mustn't abort the stream once it is closed
+		close(m.closed)
+		m.watching.Wait()
+		m.mic.Close()
+		m.closeErr = portaudio.Terminate()
+	})
+	return m.closeErr
 }
 
 func (m *MicStream) Read() (*Frame, error) {
+	if m.ctx.Err() != nil {
+		return nil, m.cancelled()
+	}
 	err := m.mic.Read()
 	if err != nil {
+		if m.ctx.Err() != nil {
+			return nil, m.cancelled()
+		}
 		return nil, err
 	}
 
@@ -33,28 +57,81 @@ func (m *MicStream) Read() (*Frame, error) {
 	return &frame, nil
 }
 
+func (m *MicStream) cancelled() error {
+	return fmt.Errorf("Reading microphone: %w", m.ctx.Err())
+}
+
 func (m *MicStream) Start() (err error) {
 	return m.mic.Start()
 }
 
-func NewMicStream(sampleRate, blockSize int) (*MicStream, error) {
-	portaudio.Initialize()
+func NewMicStream(ctx context.Context, sampleRate, blockSize int) (*MicStream, error) {
+	if err := portaudio.Initialize(); err != nil {
+		return nil, fmt.Errorf("Initialising portaudio: %s", err)
+	}
 
 	buf := make([]int16, blockSize)
 
 	mic, err := portaudio.OpenDefaultStream(1, 0, float64(sampleRate), blockSize, buf)
 
 	if err != nil {
+		portaudio.Terminate()
 		return nil, err
 	}
 
-	stream := MicStream{
+	stream := &MicStream{
+		ctx:        ctx,
 		buf:        buf,
 		blockSize:  blockSize,
 		sampleRate: sampleRate,
 		mic:        mic,
+		closed:     make(chan struct{}),
+	}
+
+	stream.watching.Add(1)
+	go func() {
+		defer stream.watching.Done()
+		select {
+		case <-ctx.Done():
+			mic.Abort()
+		case <-stream.closed:
+		}
+	}()
+
+	return stream, nil
+}
+
+// Open the microphone at the given rate or, if it won't record at that rate, at the rate it prefers with the audio
+// resampled to the given rate
+func NewMicReader(ctx context.Context, sampleRate, blockSize int) (StartReader, error) {
+	stream, err := NewMicStream(ctx, sampleRate, blockSize)
+	if err == nil {
+		return stream, nil
 	}
 
-	return &stream, nil
+	rate, rateErr := micRate()
+	if rateErr != nil || rate == sampleRate {
+		return nil, err
+	}
+	// blocks covering about the same time at the mic's rate
+	stream, micErr := NewMicStream(ctx, rate, blockSize*rate/sampleRate)
+	if micErr != nil {
+		return nil, fmt.Errorf("Opening microphone at %dHz: %s, and at its own rate of %dHz: %s", sampleRate, err, rate, micErr)
+	}
+
+	return NewResampler(stream, rate, sampleRate, blockSize), nil
 }
 
+// The sample rate the default input device records at by default
+func micRate() (int, error) {
+	if err := portaudio.Initialize(); err != nil {
+		return 0, err
+	}
+	defer portaudio.Terminate()
+
+	dev, err := portaudio.DefaultInputDevice()
+	if err != nil {
+		return 0, err
+	}
+	return int(dev.DefaultSampleRate), nil
+}
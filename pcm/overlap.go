@@ -0,0 +1,131 @@
+package pcm
+
+import (
+	"fmt"
+	"io"
+)
+
+/*
+ * overlap:
+ * Turn the blocks from any Reader into overlapping analysis windows.
+ * The underlying streams hand out disjoint blocks so anything straddling a block edge is split between two
+ * analyses, and the mic blocks never line up with the blocks of the reference file.  An OverlapReader keeps the last
+ * window of samples in a ring buffer and yields a new frame every hop samples, so the windows slide across block
+ * boundaries.  Frame timestamps are taken from the sample count rather than the block size so they stay accurate
+ * with any window, hop or input block size.
+ */
+
+type OverlapReader struct {
+	in         Reader
+	window     int
+	hop        int
+	sampleRate int
+
+	ring  []int16 // the latest samples, the oldest at head
+	head  int
+	count int     // samples in the ring
+	input []int16 // unused samples from the last input frame
+
+	start   float64 // timestamp of the first input frame
+	started bool
+	pos     int // sample number of the oldest sample in the ring
+	fresh   int // samples in the ring that have not been in a frame yet
+	eof     bool
+	blockId int
+}
+
+// Read windows of the given size from in, starting a new window every hop samples
+func NewOverlapReader(in Reader, window, hop, sampleRate int) (*OverlapReader, error) {
+	if window < 1 || hop < 1 || hop > window {
+		return nil, fmt.Errorf("Bad overlap: window %d, hop %d", window, hop)
+	}
+
+	return &OverlapReader{
+		in:         in,
+		window:     window,
+		hop:        hop,
+		sampleRate: sampleRate,
+		ring:       make([]int16, window),
+	}, nil
+}
+
+// Fill the ring up to a full window, returning false when the input has run out
+func (o *OverlapReader) fill() (bool, error) {
+	for o.count < o.window {
+		if len(o.input) == 0 {
+			if o.eof {
+				return false, nil
+			}
+			frame, err := o.in.Read()
+			if err == io.EOF || err == io.ErrUnexpectedEOF {
+				o.eof = true
+				return false, nil
+			}
+			if err != nil {
+				return false, err
+			}
+			if !o.started {
+				o.start = frame.Timestamp()
+				o.started = true
+			}
+			// the underlying stream may reuse its buffer (the mic does) so everything is copied into the ring
+			o.input = frame.Data()
+		}
+
+		tail := (o.head + o.count) % o.window
+		n := o.window - o.count
+		if n > len(o.input) {
+			n = len(o.input)
+		}
+		if n > o.window-tail {
+			n = o.window - tail
+		}
+		copy(o.ring[tail:tail+n], o.input[:n])
+		o.input = o.input[n:]
+		o.count += n
+		o.fresh += n
+	}
+
+	return true, nil
+}
+
+func (o *OverlapReader) Read() (*Frame, error) {
+	full, err := o.fill()
+	if err != nil {
+		return nil, err
+	}
+	if !full && o.fresh == 0 {
+		return nil, io.EOF
+	}
+
+	// the last frame is short, holding whatever is left
+	data := make([]int16, o.count)
+	end := o.head + o.count
+	if end > o.window {
+		end = o.window
+	}
+	n := copy(data, o.ring[o.head:end])
+	copy(data[n:], o.ring[:o.count-n])
+
+	frame := NewFrameAt(data, o.blockId, o.start+float64(o.pos)/float64(o.sampleRate))
+	o.blockId++
+	o.fresh = 0
+
+	// slide along to the next window
+	hop := o.hop
+	if hop > o.count {
+		hop = o.count
+	}
+	o.head = (o.head + hop) % o.window
+	o.count -= hop
+	o.pos += hop
+
+	return &frame, nil
+}
+
+func (o *OverlapReader) Start() error {
+	if s, ok := o.in.(StartReader); ok {
+		return s.Start()
+	}
+	return nil
+}
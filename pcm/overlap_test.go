@@ -0,0 +1,122 @@
+package pcm_test
+
+import (
+	"github.com/snuffpuppet/spectre/pcm"
+	"io"
+	"math"
+	"testing"
+)
+
+// Reader that hands out the same buffer each time, like the mic stream
+type reusingReader struct {
+	buf     []int16
+	next    int
+	end     int
+	blockId int
+}
+
+func (r *reusingReader) Read() (*pcm.Frame, error) {
+	if r.next >= r.end {
+		return nil, io.EOF
+	}
+	for i := range r.buf {
+		r.buf[i] = int16(r.next + i)
+	}
+	frame := pcm.NewFrame(r.buf, r.blockId, 1000)
+	r.next += len(r.buf)
+	r.blockId++
+
+	return &frame, nil
+}
+
+func counting(n int) []int16 {
+	x := make([]int16, n)
+	for i := range x {
+		x[i] = int16(i)
+	}
+	return x
+}
+
+func checkWindows(t *testing.T, name string, frames []*pcm.Frame, total, window, hop, rate int, start float64) {
+	for i, f := range frames {
+		first := i * hop
+		want := window
+		if first+want > total {
+			want = total - first
+		}
+		if f.BlockId() != i || len(f.Data()) != want {
+			t.Fatalf("%s: frame %d is block %d with %d samples, expected %d", name, i, f.BlockId(), len(f.Data()), want)
+		}
+		for j, s := range f.Data() {
+			if int(s) != first+j {
+				t.Fatalf("%s: frame %d sample %d is %d, expected %d", name, i, j, s, first+j)
+			}
+		}
+		ts := start + float64(first)/float64(rate)
+		if math.Abs(f.Timestamp()-ts) > 1e-9 {
+			t.Errorf("%s: frame %d at %f, expected %f", name, i, f.Timestamp(), ts)
+		}
+	}
+
+	// every sample is in a frame and the last frame ends with the last sample
+	last := frames[len(frames)-1]
+	if end := (len(frames)-1)*hop + len(last.Data()); end != total {
+		t.Errorf("%s: frames end at sample %d of %d", name, end, total)
+	}
+}
+
+func TestOverlap(t *testing.T) {
+	tests := []struct {
+		name        string
+		total       int
+		sizes       []int
+		window, hop int
+	}{
+		{"hop", 10000, []int{2048}, 2048, 256},
+		{"odd blocks", 10000, []int{1, 999, 3000, 17}, 2048, 256},
+		{"uneven hop", 10007, []int{2048}, 1000, 300},
+		{"no overlap", 8192, []int{2048}, 2048, 2048},
+		{"short", 100, []int{2048}, 2048, 256},
+	}
+
+	for _, test := range tests {
+		src := &sliceReader{samples: counting(test.total), sizes: test.sizes, rate: 1000}
+		r, err := pcm.NewOverlapReader(src, test.window, test.hop, 1000)
+		if err != nil {
+			t.Fatalf("%s: %s", test.name, err)
+		}
+		_, frames := readAll(t, r)
+		checkWindows(t, test.name, frames, test.total, test.window, test.hop, 1000, 0)
+	}
+}
+
+func TestOverlapReusedBuffer(t *testing.T) {
+	src := &reusingReader{buf: make([]int16, 512), end: 4096}
+	r, err := pcm.NewOverlapReader(src, 1024, 128, 1000)
+	if err != nil {
+		t.Fatal(err)
+	}
+	_, frames := readAll(t, r)
+	checkWindows(t, "reused", frames, 4096, 1024, 128, 1000, 0)
+}
+
+func TestOverlapStartTime(t *testing.T) {
+	src := &sliceReader{samples: counting(5000), sizes: []int{700}, rate: 1000}
+	src.pos = 1000
+	r, err := pcm.NewOverlapReader(src, 1000, 250, 1000)
+	if err != nil {
+		t.Fatal(err)
+	}
+	_, frames := readAll(t, r)
+	if len(frames) == 0 || frames[0].Timestamp() != 1 || frames[1].Timestamp() != 1.25 {
+		t.Errorf("Windows of a stream starting at 1s do not start at 1s")
+	}
+}
+
+func TestOverlapBadHop(t *testing.T) {
+	for _, hop := range []int{0, -1, 2049} {
+		if _, err := pcm.NewOverlapReader(&sliceReader{}, 2048, hop, 1000); err == nil {
+			t.Errorf("Hop of %d accepted", hop)
+		}
+	}
+}
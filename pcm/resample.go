@@ -0,0 +1,227 @@
+package pcm
+
+import (
+	"io"
+	"math"
+)
+
+/*
+ * resample:
+ * Band limited sample rate conversion using windowed sinc interpolation.
+ * ref: https://ccrma.stanford.edu/~jos/resample/
+ * The interpolating filter is a Kaiser windowed sinc, cut off just below the lower of the two Nyquist frequencies
+ * so that anything that would alias in the output is removed.  It is stored as a finely sampled table and
+ * interpolated between entries, allowing any ratio of rates.  The filter state carries over between calls so the
+ * output is the same no matter how the input is split into blocks.
+ */
+
+const RESAMPLE_ZERO_CROSSINGS = 16    // half width of the filter in zero crossings of the sinc
+const RESAMPLE_ROLLOFF = 0.9          // filter cut off as a fraction of the output Nyquist frequency
+const RESAMPLE_KAISER_BETA = 9.0      // Kaiser window shape, higher gives more stopband rejection
+const RESAMPLE_TABLE_RESOLUTION = 512 // filter table entries per input sample
+
+// Streaming windowed sinc interpolator over float64 samples
+type sincResampler struct {
+	step      float64   // input samples per output sample
+	cutoff    float64   // filter cut off relative to the input Nyquist frequency
+	halfWidth float64   // half width of the filter in input samples
+	table     []float64 // filter response from 0 to halfWidth, RESAMPLE_TABLE_RESOLUTION entries per sample
+
+	buf     []float64 // input samples still needed by the filter, preceded by zeros at the start
+	pos     float64   // position in buf of the next output sample
+	nIn     int       // input samples received
+	nOut    int       // output samples produced
+	padding int       // zeros in front of the first input sample
+}
+
+func newSincResampler(inRate, outRate int) *sincResampler {
+	r := &sincResampler{step: float64(inRate) / float64(outRate)}
+	r.cutoff = RESAMPLE_ROLLOFF * math.Min(1, float64(outRate)/float64(inRate))
+	r.halfWidth = RESAMPLE_ZERO_CROSSINGS / r.cutoff
+
+	n := int(math.Ceil(r.halfWidth*RESAMPLE_TABLE_RESOLUTION)) + 2
+	r.table = make([]float64, n)
+	i0 := besselI0(RESAMPLE_KAISER_BETA)
+	for i := range r.table {
+		t := float64(i) / RESAMPLE_TABLE_RESOLUTION
+		if t >= r.halfWidth {
+			break
+		}
+		x := t / r.halfWidth
+		w := besselI0(RESAMPLE_KAISER_BETA*math.Sqrt(1-x*x)) / i0
+		r.table[i] = r.cutoff * sinc(r.cutoff*t) * w
+	}
+
+	r.padding = int(math.Ceil(r.halfWidth))
+	r.buf = make([]float64, r.padding)
+	r.pos = float64(r.padding)
+
+	return r
+}
+
+// filter response at t input samples from the centre
+func (r *sincResampler) response(t float64) float64 {
+	t = math.Abs(t) * RESAMPLE_TABLE_RESOLUTION
+	i := int(t)
+	if i+1 >= len(r.table) {
+		return 0
+	}
+	frac := t - float64(i)
+
+	return r.table[i]*(1-frac) + r.table[i+1]*frac
+}
+
+// Number of output samples the input seen so far gives in total
+func (r *sincResampler) outputLength() int {
+	return int(math.Ceil(float64(r.nIn) / r.step))
+}
+
+// Add input samples and return all the output samples that can now be calculated
+func (r *sincResampler) process(in []float64) []float64 {
+	if r.step == 1 {
+		return in
+	}
+	r.buf = append(r.buf, in...)
+	r.nIn += len(in)
+
+	return r.generate(float64(len(r.buf)) - r.halfWidth)
+}
+
+// The input has finished, return the remaining output samples
+func (r *sincResampler) flush() []float64 {
+	if r.step == 1 {
+		return nil
+	}
+	r.buf = append(r.buf, make([]float64, r.padding+1)...)
+
+	return r.generate(float64(len(r.buf)) - r.halfWidth)
+}
+
+// calculate output samples for all positions before limit
+func (r *sincResampler) generate(limit float64) (out []float64) {
+	for r.pos < limit && r.nOut < r.outputLength() {
+		centre := int(math.Floor(r.pos))
+		lo := centre - int(r.halfWidth)
+		if lo < 0 {
+			lo = 0
+		}
+		hi := centre + int(r.halfWidth) + 1
+		if hi >= len(r.buf) {
+			hi = len(r.buf) - 1
+		}
+
+		sum := 0.0
+		for i := lo; i <= hi; i++ {
+			sum += r.buf[i] * r.response(r.pos-float64(i))
+		}
+		out = append(out, sum)
+
+		r.nOut++
+		r.pos += r.step
+	}
+
+	// drop the samples that are now out of reach of the filter
+	drop := int(math.Floor(r.pos-r.halfWidth)) - 1
+	if drop > 0 {
+		r.buf = append(r.buf[:0], r.buf[drop:]...)
+		r.pos -= float64(drop)
+	}
+
+	return out
+}
+
+func sinc(x float64) float64 {
+	if x == 0 {
+		return 1
+	}
+	return math.Sin(math.Pi*x) / (math.Pi * x)
+}
+
+// Zeroth order modified Bessel function of the first kind (for the Kaiser window)
+func besselI0(x float64) float64 {
+	sum, term := 1.0, 1.0
+	for k := 1; k < 50; k++ {
+		term *= (x / 2) / float64(k)
+		sum += term * term
+		if term*term < sum*1e-16 {
+			break
+		}
+	}
+
+	return sum
+}
+
+// Resampler converts the frames from any Reader to a different sample rate
+type Resampler struct {
+	in        Reader
+	filter    *sincResampler
+	outRate   int
+	blockSize int
+	pending   []float64
+	start     float64 // timestamp of the first input frame
+	started   bool
+	eof       bool
+	blockId   int
+	produced  int // output samples handed out in frames
+}
+
+func NewResampler(in Reader, inRate, outRate, blockSize int) *Resampler {
+	return &Resampler{
+		in:        in,
+		filter:    newSincResampler(inRate, outRate),
+		outRate:   outRate,
+		blockSize: blockSize,
+	}
+}
+
+func (r *Resampler) Read() (*Frame, error) {
+	for len(r.pending) < r.blockSize && !r.eof {
+		frame, err := r.in.Read()
+		if err == io.EOF || err == io.ErrUnexpectedEOF {
+			r.eof = true
+			r.pending = append(r.pending, r.filter.flush()...)
+			break
+		}
+		if err != nil {
+			return nil, err
+		}
+		if !r.started {
+			r.start = frame.Timestamp()
+			r.started = true
+		}
+
+		data := frame.Data()
+		samples := make([]float64, len(data))
+		for i, x := range data {
+			samples[i] = float64(x) / 32768
+		}
+		r.pending = append(r.pending, r.filter.process(samples)...)
+	}
+
+	if len(r.pending) == 0 {
+		return nil, io.EOF
+	}
+
+	n := r.blockSize
+	if n > len(r.pending) {
+		n = len(r.pending)
+	}
+	block := make([]int16, n)
+	for i := range block {
+		block[i] = toInt16(r.pending[i])
+	}
+	r.pending = append(r.pending[:0], r.pending[n:]...)
+
+	frame := NewFrameAt(block, r.blockId, r.start+float64(r.produced)/float64(r.outRate))
+	r.blockId++
+	r.produced += n
+
+	return &frame, nil
+}
+
+func (r *Resampler) Start() error {
+	if s, ok := r.in.(StartReader); ok {
+		return s.Start()
+	}
+	return nil
+}
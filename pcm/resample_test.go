@@ -0,0 +1,140 @@
+package pcm_test
+
+import (
+	"github.com/snuffpuppet/spectre/pcm"
+	"io"
+	"math"
+	"testing"
+)
+
+// Reader over samples in memory, cut into frames of the given sizes in turn
+type sliceReader struct {
+	samples []int16
+	sizes   []int
+	rate    int
+	pos     int
+	blockId int
+}
+
+func (s *sliceReader) Read() (*pcm.Frame, error) {
+	if s.pos >= len(s.samples) {
+		return nil, io.EOF
+	}
+	n := s.sizes[s.blockId%len(s.sizes)]
+	if s.pos+n > len(s.samples) {
+		n = len(s.samples) - s.pos
+	}
+	frame := pcm.NewFrameAt(s.samples[s.pos:s.pos+n], s.blockId, float64(s.pos)/float64(s.rate))
+	s.pos += n
+	s.blockId++
+
+	return &frame, nil
+}
+
+// Linear sine sweep between two frequencies, faded in and out so the ends do not click
+func sweep(rate int, seconds, from, to, amplitude float64) []int16 {
+	n := int(seconds * float64(rate))
+	fade := rate / 20
+	out := make([]int16, n)
+	for i := range out {
+		t := float64(i) / float64(rate)
+		phase := 2 * math.Pi * (from*t + (to-from)*t*t/(2*seconds))
+		gain := amplitude
+		if edge := math.Min(float64(i), float64(n-1-i)); edge < float64(fade) {
+			gain *= 0.5 - 0.5*math.Cos(math.Pi*edge/float64(fade))
+		}
+		out[i] = int16(gain * 32767 * math.Sin(phase))
+	}
+
+	return out
+}
+
+func rms(samples []int16) float64 {
+	sum := 0.0
+	for _, s := range samples {
+		sum += float64(s) * float64(s)
+	}
+	return math.Sqrt(sum / float64(len(samples)))
+}
+
+func resample(t *testing.T, samples []int16, sizes []int, inRate, outRate int) []int16 {
+	r := pcm.NewResampler(&sliceReader{samples: samples, sizes: sizes, rate: inRate}, inRate, outRate, 1024)
+	out, _ := readAll(t, r)
+	return out
+}
+
+func TestResampleAliasing(t *testing.T) {
+	tests := []struct {
+		inRate, outRate int
+		from, to        float64
+	}{
+		{44100, 11025, 6000, 22000},
+		{48000, 11025, 6000, 24000},
+		{22050, 11025, 6000, 11000},
+	}
+
+	for _, test := range tests {
+		in := sweep(test.inRate, 2, test.from, test.to, 0.5)
+		out := resample(t, in, []int{4096}, test.inRate, test.outRate)
+
+		// everything is above the output Nyquist frequency so should be removed rather than folded back
+		db := 20 * math.Log10(rms(out)/rms(in))
+		if db > -80 {
+			t.Errorf("%d -> %d: sweep %.0f-%.0fHz aliased at %.1fdB", test.inRate, test.outRate, test.from, test.to, db)
+		}
+	}
+}
+
+func TestResamplePassband(t *testing.T) {
+	tests := []struct {
+		inRate, outRate int
+	}{
+		{44100, 11025},
+		{48000, 11025},
+		{8000, 11025},
+	}
+
+	for _, test := range tests {
+		in := sweep(test.inRate, 2, 50, 3500, 0.5)
+		out := resample(t, in, []int{4096}, test.inRate, test.outRate)
+
+		want := int(math.Ceil(float64(len(in)) * float64(test.outRate) / float64(test.inRate)))
+		if len(out) != want {
+			t.Errorf("%d -> %d: gave %d samples, expected %d", test.inRate, test.outRate, len(out), want)
+		}
+
+		db := 20 * math.Log10(rms(out)/rms(in))
+		if math.Abs(db) > 0.1 {
+			t.Errorf("%d -> %d: passband sweep changed level by %.2fdB", test.inRate, test.outRate, db)
+		}
+	}
+}
+
+func TestResampleBlocks(t *testing.T) {
+	in := sweep(44100, 1, 100, 8000, 0.5)
+	whole := resample(t, in, []int{len(in)}, 44100, 11025)
+	pieces := resample(t, in, []int{1, 7, 333, 4096, 50}, 44100, 11025)
+
+	if len(whole) != len(pieces) {
+		t.Fatalf("Block sizes changed the output length: %d and %d", len(whole), len(pieces))
+	}
+	for i := range whole {
+		if whole[i] != pieces[i] {
+			t.Fatalf("Block sizes changed sample %d: %d and %d", i, whole[i], pieces[i])
+		}
+	}
+}
+
+func TestResampleTimestamps(t *testing.T) {
+	src := &sliceReader{samples: sweep(44100, 1, 100, 1000, 0.5), sizes: []int{1000}, rate: 44100}
+	src.pos = 44100 / 2 // start half way through, as if the stream had been seeked
+	r := pcm.NewResampler(src, 44100, 11025, 1024)
+	_, frames := readAll(t, r)
+
+	for i, f := range frames {
+		want := 0.5 + float64(i*1024)/11025
+		if f.BlockId() != i || math.Abs(f.Timestamp()-want) > 1e-9 {
+			t.Errorf("Frame %d (block %d) at %f, expected %f", i, f.BlockId(), f.Timestamp(), want)
+		}
+	}
+}
@@ -0,0 +1,332 @@
+package pcm
+
+import (
+	"bufio"
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"io"
+	"math"
+)
+
+/*
+ * wavstream:
+ * Decode WAV files and raw PCM without ffmpeg so that uncompressed audio (and tests) do not need it installed.
+ * WAV files can be 8/16/24/32 bit integer or 32/64 bit float with any number of channels, raw PCM is s16le or
+ * f32le.  The audio is mixed down to mono and resampled to the requested rate before being cut into frames.
+ */
+
+const (
+	RAW_S16LE = "s16le"
+	RAW_F32LE = "f32le"
+)
+
+const (
+	wavFormatPCM        = 1
+	wavFormatFloat      = 3
+	wavFormatExtensible = 0xfffe
+)
+
+const (
+	wavFmtSize    = 40  // the largest fmt chunk (WAVE_FORMAT_EXTENSIBLE), anything more is ignored
+	wavFmtMaxSize = 512 // fmt chunks claiming to be bigger than this are corrupt
+)
+
+const (
+	wavMaxChannels   = 32     // more channels than this is a corrupt header, not a real file
+	wavMaxSampleRate = 768000 // as is a faster sample rate
+)
+
+// Returned when a WAV file uses an encoding we cannot decode natively (ffmpeg can still handle it)
+var ErrUnsupportedWav = errors.New("Unsupported WAV encoding")
+
+type sampleFormat struct {
+	sampleRate int
+	channels   int
+	bits       int
+	float      bool
+}
+
+func (s sampleFormat) String() string {
+	kind := "int"
+	if s.float {
+		kind = "float"
+	}
+	return fmt.Sprintf("%d bit %s, %d channels at %dHz", s.bits, kind, s.channels, s.sampleRate)
+}
+
+// Decode a single sample at the start of b to the range [-1, 1)
+func (s sampleFormat) decode(b []byte) float64 {
+	switch {
+	case s.float && s.bits == 32:
+		return float64(math.Float32frombits(binary.LittleEndian.Uint32(b)))
+	case s.float && s.bits == 64:
+		return math.Float64frombits(binary.LittleEndian.Uint64(b))
+	case s.bits == 8:
+		return float64(int(b[0])-128) / 128
+	case s.bits == 16:
+		return float64(int16(binary.LittleEndian.Uint16(b))) / 32768
+	case s.bits == 24:
+		v := int32(uint32(b[0])<<8|uint32(b[1])<<16|uint32(b[2])<<24) >> 8
+		return float64(v) / 8388608
+	case s.bits == 32:
+		return float64(int32(binary.LittleEndian.Uint32(b))) / 2147483648
+	}
+
+	return 0
+}
+
+type WavStream struct {
+	in         io.ReadCloser
+	r          *bufio.Reader
+	format     sampleFormat
+	remaining  int64 // bytes left in the data chunk, -1 if unknown (read to EOF)
+	blockSize  int
+	sampleRate int
+	resampler  *sincResampler
+	pending    []float64 // mono samples at sampleRate waiting to fill a block
+	eof        bool
+	blockId    int
+	produced   int // samples handed out in frames
+}
+
+// Open a stream over WAV data, the stream takes ownership of in
+func NewWavStream(in io.ReadCloser, sampleRate, blockSize int) (*WavStream, error) {
+	r := bufio.NewReader(in)
+
+	format, size, err := readWavHeader(r)
+	if err != nil {
+		return nil, err
+	}
+
+	return newWavStream(in, r, format, size, sampleRate, blockSize), nil
+}
+
+// Open a stream over raw PCM data of the given format (RAW_S16LE or RAW_F32LE), the stream takes ownership of in
+func NewRawStream(in io.ReadCloser, rawFormat string, rawRate, channels, sampleRate, blockSize int) (*WavStream, error) {
+	format := sampleFormat{sampleRate: rawRate, channels: channels}
+	switch rawFormat {
+	case RAW_S16LE:
+		format.bits = 16
+	case RAW_F32LE:
+		format.bits = 32
+		format.float = true
+	default:
+		return nil, fmt.Errorf("Unrecognised raw PCM format: %s", rawFormat)
+	}
+	if channels < 1 || rawRate < 1 {
+		return nil, fmt.Errorf("Bad raw PCM layout: %d channels at %dHz", channels, rawRate)
+	}
+
+	return newWavStream(in, bufio.NewReader(in), format, -1, sampleRate, blockSize), nil
+}
+
+func newWavStream(in io.ReadCloser, r *bufio.Reader, format sampleFormat, size int64, sampleRate, blockSize int) *WavStream {
+	return &WavStream{
+		in:         in,
+		r:          r,
+		format:     format,
+		remaining:  size,
+		blockSize:  blockSize,
+		sampleRate: sampleRate,
+		resampler:  newSincResampler(format.sampleRate, sampleRate),
+		pending:    make([]float64, 0, blockSize),
+	}
+}
+
+// Check for a RIFF/WAVE header, returning the format and size of the data chunk
+func readWavHeader(r *bufio.Reader) (format sampleFormat, size int64, err error) {
+	var riff [12]byte
+	if _, err = io.ReadFull(r, riff[:]); err != nil {
+		return format, 0, fmt.Errorf("Reading WAV header: %s", err)
+	}
+	if string(riff[0:4]) != "RIFF" || string(riff[8:12]) != "WAVE" {
+		return format, 0, fmt.Errorf("Not a WAV file")
+	}
+
+	haveFormat := false
+	for {
+		var hdr [8]byte
+		if _, err = io.ReadFull(r, hdr[:]); err != nil {
+			return format, 0, fmt.Errorf("Reading WAV chunk: %s", err)
+		}
+		id := string(hdr[0:4])
+		chunkSize := int64(binary.LittleEndian.Uint32(hdr[4:8]))
+
+		switch id {
+		case "fmt ":
+			if chunkSize < 16 {
+				return format, 0, fmt.Errorf("Short WAV fmt chunk")
+			}
+			// the size comes from the file so don't trust it with an allocation
+			if chunkSize > wavFmtMaxSize {
+				return format, 0, fmt.Errorf("WAV fmt chunk is too big (%d bytes)", chunkSize)
+			}
+			keep := chunkSize
+			if keep > wavFmtSize {
+				keep = wavFmtSize
+			}
+			fmtChunk := make([]byte, keep)
+			if _, err = io.ReadFull(r, fmtChunk); err != nil {
+				return format, 0, fmt.Errorf("Reading WAV fmt chunk: %s", err)
+			}
+			if _, err = r.Discard(int(chunkSize - keep + chunkSize%2)); err != nil {
+				return format, 0, fmt.Errorf("Reading WAV fmt chunk: %s", err)
+			}
+			if format, err = parseFmtChunk(fmtChunk); err != nil {
+				return format, 0, err
+			}
+			haveFormat = true
+
+		case "data":
+			if !haveFormat {
+				return format, 0, fmt.Errorf("WAV data chunk before fmt chunk")
+			}
+			// streamed WAV (e.g. from a pipe) does not know its length up front
+			if chunkSize == 0 || chunkSize == 0xffffffff {
+				chunkSize = -1
+			}
+			return format, chunkSize, nil
+
+		default:
+			if _, err = r.Discard(int(chunkSize + chunkSize%2)); err != nil {
+				return format, 0, fmt.Errorf("Skipping WAV %s chunk: %s", id, err)
+			}
+		}
+	}
+}
+
+func parseFmtChunk(b []byte) (format sampleFormat, err error) {
+	code := binary.LittleEndian.Uint16(b[0:2])
+	format.channels = int(binary.LittleEndian.Uint16(b[2:4]))
+	format.sampleRate = int(binary.LittleEndian.Uint32(b[4:8]))
+	blockAlign := int(binary.LittleEndian.Uint16(b[12:14]))
+	format.bits = int(binary.LittleEndian.Uint16(b[14:16]))
+
+	if code == wavFormatExtensible {
+		if len(b) < 26 {
+			return format, fmt.Errorf("Short WAV extensible fmt chunk")
+		}
+		// the real format code is at the start of the sub format GUID
+		code = binary.LittleEndian.Uint16(b[24:26])
+	}
+
+	switch {
+	case code == wavFormatPCM && (format.bits == 8 || format.bits == 16 || format.bits == 24 || format.bits == 32):
+	case code == wavFormatFloat && (format.bits == 32 || format.bits == 64):
+		format.float = true
+	default:
+		return format, fmt.Errorf("%w: format %d, %d bits", ErrUnsupportedWav, code, format.bits)
+	}
+
+	if format.channels < 1 || format.sampleRate < 1 {
+		return format, fmt.Errorf("%w: %d channels at %dHz", ErrUnsupportedWav, format.channels, format.sampleRate)
+	}
+
+	// the sizes of the read buffers and resampler follow from these so a corrupt header mustn't get through
+	if format.channels > wavMaxChannels || format.sampleRate > wavMaxSampleRate {
+		return format, fmt.Errorf("Corrupt WAV fmt chunk: %d channels at %dHz", format.channels, format.sampleRate)
+	}
+	if blockAlign != format.channels*format.bits/8 {
+		return format, fmt.Errorf("Corrupt WAV fmt chunk: block align %d for %s", blockAlign, format)
+	}
+
+	return format, nil
+}
+
+// Read the next set of samples from the file, mixed down to mono
+func (w *WavStream) readMono(n int) ([]float64, error) {
+	frameBytes := w.format.channels * w.format.bits / 8
+	want := int64(n * frameBytes)
+	if w.remaining >= 0 && want > w.remaining {
+		want = w.remaining - w.remaining%int64(frameBytes)
+	}
+	if want == 0 {
+		return nil, io.EOF
+	}
+
+	buf := make([]byte, want)
+	got, err := io.ReadFull(w.r, buf)
+	if err == io.ErrUnexpectedEOF {
+		err = nil
+	}
+	got -= got % frameBytes
+	if got == 0 {
+		if err == nil {
+			err = io.EOF
+		}
+		return nil, err
+	}
+	if w.remaining >= 0 {
+		w.remaining -= int64(got)
+	}
+
+	bytesPerSample := w.format.bits / 8
+	mono := make([]float64, got/frameBytes)
+	for i := range mono {
+		sum := 0.0
+		for c := 0; c < w.format.channels; c++ {
+			sum += w.format.decode(buf[i*frameBytes+c*bytesPerSample:])
+		}
+		mono[i] = sum / float64(w.format.channels)
+	}
+
+	return mono, nil
+}
+
+func (w *WavStream) Read() (*Frame, error) {
+	for len(w.pending) < w.blockSize && !w.eof {
+		mono, err := w.readMono(w.blockSize)
+		if err == io.EOF {
+			w.eof = true
+			w.pending = append(w.pending, w.resampler.flush()...)
+			break
+		}
+		if err != nil {
+			return nil, err
+		}
+		w.pending = append(w.pending, w.resampler.process(mono)...)
+	}
+
+	if len(w.pending) == 0 {
+		return nil, io.EOF
+	}
+
+	// the last block is short, like the ffmpeg stream
+	n := w.blockSize
+	if n > len(w.pending) {
+		n = len(w.pending)
+	}
+	block := make([]int16, n)
+	for i := range block {
+		block[i] = toInt16(w.pending[i])
+	}
+	w.pending = append(w.pending[:0], w.pending[n:]...)
+
+	frame := NewFrameAt(block, w.blockId, float64(w.produced)/float64(w.sampleRate))
+	w.blockId++
+	w.produced += n
+
+	return &frame, nil
+}
+
+func (w *WavStream) Start() error {
+	return nil
+}
+
+func (w *WavStream) Close() error {
+	return w.in.Close()
+}
+
+// Scale a sample in the range [-1, 1) to a 16 bit integer
+func toInt16(x float64) int16 {
+	v := math.Floor(x*32768 + 0.5)
+	if v > math.MaxInt16 {
+		return math.MaxInt16
+	}
+	if v < math.MinInt16 {
+		return math.MinInt16
+	}
+
+	return int16(v)
+}
@@ -0,0 +1,250 @@
+package pcm_test
+
+import (
+	"bytes"
+	"context"
+	"encoding/binary"
+	"github.com/snuffpuppet/spectre/pcm"
+	"io"
+	"math"
+	"os"
+	"path/filepath"
+	"testing"
+)
+
+// Build a WAV file in memory from per channel samples in the range [-1, 1)
+func makeWav(format uint16, bits, rate int, channels [][]float64) []byte {
+	var data bytes.Buffer
+	for i := range channels[0] {
+		for _, ch := range channels {
+			x := ch[i]
+			switch {
+			case format == 3 && bits == 32:
+				binary.Write(&data, binary.LittleEndian, float32(x))
+			case bits == 8:
+				data.WriteByte(byte(int(x*128) + 128))
+			case bits == 16:
+				binary.Write(&data, binary.LittleEndian, int16(x*32768))
+			case bits == 24:
+				v := int32(x * 8388608)
+				data.Write([]byte{byte(v), byte(v >> 8), byte(v >> 16)})
+			case bits == 32:
+				binary.Write(&data, binary.LittleEndian, int32(x*2147483648))
+			}
+		}
+	}
+
+	var b bytes.Buffer
+	nch := len(channels)
+	b.WriteString("RIFF")
+	binary.Write(&b, binary.LittleEndian, uint32(4+8+16+8+data.Len()+8+4))
+	b.WriteString("WAVE")
+	// an unknown chunk that should be skipped
+	b.WriteString("LIST")
+	binary.Write(&b, binary.LittleEndian, uint32(4))
+	b.WriteString("junk")
+	b.WriteString("fmt ")
+	binary.Write(&b, binary.LittleEndian, uint32(16))
+	binary.Write(&b, binary.LittleEndian, format)
+	binary.Write(&b, binary.LittleEndian, uint16(nch))
+	binary.Write(&b, binary.LittleEndian, uint32(rate))
+	binary.Write(&b, binary.LittleEndian, uint32(rate*nch*bits/8))
+	binary.Write(&b, binary.LittleEndian, uint16(nch*bits/8))
+	binary.Write(&b, binary.LittleEndian, uint16(bits))
+	b.WriteString("data")
+	binary.Write(&b, binary.LittleEndian, uint32(data.Len()))
+	b.Write(data.Bytes())
+
+	return b.Bytes()
+}
+
+func readAll(t *testing.T, r pcm.Reader) (samples []int16, frames []*pcm.Frame) {
+	for {
+		f, err := r.Read()
+		if err == io.EOF {
+			return
+		}
+		if err != nil {
+			t.Fatalf("Read failed: %s", err)
+		}
+		frames = append(frames, f)
+		samples = append(samples, f.Data()...)
+	}
+}
+
+func ramp(n int, scale float64) []float64 {
+	x := make([]float64, n)
+	for i := range x {
+		x[i] = scale * float64(i%100) / 100
+	}
+	return x
+}
+
+func TestWavFormats(t *testing.T) {
+	const n = 5000
+	tests := []struct {
+		name   string
+		format uint16
+		bits   int
+	}{
+		{"8 bit", 1, 8},
+		{"16 bit", 1, 16},
+		{"24 bit", 1, 24},
+		{"32 bit", 1, 32},
+		{"float", 3, 32},
+	}
+
+	for _, test := range tests {
+		// stereo with opposite channels at half level gives a downmix of a quarter
+		left, right := ramp(n, 0.75), ramp(n, -0.25)
+		wav := makeWav(test.format, test.bits, 11025, [][]float64{left, right})
+
+		stream, err := pcm.NewWavStream(io.NopCloser(bytes.NewReader(wav)), 11025, 1024)
+		if err != nil {
+			t.Fatalf("%s: NewWavStream failed: %s", test.name, err)
+		}
+		samples, frames := readAll(t, stream)
+
+		if len(samples) != n {
+			t.Errorf("%s: got %d samples, expected %d", test.name, len(samples), n)
+			continue
+		}
+		if len(frames) != 5 || frames[3].Timestamp() != 3*1024/11025.0 {
+			t.Errorf("%s: got %d frames, fourth at %v", test.name, len(frames), frames[3].Timestamp())
+		}
+		tolerance := 2.0
+		if test.bits == 8 {
+			tolerance = 300
+		}
+		for i, s := range samples {
+			want := 0.25 * float64(i%100) / 100 * 32768
+			if math.Abs(float64(s)-want) > tolerance {
+				t.Errorf("%s: sample %d is %d, expected %.0f", test.name, i, s, want)
+				break
+			}
+		}
+	}
+}
+
+func TestWavResample(t *testing.T) {
+	const n = 22050
+	tone := make([]float64, n)
+	for i := range tone {
+		tone[i] = 0.5 * math.Sin(2*math.Pi*440*float64(i)/22050)
+	}
+	wav := makeWav(1, 16, 22050, [][]float64{tone})
+
+	stream, err := pcm.NewWavStream(io.NopCloser(bytes.NewReader(wav)), 11025, 2048)
+	if err != nil {
+		t.Fatalf("NewWavStream failed: %s", err)
+	}
+	samples, _ := readAll(t, stream)
+
+	if len(samples) < 11020 || len(samples) > 11030 {
+		t.Errorf("Resampling 1s of audio gave %d samples", len(samples))
+	}
+	// skip the ringing where the tone starts abruptly
+	for i := 100; i < 11000; i++ {
+		s := samples[i]
+		want := 0.5 * math.Sin(2*math.Pi*440*float64(i)/11025) * 32768
+		if math.Abs(float64(s)-want) > 20 {
+			t.Errorf("Resampled sample %d is %d, expected %.0f", i, s, want)
+			break
+		}
+	}
+}
+
+func TestUnsupportedWav(t *testing.T) {
+	wav := makeWav(2, 4, 11025, [][]float64{ramp(10, 0)}) // ADPCM
+	_, err := pcm.NewWavStream(io.NopCloser(bytes.NewReader(wav)), 11025, 1024)
+	if err == nil {
+		t.Errorf("ADPCM WAV accepted")
+	}
+}
+
+// The fmt chunk size comes from the file and can't be trusted
+func TestWavFmtSize(t *testing.T) {
+	wav := makeWav(1, 16, 11025, [][]float64{ramp(4096, 0.5)})
+	withSize := func(size uint32, extra int) []byte {
+		var b bytes.Buffer
+		b.Write(wav[:28])
+		binary.Write(&b, binary.LittleEndian, size)
+		b.Write(wav[32:48])
+		b.Write(make([]byte, extra))
+		b.Write(wav[48:])
+		return b.Bytes()
+	}
+
+	// bigger than any real fmt chunk, but only padding
+	stream, err := pcm.NewWavStream(io.NopCloser(bytes.NewReader(withSize(60, 44))), 11025, 1024)
+	if err != nil {
+		t.Fatalf("WAV with a padded fmt chunk failed: %s", err)
+	}
+	if samples, _ := readAll(t, stream); len(samples) != 4096 {
+		t.Errorf("Read %d samples after a padded fmt chunk, expected 4096", len(samples))
+	}
+
+	if _, err := pcm.NewWavStream(io.NopCloser(bytes.NewReader(withSize(0xfffffff0, 0))), 11025, 1024); err == nil {
+		t.Errorf("WAV with a 4GB fmt chunk accepted")
+	}
+}
+
+// Header fields that set the size of buffers can't be trusted either
+func TestWavCorruptFmt(t *testing.T) {
+	wav := makeWav(1, 16, 11025, [][]float64{ramp(4096, 0.5)})
+	tests := []struct {
+		name   string
+		offset int // of the field in the file
+		value  interface{}
+	}{
+		{"65535 channels", 34, uint16(0xffff)},
+		{"4GHz sample rate", 36, uint32(4000000000)},
+		{"wrong block align", 44, uint16(4)},
+	}
+	for _, test := range tests {
+		corrupt := append([]byte(nil), wav...)
+		var field bytes.Buffer
+		binary.Write(&field, binary.LittleEndian, test.value)
+		copy(corrupt[test.offset:], field.Bytes())
+		if _, err := pcm.NewWavStream(io.NopCloser(bytes.NewReader(corrupt)), 11025, 1024); err == nil {
+			t.Errorf("WAV with %s accepted", test.name)
+		}
+	}
+
+	// the most channels and fastest rate we take are fine
+	many := make([][]float64, 32)
+	for i := range many {
+		many[i] = ramp(768, 0.5)
+	}
+	stream, err := pcm.NewWavStream(io.NopCloser(bytes.NewReader(makeWav(1, 16, 768000, many))), 11025, 1024)
+	if err != nil {
+		t.Fatalf("WAV with 32 channels at 768kHz failed: %s", err)
+	}
+	readAll(t, stream)
+}
+
+func TestFileStreamNative(t *testing.T) {
+	dir := t.TempDir()
+
+	wavFile := filepath.Join(dir, "test.wav")
+	os.WriteFile(wavFile, makeWav(1, 16, 11025, [][]float64{ramp(3000, 0.5)}), 0644)
+
+	rawFile := filepath.Join(dir, "test.raw")
+	var raw bytes.Buffer
+	for _, x := range ramp(3000, 0.5) {
+		binary.Write(&raw, binary.LittleEndian, int16(x*32768))
+	}
+	os.WriteFile(rawFile, raw.Bytes(), 0644)
+
+	for _, filename := range []string{wavFile, rawFile} {
+		stream, err := pcm.NewFileStream(context.Background(), filename, 11025, 2048)
+		if err != nil {
+			t.Fatalf("NewFileStream(%s) failed: %s", filename, err)
+		}
+		samples, _ := readAll(t, stream)
+		stream.Close()
+		if len(samples) != 3000 {
+			t.Errorf("%s: got %d samples, expected 3000", filename, len(samples))
+		}
+	}
+}
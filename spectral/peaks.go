@@ -0,0 +1,222 @@
+package spectral
+
+import (
+	"math"
+	"sort"
+)
+
+/*
+ * peaks:
+ * Pick the peaks out of a spectrogram for constellation style fingerprinting.
+ * A peak is the strongest point in a time x frequency neighbourhood around it.  Rather than a fixed silence level,
+ * each peak must stand above the running median level of its frequency band, so quiet passages still give peaks
+ * and loud ones do not flood the index.  The number of peaks kept in each second is capped (strongest first), which
+ * is the main control over index size against robustness.
+ * The picker is streaming: columns are added as they are made and peaks are returned once they are final.
+ */
+
+type PeakOptions struct {
+	TimeRadius    int     // a peak must be the maximum over +/- this many columns
+	FreqRadius    int     // and +/- this many bins
+	Bands         int     // number of frequency bands with their own threshold
+	MedianColumns int     // columns in the running median of each band
+	Margin        float64 // how far above its band's median a peak must be
+	Floor         float64 // absolute minimum strength for a peak (silence)
+	MaxPerSecond  int     // most peaks kept in each second, 0 for no limit
+}
+
+// Streaming 2D peak picker
+type PeakPicker struct {
+	opts      PeakOptions
+	bandStart []int // first bin of each band, with the end of the last band at the end
+	freqs     []float64
+
+	cols       [][]float64 // recent columns, cols[0] is column number base
+	times      []float64
+	thresholds [][]float64 // threshold of each band for each of the recent columns
+	base       int
+	n          int         // columns added
+	checked    int         // columns [0, checked) have been checked for peaks
+	history    [][]float64 // recent band levels, for the running medians
+
+	bucket    []Point // peaks in the current second
+	bucketEnd float64 // time the current second ends
+	started   bool
+	done      int // peaks in columns [0, done) have all been returned
+}
+
+func NewPeakPicker(opts PeakOptions) *PeakPicker {
+	if opts.Bands < 1 {
+		opts.Bands = 1
+	}
+	if opts.MedianColumns < 1 {
+		opts.MedianColumns = 1
+	}
+
+	return &PeakPicker{
+		opts:    opts,
+		history: make([][]float64, opts.Bands),
+	}
+}
+
+// Columns [0, Done) are final: no more peaks will be returned for them
+func (p *PeakPicker) Done() int {
+	return p.done
+}
+
+// Add spectrogram columns and return any peaks that are now final
+func (p *PeakPicker) Add(s Spectrogram) []Point {
+	if p.bandStart == nil && len(s.Freqs) > 0 {
+		p.freqs = s.Freqs
+		p.bandStart = make([]int, p.opts.Bands+1)
+		for b := range p.bandStart {
+			p.bandStart[b] = b * len(s.Freqs) / p.opts.Bands
+		}
+	}
+
+	for c, col := range s.Pxx {
+		p.cols = append(p.cols, col)
+		p.times = append(p.times, s.Times[c])
+		p.thresholds = append(p.thresholds, p.threshold(col))
+		p.n++
+	}
+
+	// a column can only be checked once all of its neighbours have arrived
+	return p.check(p.n - p.opts.TimeRadius)
+}
+
+// The stream has finished, return the remaining peaks
+func (p *PeakPicker) Flush() []Point {
+	out := p.check(p.n)
+	out = append(out, p.release()...)
+	p.done = p.n
+
+	return out
+}
+
+// update the running medians with a new column, returning its band thresholds
+func (p *PeakPicker) threshold(col []float64) []float64 {
+	thresholds := make([]float64, p.opts.Bands)
+	for b := range thresholds {
+		lo, hi := p.bandStart[b], p.bandStart[b+1]
+		level := 0.0
+		for _, x := range col[lo:hi] {
+			level += x
+		}
+		if hi > lo {
+			level /= float64(hi - lo)
+		}
+
+		p.history[b] = append(p.history[b], level)
+		if len(p.history[b]) > p.opts.MedianColumns {
+			p.history[b] = p.history[b][1:]
+		}
+		thresholds[b] = math.Max(median(p.history[b])+p.opts.Margin, p.opts.Floor)
+	}
+
+	return thresholds
+}
+
+func median(x []float64) float64 {
+	s := append([]float64(nil), x...)
+	sort.Float64s(s)
+	if len(s)%2 == 1 {
+		return s[len(s)/2]
+	}
+	return (s[len(s)/2-1] + s[len(s)/2]) / 2
+}
+
+// check columns [checked, upto) for peaks
+func (p *PeakPicker) check(upto int) (out []Point) {
+	for ; p.checked < upto; p.checked++ {
+		c := p.checked
+		time := p.times[c-p.base]
+
+		if p.opts.MaxPerSecond > 0 {
+			if !p.started {
+				p.bucketEnd = time + 1
+				p.started = true
+			}
+			// the second is over, so its peaks can be capped and handed out
+			if time >= p.bucketEnd {
+				out = append(out, p.release()...)
+				p.done = c
+				for time >= p.bucketEnd {
+					p.bucketEnd++
+				}
+			}
+		}
+
+		col := p.cols[c-p.base]
+		thresholds := p.thresholds[c-p.base]
+		band := 0
+		for bin, v := range col {
+			for bin >= p.bandStart[band+1] {
+				band++
+			}
+			if v > thresholds[band] && p.isPeak(c, bin) {
+				p.bucket = append(p.bucket, Point{Column: c, Bin: bin, Time: time, Freq: p.freqs[bin], Pxx: v})
+			}
+		}
+
+		if p.opts.MaxPerSecond == 0 {
+			out = append(out, p.release()...)
+			p.done = c + 1
+		}
+	}
+
+	// columns are only needed for as long as they may be a neighbour of an unchecked column
+	drop := p.checked - p.opts.TimeRadius - p.base
+	if drop > 0 {
+		p.cols = append([][]float64(nil), p.cols[drop:]...)
+		p.times = append([]float64(nil), p.times[drop:]...)
+		p.thresholds = append([][]float64(nil), p.thresholds[drop:]...)
+		p.base += drop
+	}
+
+	return out
+}
+
+// hand out the strongest of the peaks in the current second, in time order
+func (p *PeakPicker) release() []Point {
+	peaks := p.bucket
+	p.bucket = nil
+
+	if p.opts.MaxPerSecond > 0 && len(peaks) > p.opts.MaxPerSecond {
+		sort.SliceStable(peaks, func(i, j int) bool { return peaks[i].Pxx > peaks[j].Pxx })
+		peaks = peaks[:p.opts.MaxPerSecond]
+		sort.SliceStable(peaks, func(i, j int) bool {
+			return peaks[i].Column < peaks[j].Column || (peaks[i].Column == peaks[j].Column && peaks[i].Bin < peaks[j].Bin)
+		})
+	}
+
+	return peaks
+}
+
+// check that nothing in the neighbourhood of (c, bin) is as strong.
+// Ties go to the earliest / lowest point so that flat areas give a single peak
+func (p *PeakPicker) isPeak(c, bin int) bool {
+	v := p.cols[c-p.base][bin]
+	for t := c - p.opts.TimeRadius; t <= c+p.opts.TimeRadius; t++ {
+		if t < p.base || t >= p.n {
+			continue
+		}
+		col := p.cols[t-p.base]
+		for f := bin - p.opts.FreqRadius; f <= bin+p.opts.FreqRadius; f++ {
+			if f < 0 || f >= len(col) || (t == c && f == bin) {
+				continue
+			}
+			if col[f] > v || (col[f] == v && (t < c || (t == c && f < bin))) {
+				return false
+			}
+		}
+	}
+
+	return true
+}
+
+// Pick the peaks from a whole spectrogram
+func (s Spectrogram) Peaks(opts PeakOptions) []Point {
+	p := NewPeakPicker(opts)
+	return append(p.Add(s), p.Flush()...)
+}
@@ -0,0 +1,135 @@
+package spectral_test
+
+import (
+	"github.com/snuffpuppet/spectre/spectral"
+	"math"
+	"math/rand"
+	"reflect"
+	"testing"
+)
+
+// A spectrogram of low level noise, one column every 10ms
+func noise(cols, bins int, seed int64, level func(bin int) float64) spectral.Spectrogram {
+	r := rand.New(rand.NewSource(seed))
+	s := spectral.NewSpectrogram(make([]float64, cols), make([]float64, bins), make([][]float64, cols))
+	for b := range s.Freqs {
+		s.Freqs[b] = float64(b) * 10
+	}
+	for c := range s.Pxx {
+		s.Times[c] = float64(c) / 100
+		s.Pxx[c] = make([]float64, bins)
+		for b := range s.Pxx[c] {
+			s.Pxx[c][b] = level(b) + r.Float64()*2 - 1
+		}
+	}
+	return s
+}
+
+var testOptions = spectral.PeakOptions{
+	TimeRadius:    3,
+	FreqRadius:    3,
+	Bands:         2,
+	MedianColumns: 50,
+	Margin:        3,
+	Floor:         10,
+}
+
+func TestPeaksAdaptive(t *testing.T) {
+	// a quiet lower band and a loud upper band
+	s := noise(200, 64, 1, func(bin int) float64 {
+		if bin < 32 {
+			return 20
+		}
+		return 50
+	})
+	s.Pxx[50][10] = 26  // stands out in the quiet band
+	s.Pxx[120][40] = 52 // louder, but not above the loud band's level
+	s.Pxx[150][45] = 60
+
+	peaks := s.Peaks(testOptions)
+	if len(peaks) != 2 {
+		t.Fatalf("Found %d peaks, expected 2: %v", len(peaks), peaks)
+	}
+	if peaks[0].Column != 50 || peaks[0].Bin != 10 || peaks[1].Column != 150 || peaks[1].Bin != 45 {
+		t.Errorf("Found peaks at %v", peaks)
+	}
+	if peaks[0].Time != 0.5 || peaks[0].Freq != 100 || peaks[0].Pxx != 26 {
+		t.Errorf("Peak is %s, expected 100Hz at 0.5s", peaks[0])
+	}
+}
+
+func TestPeaksPerSecond(t *testing.T) {
+	// strong random points everywhere, so there are far more peaks than wanted
+	s := noise(500, 64, 2, func(bin int) float64 { return 20 })
+	r := rand.New(rand.NewSource(3))
+	for i := 0; i < 2000; i++ {
+		s.Pxx[r.Intn(500)][r.Intn(64)] = 30 + r.Float64()*30
+	}
+
+	all := s.Peaks(testOptions)
+	opts := testOptions
+	opts.MaxPerSecond = 10
+	capped := s.Peaks(opts)
+
+	perSecond := make(map[int][]spectral.Point)
+	for _, p := range all {
+		sec := int(math.Floor(p.Time + 1e-9))
+		perSecond[sec] = append(perSecond[sec], p)
+	}
+	kept := make(map[int]int)
+	for i, p := range capped {
+		sec := int(math.Floor(p.Time + 1e-9))
+		kept[sec]++
+		if i > 0 && (p.Column < capped[i-1].Column) {
+			t.Fatalf("Capped peaks out of order at %d", i)
+		}
+		// nothing stronger in the same second was dropped
+		weaker := 0
+		for _, q := range perSecond[sec] {
+			if q.Pxx > p.Pxx {
+				weaker++
+			}
+		}
+		if weaker >= opts.MaxPerSecond {
+			t.Errorf("Peak %s kept over %d stronger ones", p, weaker)
+		}
+	}
+	for sec, n := range kept {
+		if n > opts.MaxPerSecond || (len(perSecond[sec]) >= opts.MaxPerSecond && n != opts.MaxPerSecond) {
+			t.Errorf("Second %d kept %d of %d peaks", sec, n, len(perSecond[sec]))
+		}
+	}
+}
+
+func TestPeakPickerStreaming(t *testing.T) {
+	s := noise(500, 64, 4, func(bin int) float64 { return 20 })
+	r := rand.New(rand.NewSource(5))
+	for i := 0; i < 1000; i++ {
+		s.Pxx[r.Intn(500)][r.Intn(64)] = 30 + r.Float64()*30
+	}
+	opts := testOptions
+	opts.MaxPerSecond = 10
+	batch := s.Peaks(opts)
+
+	p := spectral.NewPeakPicker(opts)
+	var streamed []spectral.Point
+	for c := 0; c < s.Len(); {
+		n := 1 + r.Intn(40)
+		if c+n > s.Len() {
+			n = s.Len() - c
+		}
+		chunk := spectral.NewSpectrogram(s.Times[c:c+n], s.Freqs, s.Pxx[c:c+n])
+		for _, pt := range p.Add(chunk) {
+			if pt.Column >= p.Done() {
+				t.Fatalf("Peak in column %d returned before the column was done (%d)", pt.Column, p.Done())
+			}
+			streamed = append(streamed, pt)
+		}
+		c += n
+	}
+	streamed = append(streamed, p.Flush()...)
+
+	if !reflect.DeepEqual(batch, streamed) {
+		t.Errorf("Streaming gave %d peaks, batch gave %d", len(streamed), len(batch))
+	}
+}
@@ -0,0 +1,295 @@
+package spectral
+
+import (
+	"bufio"
+	"fmt"
+	"github.com/mjibson/go-dsp/fft"
+	"github.com/mjibson/go-dsp/window"
+	"github.com/snuffpuppet/spectre/pcm"
+	"io"
+	"math"
+	"math/cmplx"
+)
+
+/*
+ * spectrogram:
+ * Time-frequency analysis of a stream.  Where Spectra holds a single spectrum for a whole block, a Spectrogram keeps
+ * a column for every STFT window so that events inside a block keep their position in time.
+ * The STFT is streaming: frames are added as they arrive and the columns that can be completed are returned, with
+ * the unused samples carried over to the next frame, so windows run across frame boundaries.
+ * Only cutting the stream into windows has to be done in order.  The transforms of the windows can be done on other
+ * goroutines (see Split) so that the FFTs of a long stream are spread over several cores.
+ */
+
+type Spectrogram struct {
+	Pxx   [][]float64 // Pxx[column][bin], the strength of each frequency in each window
+	Times []float64   // stream time of the first sample of each column's window
+	Freqs []float64   // frequency of each bin
+}
+
+// A single point in the time-frequency plane
+type Point struct {
+	Column, Bin int
+	Time, Freq  float64
+	Pxx         float64
+}
+
+func (p Point) String() string {
+	return fmt.Sprintf("%.3fs %7.2f(%5.2f)", p.Time, p.Freq, p.Pxx)
+}
+
+func NewSpectrogram(times, freqs []float64, pxx [][]float64) Spectrogram {
+	return Spectrogram{
+		Pxx:   pxx,
+		Times: times,
+		Freqs: freqs,
+	}
+}
+
+func (s Spectrogram) Len() int {
+	return len(s.Times)
+}
+
+// The spectrum of a single column
+func (s Spectrogram) Column(c int) Spectra {
+	return NewSpectra(s.Freqs, s.Pxx[c])
+}
+
+// Add the columns of another spectrogram of the same frequencies to the end
+func (s Spectrogram) Append(o Spectrogram) Spectrogram {
+	if s.Freqs == nil {
+		s.Freqs = o.Freqs
+	}
+	s.Pxx = append(s.Pxx, o.Pxx...)
+	s.Times = append(s.Times, o.Times...)
+
+	return s
+}
+
+// Convert strengths to dB, with anything below 1 taken as silence (0) in the same way as the block analysers
+func (s Spectrogram) DB() Spectrogram {
+	pxx := make([][]float64, len(s.Pxx))
+	for c, col := range s.Pxx {
+		pxx[c] = make([]float64, len(col))
+		for i, x := range col {
+			if x >= 1 {
+				pxx[c][i] = 10 * math.Log10(x)
+			}
+		}
+	}
+
+	return NewSpectrogram(s.Times, s.Freqs, pxx)
+}
+
+// Keep only the frequencies in the range [lo, hi]
+func (s Spectrogram) Band(lo, hi float64) Spectrogram {
+	first, last := len(s.Freqs), 0
+	for i, f := range s.Freqs {
+		if f >= lo && f <= hi {
+			if i < first {
+				first = i
+			}
+			last = i + 1
+		}
+	}
+	if first >= last {
+		first, last = 0, 0
+	}
+
+	pxx := make([][]float64, len(s.Pxx))
+	for c, col := range s.Pxx {
+		pxx[c] = col[first:last]
+	}
+
+	return NewSpectrogram(s.Times, s.Freqs[first:last], pxx)
+}
+
+// Zero out the points that do not pass the test, keeping the shape of the spectrogram
+func (s Spectrogram) Filter(f func(freq, power float64) bool) Spectrogram {
+	pxx := make([][]float64, len(s.Pxx))
+	for c, col := range s.Pxx {
+		pxx[c] = make([]float64, len(col))
+		for i, x := range col {
+			if f(s.Freqs[i], x) {
+				pxx[c][i] = x
+			}
+		}
+	}
+
+	return NewSpectrogram(s.Times, s.Freqs, pxx)
+}
+
+// Find the local maxima in the time-frequency plane: points that are stronger than everything within timeRadius
+// columns and freqRadius bins of them.  Ties go to the earliest / lowest point so that flat areas give a single
+// maximum and silence (0) is never a maximum.
+func (s Spectrogram) Maxima(timeRadius, freqRadius int) (maxima []Point) {
+	for c, col := range s.Pxx {
+		for bin, v := range col {
+			if v > 0 && s.isMaximum(c, bin, timeRadius, freqRadius) {
+				maxima = append(maxima, Point{Column: c, Bin: bin, Time: s.Times[c], Freq: s.Freqs[bin], Pxx: v})
+			}
+		}
+	}
+
+	return
+}
+
+func (s Spectrogram) isMaximum(c, bin, timeRadius, freqRadius int) bool {
+	v := s.Pxx[c][bin]
+	for t := c - timeRadius; t <= c+timeRadius; t++ {
+		if t < 0 || t >= len(s.Pxx) {
+			continue
+		}
+		col := s.Pxx[t]
+		for f := bin - freqRadius; f <= bin+freqRadius; f++ {
+			if f < 0 || f >= len(col) || (t == c && f == bin) {
+				continue
+			}
+			if col[f] > v || (col[f] == v && (t < c || (t == c && f < bin))) {
+				return false
+			}
+		}
+	}
+
+	return true
+}
+
+// Write the spectrogram as a greyscale PGM image (time across, frequency up) for visual debugging
+func (s Spectrogram) WritePGM(w io.Writer) error {
+	lo, hi := math.Inf(1), math.Inf(-1)
+	for _, col := range s.Pxx {
+		for _, x := range col {
+			lo = math.Min(lo, x)
+			hi = math.Max(hi, x)
+		}
+	}
+	scale := 0.0
+	if hi > lo {
+		scale = 255 / (hi - lo)
+	}
+
+	b := bufio.NewWriter(w)
+	fmt.Fprintf(b, "P5\n%d %d\n255\n", len(s.Pxx), len(s.Freqs))
+	for bin := len(s.Freqs) - 1; bin >= 0; bin-- {
+		for _, col := range s.Pxx {
+			b.WriteByte(byte((col[bin] - lo) * scale))
+		}
+	}
+
+	return b.Flush()
+}
+
+// Streaming short time Fourier transform over pcm frames
+type STFT struct {
+	fs, nfft, hop int
+	window        []float64
+	freqs         []float64
+
+	samples []float64 // samples not yet consumed by a full window
+	start   float64   // stream time of the first sample seen
+	started bool
+	n       int // columns generated so far
+}
+
+// Hann windowed STFT of nfft samples, starting a new window every hop samples
+func NewSTFT(fs, nfft, hop int) *STFT {
+	return NewWindowedSTFT(fs, nfft, hop, window.Hann(nfft))
+}
+
+// STFT with a window function of its own, which must be nfft long
+func NewWindowedSTFT(fs, nfft, hop int, w []float64) *STFT {
+	freqs := make([]float64, nfft/2+1)
+	for i := range freqs {
+		freqs[i] = float64(i) * float64(fs) / float64(nfft)
+	}
+
+	return &STFT{
+		fs:     fs,
+		nfft:   nfft,
+		hop:    hop,
+		window: w,
+		freqs:  freqs,
+	}
+}
+
+func (s *STFT) Freqs() []float64 {
+	return s.freqs
+}
+
+// Add a frame of audio and return the columns for all the windows it completes
+func (s *STFT) Add(frame *pcm.Frame) Spectrogram {
+	return s.Split(frame).Transform()
+}
+
+// The windows of samples completed by a frame, waiting to be transformed into spectrogram columns
+type Windows struct {
+	stft    *STFT
+	samples [][]float64
+	times   []float64
+}
+
+// Add a frame of audio and return the windows it completes.  Frames must be split in order but the windows can be
+// transformed on any goroutine, whatever has happened to the STFT since.
+func (s *STFT) Split(frame *pcm.Frame) Windows {
+	if !s.started {
+		s.start = frame.Timestamp()
+		s.started = true
+	}
+
+	w := Windows{stft: s}
+
+	// the windows share the samples, which are never written to again once the rest is copied off below
+	s.samples = append(s.samples, frame.AsFloat64()...)
+	for len(s.samples) >= s.nfft {
+		w.samples = append(w.samples, s.samples[:s.nfft])
+		w.times = append(w.times, s.start+float64(s.n*s.hop)/float64(s.fs))
+		s.n++
+		s.samples = s.samples[s.hop:]
+	}
+	s.samples = append([]float64(nil), s.samples...)
+
+	return w
+}
+
+// The spectrogram columns of the windows
+func (w Windows) Transform() Spectrogram {
+	out := NewSpectrogram(w.times, w.stft.freqs, make([][]float64, len(w.samples)))
+	for c, samples := range w.samples {
+		out.Pxx[c] = w.stft.column(samples)
+	}
+
+	return out
+}
+
+// the magnitude spectrum of a single window of samples
+func (s *STFT) column(samples []float64) []float64 {
+	x := make([]float64, s.nfft)
+	for i := range x {
+		x[i] = samples[i] * s.window[i]
+	}
+	spectrum := fft.FFTReal(x)
+
+	col := make([]float64, len(s.freqs))
+	for i := range col {
+		col[i] = cmplx.Abs(spectrum[i])
+	}
+
+	return col
+}
+
+// Build the spectrogram of everything left in a reader
+func ReadSpectrogram(in pcm.Reader, fs, nfft, hop int) (Spectrogram, error) {
+	stft := NewSTFT(fs, nfft, hop)
+	s := NewSpectrogram(nil, stft.Freqs(), nil)
+
+	for {
+		frame, err := in.Read()
+		if err == io.EOF || err == io.ErrUnexpectedEOF {
+			return s, nil
+		}
+		if err != nil {
+			return s, err
+		}
+		s = s.Append(stft.Add(frame))
+	}
+}
@@ -0,0 +1,94 @@
+package spectral_test
+
+import (
+	"github.com/snuffpuppet/spectre/pcm"
+	"github.com/snuffpuppet/spectre/spectral"
+	"io"
+	"math"
+	"testing"
+)
+
+const fs = 11025
+
+// Reader over samples in memory, cut into frames of the given size
+type sliceReader struct {
+	samples []int16
+	size    int
+	pos     int
+	blockId int
+}
+
+func (s *sliceReader) Read() (*pcm.Frame, error) {
+	if s.pos >= len(s.samples) {
+		return nil, io.EOF
+	}
+	n := s.size
+	if s.pos+n > len(s.samples) {
+		n = len(s.samples) - s.pos
+	}
+	frame := pcm.NewFrameAt(s.samples[s.pos:s.pos+n], s.blockId, float64(s.pos)/fs)
+	s.pos += n
+	s.blockId++
+
+	return &frame, nil
+}
+
+// Two tone bursts: 1000Hz at 0.5-0.7s and 3000Hz at 1.2-1.4s
+func bursts() []int16 {
+	samples := make([]int16, 2*fs)
+	for i := range samples {
+		t := float64(i) / fs
+		switch {
+		case t >= 0.5 && t < 0.7:
+			samples[i] = int16(8000 * math.Sin(2*math.Pi*1000*t))
+		case t >= 1.2 && t < 1.4:
+			samples[i] = int16(8000 * math.Sin(2*math.Pi*3000*t))
+		}
+	}
+	return samples
+}
+
+func TestSpectrogram(t *testing.T) {
+	s, err := spectral.ReadSpectrogram(&sliceReader{samples: bursts(), size: 2048}, fs, 1024, 256)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	cols := 1 + (2*fs-1024)/256
+	if s.Len() != cols || len(s.Pxx) != cols || len(s.Freqs) != 513 || len(s.Pxx[0]) != 513 {
+		t.Fatalf("Spectrogram is %d x %d (%d times), expected %d x 513", len(s.Pxx), len(s.Pxx[0]), s.Len(), cols)
+	}
+	for c, ts := range s.Times {
+		if math.Abs(ts-float64(c*256)/fs) > 1e-9 {
+			t.Fatalf("Column %d at %f", c, ts)
+		}
+	}
+
+	maxima := s.DB().Band(100, 5000).Filter(func(freq, pwr float64) bool { return pwr > 30 }).Maxima(50, 50)
+	if len(maxima) != 2 {
+		t.Fatalf("Found %d maxima, expected 2: %v", len(maxima), maxima)
+	}
+	want := []struct{ from, to, freq float64 }{{0.4, 0.7, 1000}, {1.1, 1.4, 3000}}
+	for i, m := range maxima {
+		if m.Time < want[i].from || m.Time > want[i].to || math.Abs(m.Freq-want[i].freq) > fs/1024.0 {
+			t.Errorf("Maximum %d at %s, expected %.0fHz between %.1fs and %.1fs", i, m, want[i].freq, want[i].from, want[i].to)
+		}
+	}
+}
+
+func TestSTFTFrames(t *testing.T) {
+	samples := bursts()
+	whole, _ := spectral.ReadSpectrogram(&sliceReader{samples: samples, size: len(samples)}, fs, 1024, 256)
+	pieces, _ := spectral.ReadSpectrogram(&sliceReader{samples: samples, size: 999}, fs, 1024, 256)
+
+	if whole.Len() != pieces.Len() {
+		t.Fatalf("Frame size changed the number of columns: %d and %d", whole.Len(), pieces.Len())
+	}
+	for c := range whole.Pxx {
+		for i := range whole.Pxx[c] {
+			if whole.Pxx[c][i] != pieces.Pxx[c][i] || whole.Times[c] != pieces.Times[c] {
+				t.Fatalf("Frame size changed column %d bin %d", c, i)
+			}
+		}
+	}
+}
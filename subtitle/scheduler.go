@@ -0,0 +1,118 @@
+package subtitle
+
+/*
+ * scheduler:
+ * Work out which cues should be on screen as the film position reported by the audio matcher changes.
+ * The position is only an estimate so it is expected to move about a little.  Small steps back are ignored
+ * (so cues are not replayed), steps forward within SEEK_THRESHOLD show any cues that were passed over between
+ * updates (so cues are not dropped, they are shown and hidden in the same update) and anything bigger is treated
+ * as a seek, where the display simply switches to the cues active at the new position.  A position that does not
+ * change (paused) changes nothing.
+ */
+
+const SEEK_THRESHOLD = 5.0   // forward jumps (seconds) bigger than this are treated as a seek
+const JITTER_TOLERANCE = 0.5 // backward steps smaller than this are ignored
+const LOOKAHEAD = 10.0       // how far ahead to report upcoming cues
+
+// The changes to the display after moving to a new position
+type Update struct {
+	Position float64
+	Seeked   bool  // the position jumped, Show and Hide reflect the switch to the new position
+	Show     []Cue // cues to display, in start order
+	Hide     []Cue // cues to remove from the display, including any passed over cues in Show
+	Active   []Cue // all the cues active at Position
+	Upcoming []Cue // cues starting within the lookahead
+}
+
+type Scheduler struct {
+	SeekThreshold   float64
+	JitterTolerance float64
+	Lookahead       float64
+
+	cues     []Cue
+	position float64
+	started  bool
+	showing  map[int]bool // indexes of the cues currently displayed
+}
+
+func NewScheduler(cues []Cue) *Scheduler {
+	sorted := append([]Cue(nil), cues...)
+	sortCues(sorted)
+
+	return &Scheduler{
+		SeekThreshold:   SEEK_THRESHOLD,
+		JitterTolerance: JITTER_TOLERANCE,
+		Lookahead:       LOOKAHEAD,
+		cues:            sorted,
+		showing:         make(map[int]bool),
+	}
+}
+
+// The last position given to Update (after jitter has been removed)
+func (s *Scheduler) Position() float64 {
+	return s.position
+}
+
+// Forget the current position so that the next update is treated like a seek
+func (s *Scheduler) Reset() (hide []Cue) {
+	for i := range s.cues {
+		if s.showing[i] {
+			hide = append(hide, s.cues[i])
+		}
+	}
+	s.showing = make(map[int]bool)
+	s.started = false
+
+	return
+}
+
+// Move to a new film position and work out what needs to change on the display
+func (s *Scheduler) Update(pos float64) (u Update) {
+	prev := s.position
+	delta := pos - prev
+
+	switch {
+	case !s.started:
+		u.Seeked = true
+	case delta < 0 && -delta < s.JitterTolerance:
+		pos = prev
+	case delta < 0 || delta > s.SeekThreshold:
+		u.Seeked = true
+	}
+	s.started = true
+	s.position = pos
+	u.Position = pos
+
+	active := make(map[int]bool)
+	var passed []Cue
+	for i, c := range s.cues {
+		if c.Start > pos+s.Lookahead {
+			break
+		}
+
+		switch {
+		case c.Contains(pos):
+			active[i] = true
+			u.Active = append(u.Active, c)
+			if !s.showing[i] {
+				u.Show = append(u.Show, c)
+			}
+		case !u.Seeked && c.Start > prev && c.End <= pos:
+			// started and finished between updates, show it anyway so it is not lost and hide it again straight away
+			u.Show = append(u.Show, c)
+			passed = append(passed, c)
+		case c.Start > pos:
+			u.Upcoming = append(u.Upcoming, c)
+		}
+	}
+
+	for i, c := range s.cues {
+		if s.showing[i] && !active[i] {
+			u.Hide = append(u.Hide, c)
+		}
+	}
+	u.Hide = append(u.Hide, passed...)
+	s.showing = active
+
+	return
+}
@@ -0,0 +1,59 @@
+package subtitle
+
+import (
+	"fmt"
+	"io"
+	"strings"
+)
+
+/*
+ * SRT:
+ *   1
+ *   00:00:20,000 --> 00:00:24,400
+ *   <i>Text of the subtitle</i>
+ *   over one or more lines
+ */
+
+func ParseSRT(r io.Reader) ([]Cue, error) {
+	blks, err := blocks(r)
+	if err != nil {
+		return nil, err
+	}
+
+	cues := make([]Cue, 0, len(blks))
+	for _, b := range blks {
+		// the sequence number is optional in practice, find the timing line
+		t := 0
+		for t < len(b) && !strings.Contains(b[t], "-->") {
+			t++
+		}
+		if t == len(b) {
+			return nil, fmt.Errorf("No timing line in cue starting '%s'", b[0])
+		}
+
+		start, end, settings, err := parseTiming(b[t])
+		if err != nil {
+			return nil, err
+		}
+
+		cue := Cue{
+			Start: start,
+			End:   end,
+			Raw:   b[t+1:],
+		}
+		if t > 0 {
+			cue.Id = strings.TrimSpace(b[t-1])
+		}
+		cue.Text, cue.Style = markup(cue.Raw)
+		if settings != "" {
+			// some files carry coordinates after the timings (X1:.. X2:..)
+			cue.Style.Settings = settings
+		}
+
+		cues = append(cues, cue)
+	}
+
+	sortCues(cues)
+
+	return cues, nil
+}
@@ -0,0 +1,210 @@
+package subtitle
+
+import (
+	"bufio"
+	"bytes"
+	"fmt"
+	"io"
+	"os"
+	"path/filepath"
+	"regexp"
+	"sort"
+	"strconv"
+	"strings"
+)
+
+/*
+ * subtitle:
+ * Parse SRT and WebVTT subtitle files into cues that can be scheduled against the film position
+ * found by the audio matcher.  All times are in seconds from the start of the film.
+ */
+
+const (
+	FORMAT_SRT = "srt"
+	FORMAT_VTT = "vtt"
+)
+
+// Styling applied to (some of) the text of a cue
+type Style struct {
+	Italic    bool
+	Bold      bool
+	Underline bool
+	Color     string // from <font color=...> (SRT) or <c.colour> (WebVTT)
+	Voice     string // speaker from <v Name> (WebVTT)
+	Settings  string // positioning: WebVTT cue settings or an SRT {\an8} style override
+}
+
+// A single subtitle that is displayed between Start and End
+type Cue struct {
+	Id    string
+	Start float64
+	End   float64
+	Text  []string // lines of text with the markup removed
+	Raw   []string // lines of text as they appear in the file
+	Style Style
+}
+
+func (c Cue) Contains(pos float64) bool {
+	return pos >= c.Start && pos < c.End
+}
+
+func (c Cue) String() string {
+	return fmt.Sprintf("[%s --> %s] %s", formatTime(c.Start), formatTime(c.End), strings.Join(c.Text, " / "))
+}
+
+// Load a subtitle file, using the file extension (or the contents) to decide on the format
+func Load(filename string) ([]Cue, error) {
+	data, err := os.ReadFile(filename)
+	if err != nil {
+		return nil, err
+	}
+
+	format := FORMAT_SRT
+	switch strings.ToLower(filepath.Ext(filename)) {
+	case ".vtt":
+		format = FORMAT_VTT
+	case ".srt":
+	default:
+		if bytes.HasPrefix(bytes.TrimPrefix(data, []byte("\uFEFF")), []byte("WEBVTT")) {
+			format = FORMAT_VTT
+		}
+	}
+
+	cues, err := Parse(bytes.NewReader(data), format)
+	if err != nil {
+		return nil, fmt.Errorf("Parsing subtitles %s: %s", filename, err)
+	}
+
+	return cues, nil
+}
+
+func Parse(r io.Reader, format string) ([]Cue, error) {
+	switch format {
+	case FORMAT_SRT:
+		return ParseSRT(r)
+	case FORMAT_VTT:
+		return ParseVTT(r)
+	}
+
+	return nil, fmt.Errorf("Unrecognised subtitle format: %s", format)
+}
+
+// Split the input into blank line separated blocks of lines
+func blocks(r io.Reader) ([][]string, error) {
+	var blocks [][]string
+	var block []string
+
+	scanner := bufio.NewScanner(r)
+	first := true
+	for scanner.Scan() {
+		line := strings.TrimRight(scanner.Text(), "\r")
+		if first {
+			line = strings.TrimPrefix(line, "\uFEFF")
+			first = false
+		}
+
+		if strings.TrimSpace(line) == "" {
+			if len(block) > 0 {
+				blocks = append(blocks, block)
+				block = nil
+			}
+			continue
+		}
+		block = append(block, line)
+	}
+	if len(block) > 0 {
+		blocks = append(blocks, block)
+	}
+
+	return blocks, scanner.Err()
+}
+
+// Matches the "start --> end [settings]" timing line of a cue
+var timingRe = regexp.MustCompile(`^\s*(\S+)\s+-->\s+(\S+)\s*(.*)$`)
+
+func parseTiming(line string) (start, end float64, settings string, err error) {
+	m := timingRe.FindStringSubmatch(line)
+	if m == nil {
+		return 0, 0, "", fmt.Errorf("Bad cue timing line: '%s'", line)
+	}
+	if start, err = parseTime(m[1]); err != nil {
+		return
+	}
+	if end, err = parseTime(m[2]); err != nil {
+		return
+	}
+
+	return start, end, strings.TrimSpace(m[3]), nil
+}
+
+// Parse a timestamp of the form [hh:]mm:ss[.,]ttt
+func parseTime(s string) (float64, error) {
+	parts := strings.Split(strings.Replace(s, ",", ".", 1), ":")
+	if len(parts) < 2 || len(parts) > 3 {
+		return 0, fmt.Errorf("Bad timestamp: '%s'", s)
+	}
+
+	secs, err := strconv.ParseFloat(parts[len(parts)-1], 64)
+	if err != nil {
+		return 0, fmt.Errorf("Bad timestamp: '%s'", s)
+	}
+
+	mult := 60.0
+	for i := len(parts) - 2; i >= 0; i-- {
+		n, err := strconv.Atoi(parts[i])
+		if err != nil {
+			return 0, fmt.Errorf("Bad timestamp: '%s'", s)
+		}
+		secs += float64(n) * mult
+		mult *= 60
+	}
+
+	return secs, nil
+}
+
+func formatTime(secs float64) string {
+	ms := int(secs*1000 + 0.5)
+	return fmt.Sprintf("%02d:%02d:%02d.%03d", ms/3600000, ms/60000%60, ms/1000%60, ms%1000)
+}
+
+var tagRe = regexp.MustCompile(`<[^>]*>`)
+var overrideRe = regexp.MustCompile(`\{\\[^}]*\}`)
+var colorRe = regexp.MustCompile(`(?i)color\s*=\s*"?([^">\s]+)"?`)
+
+// Pick out the styling from the markup in the text lines and return the plain text
+func markup(raw []string) (text []string, style Style) {
+	for _, line := range raw {
+		for _, tag := range tagRe.FindAllString(line, -1) {
+			name := strings.ToLower(strings.Trim(tag, "<>/ "))
+			switch {
+			case name == "i":
+				style.Italic = true
+			case name == "b":
+				style.Bold = true
+			case name == "u":
+				style.Underline = true
+			case strings.HasPrefix(name, "font"):
+				if m := colorRe.FindStringSubmatch(tag); m != nil {
+					style.Color = m[1]
+				}
+			case strings.HasPrefix(name, "c."):
+				// WebVTT classes, the first one is usually the colour
+				style.Color = strings.Split(strings.Trim(tag, "<>"), ".")[1]
+			case strings.HasPrefix(name, "v ") && !strings.HasPrefix(tag, "</"):
+				style.Voice = strings.TrimSpace(strings.Trim(tag, "<>")[2:])
+			}
+		}
+		for _, o := range overrideRe.FindAllString(line, -1) {
+			style.Settings = strings.Trim(o, "{}\\")
+		}
+
+		plain := overrideRe.ReplaceAllString(tagRe.ReplaceAllString(line, ""), "")
+		text = append(text, plain)
+	}
+
+	return
+}
+
+func sortCues(cues []Cue) {
+	sort.SliceStable(cues, func(i, j int) bool { return cues[i].Start < cues[j].Start })
+}
@@ -0,0 +1,137 @@
+package subtitle_test
+
+import (
+	"github.com/snuffpuppet/spectre/subtitle"
+	"strings"
+	"testing"
+)
+
+const srt = "\uFEFF1\r\n00:00:01,000 --> 00:00:03,500\r\n<i>Hello</i> there\r\n\r\n" +
+	"2\r\n00:00:04,000 --> 00:00:04,200\r\n{\\an8}Quick\r\n\r\n" +
+	"3\r\n00:01:00,000 --> 00:01:02,000\r\n<font color=\"#ffff00\">[DOOR SLAMS]</font>\r\nsecond line\r\n"
+
+const vtt = `WEBVTT - test
+
+NOTE this is a comment
+
+STYLE
+::cue { color: white }
+
+intro
+00:01.000 --> 00:03.500 line:0 align:start
+<v Narrator>Hello &amp; welcome</v>
+
+01:00:00.000 --> 01:00:02.000
+<c.yellow>Later</c>
+`
+
+func TestParseSRT(t *testing.T) {
+	cues, err := subtitle.Parse(strings.NewReader(srt), subtitle.FORMAT_SRT)
+	if err != nil {
+		t.Fatalf("ParseSRT failed: %s", err)
+	}
+	if len(cues) != 3 {
+		t.Fatalf("Expected 3 cues, got %d", len(cues))
+	}
+
+	c := cues[0]
+	if c.Id != "1" || c.Start != 1.0 || c.End != 3.5 || c.Text[0] != "Hello there" || !c.Style.Italic {
+		t.Errorf("First cue parsed incorrectly: %+v", c)
+	}
+	if cues[1].Style.Settings != "an8" || cues[1].Text[0] != "Quick" {
+		t.Errorf("Style override parsed incorrectly: %+v", cues[1])
+	}
+	if cues[2].Start != 60.0 || len(cues[2].Text) != 2 || cues[2].Style.Color != "#ffff00" {
+		t.Errorf("Third cue parsed incorrectly: %+v", cues[2])
+	}
+}
+
+func TestParseVTT(t *testing.T) {
+	cues, err := subtitle.Parse(strings.NewReader(vtt), subtitle.FORMAT_VTT)
+	if err != nil {
+		t.Fatalf("ParseVTT failed: %s", err)
+	}
+	if len(cues) != 2 {
+		t.Fatalf("Expected 2 cues, got %d", len(cues))
+	}
+
+	c := cues[0]
+	if c.Id != "intro" || c.Start != 1.0 || c.End != 3.5 || c.Text[0] != "Hello & welcome" {
+		t.Errorf("First cue parsed incorrectly: %+v", c)
+	}
+	if c.Style.Voice != "Narrator" || c.Style.Settings != "line:0 align:start" {
+		t.Errorf("First cue style parsed incorrectly: %+v", c.Style)
+	}
+	if cues[1].Start != 3600.0 || cues[1].Style.Color != "yellow" {
+		t.Errorf("Second cue parsed incorrectly: %+v", cues[1])
+	}
+}
+
+func TestParseBadTiming(t *testing.T) {
+	if _, err := subtitle.ParseSRT(strings.NewReader("1\n00:00:xx,000 --> 00:00:02,000\nText\n")); err == nil {
+		t.Errorf("Bad timestamp accepted")
+	}
+}
+
+func texts(cues []subtitle.Cue) (s []string) {
+	for _, c := range cues {
+		s = append(s, c.Text[0])
+	}
+	return
+}
+
+func TestScheduler(t *testing.T) {
+	cues, _ := subtitle.ParseSRT(strings.NewReader(srt))
+	s := subtitle.NewScheduler(cues)
+
+	steps := []struct {
+		pos    float64
+		seeked bool
+		show   string
+		hide   string
+	}{
+		{0.5, true, "", ""},
+		{1.5, false, "Hello there", ""},
+		{2.0, false, "", ""},                       // nothing new
+		{2.0, false, "", ""},                       // paused
+		{1.8, false, "", ""},                       // jitter back, not replayed
+		{4.5, false, "Quick", "Hello there,Quick"}, // passed over "Quick" between updates
+		{61.0, true, "[DOOR SLAMS]", ""},           // seek forward, no catch up
+		{1.0, true, "Hello there", "[DOOR SLAMS]"}, // seek back, replayed
+	}
+
+	for i, step := range steps {
+		u := s.Update(step.pos)
+		if u.Seeked != step.seeked {
+			t.Errorf("Step %d: seeked %v, expected %v", i, u.Seeked, step.seeked)
+		}
+		if got := strings.Join(texts(u.Show), ","); got != step.show {
+			t.Errorf("Step %d: show '%s', expected '%s'", i, got, step.show)
+		}
+		if got := strings.Join(texts(u.Hide), ","); got != step.hide {
+			t.Errorf("Step %d: hide '%s', expected '%s'", i, got, step.hide)
+		}
+	}
+}
+
+// A short cue passed over between updates is flashed up, it must come down again or it stays on screen for good
+func TestSchedulerPassedCue(t *testing.T) {
+	cues, _ := subtitle.ParseSRT(strings.NewReader(srt))
+	s := subtitle.NewScheduler(cues)
+
+	s.Update(3.8)
+	u := s.Update(4.3)
+	if got := strings.Join(texts(u.Show), ","); got != "Quick" {
+		t.Errorf("Passing over the cue showed '%s'", got)
+	}
+	if got := strings.Join(texts(u.Hide), ","); got != "Quick" {
+		t.Errorf("Passing over the cue hid '%s'", got)
+	}
+	if len(u.Active) != 0 {
+		t.Errorf("Passed over cue is still active: %v", texts(u.Active))
+	}
+
+	if u := s.Update(5.0); len(u.Show) != 0 || len(u.Hide) != 0 {
+		t.Errorf("Next update showed %v and hid %v", texts(u.Show), texts(u.Hide))
+	}
+}
@@ -0,0 +1,72 @@
+package subtitle
+
+import (
+	"fmt"
+	"io"
+	"strings"
+)
+
+/*
+ * WebVTT:
+ *   WEBVTT
+ *
+ *   NOTE comments, STYLE and REGION blocks are skipped
+ *
+ *   optional-id
+ *   00:20.000 --> 00:24.400 line:0 align:start
+ *   <v Narrator>Text of the subtitle</v>
+ * ref: https://www.w3.org/TR/webvtt1/
+ */
+
+var entities = strings.NewReplacer("&amp;", "&", "&lt;", "<", "&gt;", ">", "&nbsp;", " ", "&lrm;", "", "&rlm;", "")
+
+func ParseVTT(r io.Reader) ([]Cue, error) {
+	blks, err := blocks(r)
+	if err != nil {
+		return nil, err
+	}
+
+	if len(blks) == 0 || !strings.HasPrefix(blks[0][0], "WEBVTT") {
+		return nil, fmt.Errorf("Missing WEBVTT header")
+	}
+
+	cues := make([]Cue, 0, len(blks))
+	for _, b := range blks[1:] {
+		if strings.HasPrefix(b[0], "NOTE") || b[0] == "STYLE" || b[0] == "REGION" {
+			continue
+		}
+
+		t := 0
+		if !strings.Contains(b[0], "-->") {
+			t = 1
+		}
+		if t >= len(b) || !strings.Contains(b[t], "-->") {
+			return nil, fmt.Errorf("No timing line in cue starting '%s'", b[0])
+		}
+
+		start, end, settings, err := parseTiming(b[t])
+		if err != nil {
+			return nil, err
+		}
+
+		cue := Cue{
+			Start: start,
+			End:   end,
+			Raw:   b[t+1:],
+		}
+		if t > 0 {
+			cue.Id = b[0]
+		}
+		cue.Text, cue.Style = markup(cue.Raw)
+		for i := range cue.Text {
+			cue.Text[i] = entities.Replace(cue.Text[i])
+		}
+		cue.Style.Settings = settings
+
+		cues = append(cues, cue)
+	}
+
+	sortCues(cues)
+
+	return cues, nil
+}